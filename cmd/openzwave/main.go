@@ -0,0 +1,29 @@
+// Package main with the openzwave publisher command line entry point
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+)
+
+// DefaultOnceTimeout is the default max wait for the initial node discovery in once mode
+const DefaultOnceTimeout = 300 * time.Second
+
+// Run the openzwave publisher
+// Exit codes are defined in internal.ExitCode...
+func main() {
+	options := internal.RunOptions{}
+	flag.StringVar(&options.ConfigFolder, "c", "", "Configuration folder with openzwave.yaml and messenger.yaml. Default is ~/.config/iotdomain")
+	flag.StringVar(&options.Gateway, "gateway", "", "Controller device, eg /dev/ttyACM0. Default is from the configuration or automatic")
+	flag.StringVar(&options.LogLevel, "loglevel", "", "Logging level: error, warning, info or debug. Default is from the configuration")
+	flag.BoolVar(&options.Once, "once", false, "Exit after the initial node discovery instead of running in the foreground until stopped")
+	flag.StringVar(&options.Phase, "phase", "", "Controller phase that completes the node discovery in once mode: driverReady, awakeNodesQueried or allNodesQueried. Default is awakeNodesQueried")
+	flag.DurationVar(&options.Timeout, "timeout", DefaultOnceTimeout, "Max wait for the initial node discovery in once mode")
+	flag.Parse()
+
+	exitCode := internal.Run(options)
+	os.Exit(exitCode)
+}
@@ -0,0 +1,410 @@
+// Package main with the ozwctl command for managing the zwave network of a running openzwave publisher
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+)
+
+// DefaultCommandTimeout is the default max duration of adding or removing a node
+const DefaultCommandTimeout = 60 * time.Second
+
+// ProgressInterval is the interval of checking the progress of adding or removing a node
+const ProgressInterval = time.Second
+
+const usage = `Usage: ozwctl [options] command [arguments]
+
+Commands:
+  network                          show the controllers and the state of their network
+  nodes                            list the nodes with their model and status
+  node <hwid>                      show the attributes, configuration, status and values of a node
+  set <hwid> <valueID> <value>     set a value of a node
+  config <hwid> <name> <value>     set a configuration attribute of a node
+  include                          add a node and show the progress until done
+  exclude                          remove a node and show the progress until done
+  heal                             heal the network
+  learn                            join another network and show the progress until done
+  createprimary                    become the primary when the old primary failed and show the progress
+  transferprimary                  transfer the primary role to another controller and show the progress
+  replicate <hwid>                 copy the network information to a secondary controller node
+  softreset                        restart the controller without erasing its network
+  hardreset                        request a factory reset of the controller and show the confirmation token
+  confirmreset <token>             reset the controller to factory defaults, erasing its network
+  backup                           save the network in a backup archive in the cache folder of the publisher
+  restore <file>                   restore the network from a backup archive in the cache folder
+  refresh <hwid>                   refresh the node info
+  removefailed <hwid>              remove a failed node
+  replacefailed <hwid>             replace a failed node and show the progress until restored
+  provisioning                     list the devices in the provisioning list
+  provision <dsk> <name> <location> [profile]
+                                   add a device to the provisioning list with the name, location and profile to apply
+  unprovision <dsk>                remove a device from the provisioning list
+  includedsk <dsk>                 start the provisioned inclusion of a device and show the progress until done
+  returnroute <hwid>               update the return route of a node to the controller
+
+The publisher must be configured with apiAddress. Use -token with the apiToken of the publisher, if any.
+
+Options:
+`
+
+// Manage the zwave network of a running openzwave publisher through its HTTP API
+func main() {
+	address := flag.String("api", internal.DefaultAPIAddress, "Address of the publisher HTTP API")
+	token := flag.String("token", "", "API token, see apiToken in the publisher configuration")
+	homeID := flag.String("home", "", "Home ID in hex of the network for network commands. Default is the first controller")
+	timeout := flag.Duration("timeout", DefaultCommandTimeout, "Max duration of include, exclude, learn, primary changes and replacefailed")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	client := internal.NewAPIClient(*address, *token)
+	err := runCommand(client, args[0], args[1:], *homeID, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ozwctl %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+// runCommand runs a command with its arguments
+func runCommand(client *internal.APIClient, command string, args []string, homeID string, timeout time.Duration) error {
+	requiredArgs := map[string]int{
+		"network": 0, "nodes": 0, "node": 1, "set": 3, "config": 3, "include": 0, "exclude": 0,
+		"heal": 0, "refresh": 1, "removefailed": 1, "replacefailed": 1,
+		"learn": 0, "createprimary": 0, "transferprimary": 0, "replicate": 1, "returnroute": 1,
+		"softreset": 0, "hardreset": 0, "confirmreset": 1,
+		"backup": 0, "restore": 1,
+		"provisioning": 0, "provision": 3, "unprovision": 1, "includedsk": 1,
+	}
+	optionalArgs := map[string]int{"provision": 1}
+	argCount, found := requiredArgs[command]
+	if !found {
+		return fmt.Errorf("unknown command. Use -h for help")
+	}
+	if len(args) < argCount || len(args) > argCount+optionalArgs[command] {
+		return fmt.Errorf("expected %d arguments, got %d. Use -h for help", argCount, len(args))
+	}
+	switch command {
+	case "network":
+		return showNetwork(client)
+	case "nodes":
+		return showNodes(client)
+	case "node":
+		return showNode(client, args[0])
+	case "set":
+		return client.SetValue(args[0], args[1], args[2])
+	case "config":
+		return client.SetConfig(args[0], types.NodeAttrMap{types.NodeAttr(args[1]): args[2]})
+	case "include":
+		return followNetworkCommand(client, "inclusion", homeID, "", timeout)
+	case "exclude":
+		return followNetworkCommand(client, "exclusion", homeID, "", timeout)
+	case "heal":
+		return client.NetworkCommand("heal", homeID)
+	case "learn":
+		return followNetworkCommand(client, "learnmode", homeID, "", timeout)
+	case "createprimary", "transferprimary":
+		return followNetworkCommand(client, command, homeID, "", timeout)
+	case "softreset":
+		return client.NetworkCommand("softreset", homeID)
+	case "hardreset":
+		token, err := client.HardReset(homeID, "")
+		if err == nil {
+			fmt.Printf("A hard reset erases the network and all nodes have to be added again.\n"+
+				"To confirm run within %d seconds: ozwctl confirmreset %s\n", internal.ResetConfirmTimeout, token)
+		}
+		return err
+	case "confirmreset":
+		_, err := client.HardReset(homeID, args[0])
+		return err
+	case "backup":
+		file, err := client.BackupNetwork(homeID)
+		if err == nil {
+			fmt.Printf("Network saved in %s\n", file)
+		}
+		return err
+	case "restore":
+		return client.RestoreNetwork(homeID, args[0])
+	case "provisioning":
+		return showProvisioning(client)
+	case "provision":
+		entry := internal.ProvisioningEntry{DSK: args[0], Name: args[1], Location: args[2]}
+		if len(args) > 3 {
+			entry.Profile = args[3]
+		}
+		return client.AddProvisioning(entry)
+	case "unprovision":
+		return client.RemoveProvisioning(args[0])
+	case "includedsk":
+		return followNetworkCommand(client, "inclusion", homeID, args[0], timeout)
+	case "replicate":
+		return client.NodeCommand(args[0], "replicate")
+	case "returnroute":
+		return client.NodeCommand(args[0], "assignreturnroute")
+	case "refresh", "removefailed":
+		return client.NodeCommand(args[0], command)
+	case "replacefailed":
+		return followReplaceCommand(client, args[0], timeout)
+	}
+	return nil
+}
+
+// showNetwork prints the controllers
+func showNetwork(client *internal.APIClient) error {
+	controllers, err := client.GetControllers()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GATEWAY\tHOME ID\tNODE\tPHASE\tROLE\tSUC\tCOMMAND")
+	for _, controller := range controllers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", controller.Gateway, controller.HomeID, controller.NodeHWID,
+			controller.Phase, controller.Role, controller.SUCNodeID, controller.Command)
+	}
+	return w.Flush()
+}
+
+// showProvisioning prints the provisioning list
+func showProvisioning(client *internal.APIClient) error {
+	entries, err := client.GetProvisioning()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DSK\tNAME\tLOCATION\tPROFILE\tSTATE\tNODE")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.DSK, entry.Name, entry.Location, entry.Profile,
+			entry.State, entry.NodeHWID)
+	}
+	return w.Flush()
+}
+
+// showNodes prints the nodes ordered by HWID
+func showNodes(client *internal.APIClient) error {
+	nodes, err := client.GetNodes()
+	if err != nil {
+		return err
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].HWID < nodes[j].HWID
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HWID\tNAME\tMANUFACTURER\tMODEL\tSTATE\tLAST SEEN\tLAST ERROR")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node.HWID,
+			node.Attr[types.NodeAttrName], node.Attr[types.NodeAttrManufacturer], node.Attr[types.NodeAttrModel],
+			node.Status[types.NodeStatusRunState], node.Status[types.NodeStatusLastSeen],
+			node.Status[types.NodeStatusLastError])
+	}
+	return w.Flush()
+}
+
+// showNode prints the attributes, configuration, status and values of a node
+func showNode(client *internal.APIClient, nodeHWID string) error {
+	node, err := client.GetNode(nodeHWID)
+	if err != nil {
+		return err
+	}
+	values, err := client.GetNodeValues(nodeHWID)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Node %s (%s)\n\nATTRIBUTE\tVALUE\n", node.HWID, node.Address)
+	attrNames := make([]string, 0, len(node.Attr))
+	for attrName := range node.Attr {
+		if _, isConfig := node.Config[attrName]; !isConfig {
+			attrNames = append(attrNames, string(attrName))
+		}
+	}
+	sort.Strings(attrNames)
+	for _, attrName := range attrNames {
+		fmt.Fprintf(w, "%s\t%s\n", attrName, node.Attr[types.NodeAttr(attrName)])
+	}
+
+	fmt.Fprintln(w, "\nCONFIGURATION\tVALUE\tDEFAULT\tDESCRIPTION")
+	configNames := make([]string, 0, len(node.Config))
+	for attrName := range node.Config {
+		configNames = append(configNames, string(attrName))
+	}
+	sort.Strings(configNames)
+	for _, configName := range configNames {
+		configAttr := node.Config[types.NodeAttr(configName)]
+		value := node.Attr[types.NodeAttr(configName)]
+		if configAttr.Secret {
+			value = "*****"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", configName, value, configAttr.Default, configAttr.Description)
+	}
+
+	fmt.Fprintln(w, "\nSTATUS\tVALUE")
+	statusNames := make([]string, 0, len(node.Status))
+	for statusName := range node.Status {
+		statusNames = append(statusNames, string(statusName))
+	}
+	sort.Strings(statusNames)
+	for _, statusName := range statusNames {
+		fmt.Fprintf(w, "%s\t%s\n", statusName, node.Status[types.NodeStatus(statusName)])
+	}
+
+	fmt.Fprintln(w, "\nVALUE ID\tLABEL\tVALUE\tUNITS\tGENRE\tREADONLY\tINPUT/OUTPUT")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%s\n", value.ID, value.Label, value.Value, value.Units,
+			value.Genre, value.ReadOnly, strings.Trim(value.InputID+" "+value.OutputID, " "))
+	}
+	return w.Flush()
+}
+
+// getNodeHWIDs returns the set of node HWIDs of the publisher
+func getNodeHWIDs(client *internal.APIClient) (map[string]bool, error) {
+	nodes, err := client.GetNodes()
+	nodeHWIDs := make(map[string]bool)
+	for _, node := range nodes {
+		nodeHWIDs[node.HWID] = true
+	}
+	return nodeHWIDs, err
+}
+
+// getCommandState returns the controller command state of the network, or of the first controller
+func getCommandState(client *internal.APIClient, homeID string) (string, error) {
+	controllers, err := client.GetControllers()
+	if err != nil {
+		return "", err
+	}
+	for _, controller := range controllers {
+		if homeID == "" || strings.EqualFold(controller.HomeID, homeID) {
+			return controller.Command, nil
+		}
+	}
+	return "", fmt.Errorf("no controller for network %s", homeID)
+}
+
+// followNetworkCommand starts the inclusion or exclusion of a node and shows the controller command state
+// and the nodes that are added or removed, until the command is done. The command is stopped on timeout or
+// when interrupted. A DSK includes the device of the provisioning list.
+func followNetworkCommand(client *internal.APIClient, command string, homeID string, dsk string, timeout time.Duration) error {
+	knownNodes, err := getNodeHWIDs(client)
+	if err != nil {
+		return err
+	}
+	initialState, err := getCommandState(client, homeID)
+	if err != nil {
+		return err
+	}
+	if dsk != "" {
+		err = client.IncludeProvisioned(homeID, dsk)
+	} else {
+		err = client.NetworkCommand(command+"/start", homeID)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Started %s. Press the button on the device. Ctrl-C to stop.\n", command)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	lastState := initialState
+	for {
+		select {
+		case <-interrupt:
+			fmt.Printf("Stopping %s\n", command)
+			return client.NetworkCommand(command+"/stop", homeID)
+		case <-deadline:
+			fmt.Printf("Timeout. Stopping %s\n", command)
+			return client.NetworkCommand(command+"/stop", homeID)
+		case <-ticker.C:
+		}
+		nodeHWIDs, err := getNodeHWIDs(client)
+		if err != nil {
+			return err
+		}
+		for nodeHWID := range nodeHWIDs {
+			if !knownNodes[nodeHWID] {
+				fmt.Printf("Node %s added\n", nodeHWID)
+			}
+		}
+		for nodeHWID := range knownNodes {
+			if !nodeHWIDs[nodeHWID] {
+				fmt.Printf("Node %s removed\n", nodeHWID)
+			}
+		}
+		knownNodes = nodeHWIDs
+		state, err := getCommandState(client, homeID)
+		if err != nil {
+			return err
+		}
+		if state == lastState {
+			continue
+		}
+		fmt.Printf("Controller: %s\n", state)
+		lastState = state
+		if internal.IsControllerCommandDone(state) {
+			if state != internal.ControllerCommandCompleted {
+				return fmt.Errorf("%s ended with state %s", command, state)
+			}
+			return nil
+		}
+	}
+}
+
+// followReplaceCommand starts the replacement of a failed node and shows its progress until the new device
+// is restored or the replacement failed. The publisher keeps waiting for the new device after a timeout.
+func followReplaceCommand(client *internal.APIClient, nodeHWID string, timeout time.Duration) error {
+	err := client.NodeCommand(nodeHWID, "replacefailed")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Started replacing node %s. Press the button on the new device. Ctrl-C to stop following.\n", nodeHWID)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	lastState := ""
+	for {
+		select {
+		case <-interrupt:
+			return nil
+		case <-deadline:
+			return fmt.Errorf("timeout. The node is not restored yet")
+		case <-ticker.C:
+		}
+		node, err := client.GetNode(nodeHWID)
+		if err != nil {
+			return err
+		}
+		state := node.Status[internal.NodeStatusReplaceState]
+		if state == lastState {
+			continue
+		}
+		fmt.Printf("Replacement: %s\n", state)
+		lastState = state
+		switch internal.ReplaceState(state) {
+		case internal.ReplaceStateRestored:
+			if lastError := node.Status[types.NodeStatusLastError]; lastError != "" {
+				fmt.Printf("Configuration not restored: %s\n", lastError)
+			}
+			return nil
+		case internal.ReplaceStateFailed:
+			return fmt.Errorf("replacement failed: %s", node.Status[types.NodeStatusLastError])
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHomeID = "e1f2a3b4"
+
+// testAPI is a publisher HTTP API that records the requests it receives
+// Once a network command is started, each request for the network returns the next command state and the
+// node is added when the last state is returned.
+type testAPI struct {
+	commandStates []string // controller command states after the command is started
+	addedNode     string   // node that is added when the command is done
+	requests      []string // method and URI of the received requests
+	nodes         []*types.NodeDiscoveryMessage
+	isStarted     bool
+	updateMutex   sync.Mutex
+}
+
+// ServeHTTP records the request and serves the network, the nodes and commands
+func (api *testAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.updateMutex.Lock()
+	defer api.updateMutex.Unlock()
+	api.requests = append(api.requests, r.Method+" "+r.URL.RequestURI())
+	path := strings.TrimPrefix(r.URL.Path, internal.APIPathPrefix)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && path == "network":
+		controller := &internal.APIController{HomeID: testHomeID, NodeHWID: testHomeID + "-1",
+			Phase: string(internal.ControllerPhaseAwakeNodesQueried), Command: internal.ControllerCommandNormal}
+		if api.isStarted && len(api.commandStates) > 0 {
+			controller.Command = api.commandStates[0]
+			api.commandStates = api.commandStates[1:]
+			if len(api.commandStates) == 0 && api.addedNode != "" {
+				api.nodes = append(api.nodes, &types.NodeDiscoveryMessage{HWID: api.addedNode})
+			}
+		}
+		json.NewEncoder(w).Encode([]*internal.APIController{controller})
+	case r.Method == http.MethodGet && path == "nodes":
+		json.NewEncoder(w).Encode(api.nodes)
+	case r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&internal.APIStatus{Error: "Unknown node"})
+	default:
+		if strings.HasSuffix(path, "/start") {
+			api.isStarted = true
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(&internal.APIStatus{Status: "accepted"})
+	}
+}
+
+// setCommandStates sets the command states to return once the next command is started
+func (api *testAPI) setCommandStates(addedNode string, commandStates ...string) {
+	api.updateMutex.Lock()
+	defer api.updateMutex.Unlock()
+	api.isStarted = false
+	api.addedNode = addedNode
+	api.commandStates = commandStates
+}
+
+// getRequests returns the requests received since the last call
+func (api *testAPI) getRequests() []string {
+	api.updateMutex.Lock()
+	defer api.updateMutex.Unlock()
+	requests := api.requests
+	api.requests = nil
+	return requests
+}
+
+// newTestAPI starts a test publisher API with the controller node
+func newTestAPI() (*testAPI, *httptest.Server, *internal.APIClient) {
+	api := &testAPI{nodes: []*types.NodeDiscoveryMessage{{HWID: testHomeID + "-1"}}}
+	server := httptest.NewServer(api)
+	return api, server, internal.NewAPIClient(server.URL, "")
+}
+
+func TestRunCommandArguments(t *testing.T) {
+	api, server, client := newTestAPI()
+	defer server.Close()
+
+	err := runCommand(client, "unknown", nil, "", time.Second)
+	assert.Error(t, err)
+	// neighbors aren't supported by goopenzwave
+	err = runCommand(client, "neighbors", []string{"5"}, "", time.Second)
+	assert.Error(t, err)
+	err = runCommand(client, "refresh", nil, "", time.Second)
+	assert.Error(t, err)
+	err = runCommand(client, "heal", []string{"5"}, "", time.Second)
+	assert.Error(t, err)
+	err = runCommand(client, "provision", []string{"dsk", "name", "kitchen", "profile", "extra"}, "", time.Second)
+	assert.Error(t, err)
+	assert.Empty(t, api.getRequests())
+}
+
+func TestRunCommand(t *testing.T) {
+	api, server, client := newTestAPI()
+	defer server.Close()
+
+	commands := []struct {
+		args    []string
+		request string
+	}{
+		{[]string{"heal"}, "POST /api/network/heal?homeID=" + testHomeID},
+		{[]string{"softreset"}, "POST /api/network/softreset?homeID=" + testHomeID},
+		{[]string{"refresh", "5"}, "POST /api/nodes/5/refresh"},
+		{[]string{"removefailed", "5"}, "POST /api/nodes/5/removefailed"},
+		{[]string{"returnroute", "5"}, "POST /api/nodes/5/assignreturnroute"},
+		{[]string{"replicate", "2"}, "POST /api/nodes/2/replicate"},
+		{[]string{"set", "5", "1001", "on"}, "PUT /api/nodes/5/values/1001"},
+		{[]string{"config", "5", "name", "kitchen"}, "PUT /api/nodes/5/config"},
+		{[]string{"restore", "backup.zip"}, "POST /api/network/restore?file=backup.zip&homeID=" + testHomeID},
+		{[]string{"provision", "dsk", "name", "kitchen"}, "POST /api/provisioning"},
+		{[]string{"provision", "dsk", "name", "kitchen", "profile"}, "POST /api/provisioning"},
+		{[]string{"unprovision", "dsk"}, "DELETE /api/provisioning/dsk"},
+		{[]string{"network"}, "GET /api/network"},
+		{[]string{"nodes"}, "GET /api/nodes"},
+	}
+	for _, command := range commands {
+		err := runCommand(client, command.args[0], command.args[1:], testHomeID, time.Second)
+		assert.NoError(t, err, "command %v", command.args)
+		assert.Equal(t, []string{command.request}, api.getRequests(), "command %v", command.args)
+	}
+
+	// errors of the publisher are returned
+	err := runCommand(client, "node", []string{"99"}, "", time.Second)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unknown node")
+	}
+}
+
+func TestFollowNetworkCommand(t *testing.T) {
+	api, server, client := newTestAPI()
+	defer server.Close()
+
+	// the added node is shown until the controller reports the command completed
+	api.setCommandStates(testHomeID+"-5", internal.ControllerCommandCompleted)
+	err := runCommand(client, "include", nil, "", 5*time.Second)
+	assert.NoError(t, err)
+	assert.Contains(t, api.getRequests(), "POST /api/network/inclusion/start")
+
+	// a failed command is reported
+	api.setCommandStates("", internal.ControllerCommandFailed)
+	err = runCommand(client, "exclude", nil, testHomeID, 5*time.Second)
+	assert.Error(t, err)
+	assert.Contains(t, api.getRequests(), "POST /api/network/exclusion/start?homeID="+testHomeID)
+
+	// the command is stopped on timeout
+	api.setCommandStates("", internal.ControllerCommandWaiting)
+	err = runCommand(client, "learn", nil, "", 10*time.Millisecond)
+	assert.NoError(t, err)
+	requests := api.getRequests()
+	assert.Contains(t, requests, "POST /api/network/learnmode/start")
+	assert.Equal(t, "POST /api/network/learnmode/stop", requests[len(requests)-1])
+
+	// a provisioned device is included with its DSK
+	api.setCommandStates("", internal.ControllerCommandCompleted)
+	err = runCommand(client, "includedsk", []string{"dsk"}, "", 5*time.Second)
+	assert.NoError(t, err)
+	assert.Contains(t, api.getRequests(), "POST /api/network/inclusion/start?dsk=dsk")
+}
@@ -0,0 +1,196 @@
+// Package internal with the client of the local HTTP JSON API of a running publisher
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+)
+
+// APIClientTimeout is the max time in seconds of a request to the HTTP API
+const APIClientTimeout = 30
+
+// APIClient talks to the HTTP API of a running publisher, see ServeAPI
+type APIClient struct {
+	baseURL    string
+	token      string // API token of the publisher, "" if none is configured
+	httpClient *http.Client
+}
+
+// request sends a request with an optional JSON body to the API and decodes the JSON response, if any.
+// Failed requests return the error reported by the publisher.
+func (client *APIClient) request(method string, path string, body interface{}, response interface{}) error {
+	var requestBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&requestBody).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequest(method, client.baseURL+path, &requestBody)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if client.token != "" {
+		request.Header.Set(APITokenHeader, client.token)
+	}
+	httpResponse, err := client.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		status := APIStatus{}
+		json.NewDecoder(httpResponse.Body).Decode(&status)
+		if status.Error == "" {
+			status.Error = httpResponse.Status
+		}
+		// not logged, the caller reports the error
+		return errors.New(status.Error)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResponse.Body).Decode(response)
+}
+
+// nodePath returns the API path of a node
+func nodePath(nodeHWID string) string {
+	return "nodes/" + url.PathEscape(nodeHWID)
+}
+
+// GetControllers returns the controllers and the state of their networks
+func (client *APIClient) GetControllers() (controllers []*APIController, err error) {
+	err = client.request(http.MethodGet, "network", nil, &controllers)
+	return controllers, err
+}
+
+// GetNodes returns all nodes of the publisher
+func (client *APIClient) GetNodes() (nodes []*types.NodeDiscoveryMessage, err error) {
+	err = client.request(http.MethodGet, "nodes", nil, &nodes)
+	return nodes, err
+}
+
+// GetNode returns a node by its HWID
+func (client *APIClient) GetNode(nodeHWID string) (node *types.NodeDiscoveryMessage, err error) {
+	err = client.request(http.MethodGet, nodePath(nodeHWID), nil, &node)
+	return node, err
+}
+
+// GetNodeValues returns the zwave values of a node
+func (client *APIClient) GetNodeValues(nodeHWID string) (values []*APIValue, err error) {
+	err = client.request(http.MethodGet, nodePath(nodeHWID)+"/values", nil, &values)
+	return values, err
+}
+
+// SetValue sets a zwave value of a node. The value is confirmed when the node reports it.
+func (client *APIClient) SetValue(nodeHWID string, valueID string, value string) error {
+	path := nodePath(nodeHWID) + "/values/" + url.PathEscape(valueID)
+	return client.request(http.MethodPut, path, &APISetValue{Value: value}, nil)
+}
+
+// SetConfig updates the configuration of a node
+func (client *APIClient) SetConfig(nodeHWID string, changes types.NodeAttrMap) error {
+	return client.request(http.MethodPut, nodePath(nodeHWID)+"/config", changes, nil)
+}
+
+// NodeCommand sends a command to a node: refresh, removefailed, replacefailed, assignreturnroute or replicate
+func (client *APIClient) NodeCommand(nodeHWID string, command string) error {
+	return client.request(http.MethodPost, nodePath(nodeHWID)+"/"+command, nil, nil)
+}
+
+// NetworkCommand sends a network command, eg inclusion/start or heal, to the network with the given hex
+// home ID. Use "" for the network of the first controller.
+func (client *APIClient) NetworkCommand(command string, homeID string) error {
+	path := "network/" + command
+	if homeID != "" {
+		path += "?homeID=" + url.QueryEscape(homeID)
+	}
+	return client.request(http.MethodPost, path, nil, nil)
+}
+
+// HardReset requests the hard reset of the controller of the network with the given hex home ID, or
+// confirms it with the token of the request. Without token this returns the token to confirm with.
+func (client *APIClient) HardReset(homeID string, token string) (string, error) {
+	query := url.Values{}
+	if homeID != "" {
+		query.Set("homeID", homeID)
+	}
+	if token != "" {
+		query.Set("token", token)
+	}
+	status := APIStatus{}
+	err := client.request(http.MethodPost, "network/hardreset?"+query.Encode(), nil, &status)
+	return status.Token, err
+}
+
+// BackupNetwork saves the network with the given hex home ID in a backup archive in the cache folder of the
+// publisher and returns the name of the archive
+func (client *APIClient) BackupNetwork(homeID string) (string, error) {
+	path := "network/backup"
+	if homeID != "" {
+		path += "?homeID=" + url.QueryEscape(homeID)
+	}
+	status := APIStatus{}
+	err := client.request(http.MethodPost, path, nil, &status)
+	return status.File, err
+}
+
+// RestoreNetwork restores the network with the given hex home ID from a backup archive in the cache folder of
+// the publisher
+func (client *APIClient) RestoreNetwork(homeID string, file string) error {
+	query := url.Values{}
+	if homeID != "" {
+		query.Set("homeID", homeID)
+	}
+	query.Set("file", file)
+	return client.request(http.MethodPost, "network/restore?"+query.Encode(), nil, nil)
+}
+
+// GetProvisioning returns the devices in the provisioning list
+func (client *APIClient) GetProvisioning() (entries []ProvisioningEntry, err error) {
+	err = client.request(http.MethodGet, "provisioning", nil, &entries)
+	return entries, err
+}
+
+// AddProvisioning adds a device to the provisioning list, or updates a pending device
+func (client *APIClient) AddProvisioning(entry ProvisioningEntry) error {
+	return client.request(http.MethodPost, "provisioning", &entry, nil)
+}
+
+// RemoveProvisioning removes the device with the given DSK from the provisioning list
+func (client *APIClient) RemoveProvisioning(dsk string) error {
+	return client.request(http.MethodDelete, "provisioning/"+url.PathEscape(dsk), nil, nil)
+}
+
+// IncludeProvisioned starts the inclusion of the provisioned device with the given DSK in the network with the
+// given hex home ID
+func (client *APIClient) IncludeProvisioned(homeID string, dsk string) error {
+	query := url.Values{}
+	if homeID != "" {
+		query.Set("homeID", homeID)
+	}
+	query.Set("dsk", dsk)
+	return client.request(http.MethodPost, "network/inclusion/start?"+query.Encode(), nil, nil)
+}
+
+// NewAPIClient creates a client of the HTTP API at the given address, eg localhost:9292 or http://host:9292
+// Use the token of the apiToken configuration of the publisher, or "" if it has none.
+func NewAPIClient(address string, token string) *APIClient {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	client := &APIClient{
+		baseURL:    strings.TrimSuffix(address, "/") + APIPathPrefix,
+		token:      token,
+		httpClient: &http.Client{Timeout: APIClientTimeout * time.Second},
+	}
+	return client
+}
@@ -0,0 +1,69 @@
+package internal_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIClient(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	pub.CreateNode("12", types.NodeTypeSensor)
+	server := httptest.NewServer(http.HandlerFunc(app.ServeAPI))
+	defer server.Close()
+	config.APIAddress = server.Listener.Addr().String()
+	config.APIToken = "secret"
+	client := internal.NewAPIClient(server.URL, "secret")
+
+	nodes, err := client.GetNodes()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, nodes)
+	node, err := client.GetNode("12")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "12", node.HWID)
+	}
+	values, err := client.GetNodeValues("12")
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+
+	// the controller hasn't started
+	controllers, err := client.GetControllers()
+	if assert.NoError(t, err) && assert.Len(t, controllers, 1) {
+		assert.Equal(t, string(internal.ControllerPhaseStarting), controllers[0].Phase)
+		assert.Empty(t, controllers[0].NodeHWID)
+	}
+
+	// errors reported by the publisher are returned
+	_, err = client.GetNode("99")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unknown node")
+	err = client.NetworkCommand("inclusion/start", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CheckControllerReady")
+	err = client.SetValue("12", "1001", "on")
+	assert.Error(t, err)
+
+	// requests without the API token are rejected
+	_, err = internal.NewAPIClient(server.URL, "").GetNodes()
+	assert.Error(t, err)
+}
+
+func TestControllerCommandState(t *testing.T) {
+	assert.Equal(t, internal.ControllerCommandNormal, internal.GetControllerCommandState(0))
+	assert.Equal(t, internal.ControllerCommandWaiting, internal.GetControllerCommandState(4))
+	assert.Equal(t, internal.ControllerCommandCompleted, internal.GetControllerCommandState(7))
+	assert.Equal(t, internal.ControllerCommandNodeFailed, internal.GetControllerCommandState(10))
+	assert.Equal(t, "unknown(11)", internal.GetControllerCommandState(11))
+
+	assert.True(t, internal.IsControllerCommandDone(internal.ControllerCommandCompleted))
+	assert.True(t, internal.IsControllerCommandDone(internal.ControllerCommandFailed))
+	assert.False(t, internal.IsControllerCommandDone(internal.ControllerCommandWaiting))
+	assert.False(t, internal.IsControllerCommandDone(internal.ControllerCommandInProgress))
+}
@@ -0,0 +1,210 @@
+// Package internal with the communication statistics of the zwave driver and nodes
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultStatisticsInterval is the default interval in seconds of publishing the communication statistics
+const DefaultStatisticsInterval = 60
+
+// OutputTypeCommStats is the output type of the communication statistics of the gateway, controllers and nodes
+// These are the statistics observed by the publisher. Goopenzwave doesn't expose Manager::GetDriverStatistics
+// and GetNodeStatistics, so the openzwave driver statistics, eg SOF, ACK waiting, read aborts, bad checksums,
+// CAN, NAK, dropped and retried messages and callbacks, are not published.
+const OutputTypeCommStats types.OutputType = "commstats"
+
+// Instances of the communication statistics outputs of nodes
+const (
+	CommStatsInstanceReceived = "received" // nr of messages received from the node
+	CommStatsInstanceSent     = "sent"     // nr of commands and pings sent to the node
+	CommStatsInstanceFailed   = "failed"   // nr of commands and pings to the node that timed out
+	CommStatsInstanceRTT      = "rtt"      // average ping round-trip time in msec
+	CommStatsInstanceQuality  = "quality"  // percentage of commands and pings that succeeded
+)
+
+// Instances of the communication statistics outputs of the controllers and the gateway
+const (
+	CommStatsInstanceSendQueue     = "sendqueue"     // nr of messages waiting to be sent by the controller
+	CommStatsInstanceNotifications = "notifications" // nr of notifications received from openzwave
+	CommStatsInstanceDropped       = "dropped"       // nr of notifications dropped because the queue was full
+	CommStatsInstanceQueueLength   = "queuelength"   // nr of notifications waiting to be handled, including the backlog
+)
+
+// NodeCommStats contains the communication statistics of a node
+type NodeCommStats struct {
+	Received   uint64        // messages received from the node
+	Sent       uint64        // commands and pings sent to the node
+	Failed     uint64        // commands and pings that timed out
+	AverageRTT time.Duration // average round-trip time of pings, 0 if not measured
+	Quality    int           // percentage of sent messages that didn't fail, 100 if nothing was sent
+}
+
+// nodeCommCounters holds the counters of a node
+type nodeCommCounters struct {
+	received uint64
+	sent     uint64
+	failed   uint64
+	rttTotal time.Duration
+	rttCount uint64
+}
+
+// CommStatistics counts the messages received from and sent to nodes
+// Counters are updated from the notification handlers and input commands, and read by the statistics publisher.
+type CommStatistics struct {
+	countersByNodeHWID map[string]*nodeCommCounters
+	updateMutex        sync.Mutex
+}
+
+// getCounters returns the counters of a node, creating them if needed. Must be called with the lock held.
+func (stats *CommStatistics) getCounters(nodeHWID string) *nodeCommCounters {
+	counters := stats.countersByNodeHWID[nodeHWID]
+	if counters == nil {
+		counters = &nodeCommCounters{}
+		stats.countersByNodeHWID[nodeHWID] = counters
+	}
+	return counters
+}
+
+// RecordReceived counts a message received from a node
+func (stats *CommStatistics) RecordReceived(nodeHWID string) {
+	stats.updateMutex.Lock()
+	defer stats.updateMutex.Unlock()
+	stats.getCounters(nodeHWID).received++
+}
+
+// RecordSent counts a command or ping sent to a node
+func (stats *CommStatistics) RecordSent(nodeHWID string) {
+	stats.updateMutex.Lock()
+	defer stats.updateMutex.Unlock()
+	stats.getCounters(nodeHWID).sent++
+}
+
+// RecordFailed counts a command or ping to a node that timed out
+func (stats *CommStatistics) RecordFailed(nodeHWID string) {
+	stats.updateMutex.Lock()
+	defer stats.updateMutex.Unlock()
+	stats.getCounters(nodeHWID).failed++
+}
+
+// RecordRTT adds a measured ping round-trip time of a node
+func (stats *CommStatistics) RecordRTT(nodeHWID string, rtt time.Duration) {
+	stats.updateMutex.Lock()
+	defer stats.updateMutex.Unlock()
+	counters := stats.getCounters(nodeHWID)
+	counters.rttTotal += rtt
+	counters.rttCount++
+}
+
+// GetNodeStats returns the statistics of a node and whether the node has statistics
+func (stats *CommStatistics) GetNodeStats(nodeHWID string) (nodeStats NodeCommStats, found bool) {
+	stats.updateMutex.Lock()
+	defer stats.updateMutex.Unlock()
+	counters := stats.countersByNodeHWID[nodeHWID]
+	if counters == nil {
+		return nodeStats, false
+	}
+	nodeStats = NodeCommStats{
+		Received: counters.received,
+		Sent:     counters.sent,
+		Failed:   counters.failed,
+		Quality:  100,
+	}
+	if counters.rttCount > 0 {
+		nodeStats.AverageRTT = counters.rttTotal / time.Duration(counters.rttCount)
+	}
+	if counters.sent > 0 {
+		failed := counters.failed
+		if failed > counters.sent {
+			failed = counters.sent
+		}
+		nodeStats.Quality = int(100 * (counters.sent - failed) / counters.sent)
+	}
+	return nodeStats, true
+}
+
+// GetNodeHWIDs returns the HWIDs of the nodes with statistics
+func (stats *CommStatistics) GetNodeHWIDs() []string {
+	stats.updateMutex.Lock()
+	defer stats.updateMutex.Unlock()
+	nodeHWIDs := make([]string, 0, len(stats.countersByNodeHWID))
+	for nodeHWID := range stats.countersByNodeHWID {
+		nodeHWIDs = append(nodeHWIDs, nodeHWID)
+	}
+	return nodeHWIDs
+}
+
+// Remove removes the statistics of a node
+func (stats *CommStatistics) Remove(nodeHWID string) {
+	stats.updateMutex.Lock()
+	defer stats.updateMutex.Unlock()
+	delete(stats.countersByNodeHWID, nodeHWID)
+}
+
+// NewCommStatistics creates empty communication statistics
+func NewCommStatistics() *CommStatistics {
+	stats := &CommStatistics{
+		countersByNodeHWID: make(map[string]*nodeCommCounters),
+	}
+	return stats
+}
+
+// updateStatsOutput updates the value of a statistics output, creating the output if needed
+func (app *OpenZWaveApp) updateStatsOutput(nodeHWID string, instance string, value interface{}) {
+	if app.pub.GetNodeByHWID(nodeHWID) == nil {
+		return
+	}
+	if app.pub.GetOutputByNodeHWID(nodeHWID, OutputTypeCommStats, instance) == nil {
+		app.pub.CreateOutput(nodeHWID, OutputTypeCommStats, instance)
+	}
+	app.pub.UpdateOutputValue(nodeHWID, OutputTypeCommStats, instance, fmt.Sprint(value))
+}
+
+// PublishCommStatistics publishes the statistics of the notification pipeline on the gateway node, the send
+// queue of each ready controller on its node, and the statistics of the nodes on their nodes.
+func (app *OpenZWaveApp) PublishCommStatistics() {
+	notificationStats := app.ozwAPI.GetNotificationStats()
+	app.updateStatsOutput(types.NodeIDGateway, CommStatsInstanceNotifications, notificationStats.Received)
+	app.updateStatsOutput(types.NodeIDGateway, CommStatsInstanceDropped, notificationStats.Dropped)
+	app.updateStatsOutput(types.NodeIDGateway, CommStatsInstanceQueueLength, notificationStats.QueueLength+notificationStats.Backlog)
+
+	for _, controller := range app.ozwAPI.controllers {
+		state := app.ozwAPI.GetControllerState(controller)
+		if state.HomeID == 0 || app.CheckControllerReady(state.HomeID) != nil {
+			continue
+		}
+		controllerHWID := app.MakeNodeHWID(state.HomeID, state.NodeID)
+		app.updateStatsOutput(controllerHWID, CommStatsInstanceSendQueue, app.ozwAPI.GetSendQueueCount(state.HomeID))
+	}
+	for _, nodeHWID := range app.commStats.GetNodeHWIDs() {
+		nodeStats, _ := app.commStats.GetNodeStats(nodeHWID)
+		app.updateStatsOutput(nodeHWID, CommStatsInstanceReceived, nodeStats.Received)
+		app.updateStatsOutput(nodeHWID, CommStatsInstanceSent, nodeStats.Sent)
+		app.updateStatsOutput(nodeHWID, CommStatsInstanceFailed, nodeStats.Failed)
+		app.updateStatsOutput(nodeHWID, CommStatsInstanceRTT, nodeStats.AverageRTT.Milliseconds())
+		app.updateStatsOutput(nodeHWID, CommStatsInstanceQuality, nodeStats.Quality)
+	}
+}
+
+// statisticsLoop publishes the communication statistics every interval until the supervisor stops
+func (app *OpenZWaveApp) statisticsLoop(interval int) {
+	logrus.Infof("OpenZWaveApp.statisticsLoop: Publishing statistics every %d seconds", interval)
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	defer app.supervisorWG.Done()
+
+	for {
+		select {
+		case <-app.stopSupervisor:
+			logrus.Infof("OpenZWaveApp.statisticsLoop: Stopped")
+			return
+		case <-ticker.C:
+			app.PublishCommStatistics()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommStatistics(t *testing.T) {
+	stats := internal.NewCommStatistics()
+	_, found := stats.GetNodeStats("5")
+	assert.False(t, found)
+
+	stats.RecordReceived("5")
+	nodeStats, found := stats.GetNodeStats("5")
+	assert.True(t, found)
+	assert.Equal(t, uint64(1), nodeStats.Received)
+	assert.Equal(t, 100, nodeStats.Quality, "quality without sent messages")
+	assert.Equal(t, time.Duration(0), nodeStats.AverageRTT)
+
+	for i := 0; i < 4; i++ {
+		stats.RecordSent("5")
+	}
+	stats.RecordFailed("5")
+	stats.RecordRTT("5", 100*time.Millisecond)
+	stats.RecordRTT("5", 300*time.Millisecond)
+	nodeStats, _ = stats.GetNodeStats("5")
+	assert.Equal(t, uint64(4), nodeStats.Sent)
+	assert.Equal(t, uint64(1), nodeStats.Failed)
+	assert.Equal(t, 75, nodeStats.Quality)
+	assert.Equal(t, 200*time.Millisecond, nodeStats.AverageRTT)
+
+	// timeouts of unsolicited messages don't make the quality negative
+	stats.RecordFailed("6")
+	stats.RecordFailed("6")
+	stats.RecordSent("6")
+	nodeStats, _ = stats.GetNodeStats("6")
+	assert.Equal(t, 0, nodeStats.Quality)
+
+	assert.ElementsMatch(t, []string{"5", "6"}, stats.GetNodeHWIDs())
+	stats.Remove("5")
+	assert.ElementsMatch(t, []string{"6"}, stats.GetNodeHWIDs())
+}
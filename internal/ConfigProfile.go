@@ -0,0 +1,174 @@
+// Package internal with per-model configuration profiles
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// Node attributes published for configuration profiles
+const (
+	OzwAttrNameProfile      types.NodeAttr = "profile"      // name of the configuration profile applied to the node
+	OzwAttrNameProfileDrift types.NodeAttr = "profileDrift" // configuration values that differ from the profile
+)
+
+// ConfigProfile contains the zwave configuration to apply to all nodes of a model
+// The model is identified by the manufacturer ID and optionally the product type and product ID, as
+// reported by openzwave, eg "0x0086", "0x0002", "0x0064" for the Aeotec ZW100 MultiSensor 6.
+type ConfigProfile struct {
+	Name           string            `yaml:"name"`           // profile name for reporting
+	ManufacturerID string            `yaml:"manufacturerID"` // manufacturer ID, required
+	ProductType    string            `yaml:"productType"`    // product type, empty matches all types
+	ProductID      string            `yaml:"productID"`      // product ID, empty matches all products
+	Config         map[string]string `yaml:"config"`         // configuration values by attribute name, eg parameter nr
+}
+
+// Matches returns true if the profile applies to the model with the given IDs
+// IDs are compared by their hex value so "0x0086" matches "0086" and "86".
+func (profile *ConfigProfile) Matches(manufacturerID string, productType string, productID string) bool {
+	if profile.ManufacturerID == "" || !sameModelID(profile.ManufacturerID, manufacturerID) {
+		return false
+	}
+	if profile.ProductType != "" && !sameModelID(profile.ProductType, productType) {
+		return false
+	}
+	if profile.ProductID != "" && !sameModelID(profile.ProductID, productID) {
+		return false
+	}
+	return true
+}
+
+// FindConfigProfile returns the first profile that matches the model or nil if no profile matches
+func FindConfigProfile(profiles []ConfigProfile, manufacturerID string, productType string, productID string) *ConfigProfile {
+	for index := range profiles {
+		profile := &profiles[index]
+		if profile.Matches(manufacturerID, productType, productID) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// findConfigProfileByName returns the profile with the given name or nil if no profile has the name
+func findConfigProfileByName(profiles []ConfigProfile, name string) *ConfigProfile {
+	for index := range profiles {
+		if profiles[index].Name == name {
+			return &profiles[index]
+		}
+	}
+	return nil
+}
+
+// sameModelID compares two model IDs by their numeric value
+// Openzwave reports IDs in hex notation, eg 0x0086. Hex without 0x prefix is also accepted.
+func sameModelID(id1 string, id2 string) bool {
+	value1, err1 := parseModelID(id1)
+	value2, err2 := parseModelID(id2)
+	if err1 != nil || err2 != nil {
+		return strings.EqualFold(strings.TrimSpace(id1), strings.TrimSpace(id2))
+	}
+	return value1 == value2
+}
+
+// parseModelID parses a hex model ID with or without 0x prefix
+func parseModelID(id string) (uint64, error) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	id = strings.TrimPrefix(id, "0x")
+	return strconv.ParseUint(id, 16, 32)
+}
+
+// ApplyConfigProfile writes the configuration profile that matches the node model to the node.
+// Only values that differ from the current node value are written. This is invoked when openzwave has
+// completed the node queries so all configuration values are known. Nodes included with a provisioned profile
+// get that profile instead, see ApplyProvisionedNode.
+func (app *OpenZWaveApp) ApplyConfigProfile(homeID uint32, zwNodeID uint8) {
+	nodeHWID := app.MakeNodeHWID(homeID, zwNodeID)
+	if app.HasProvisionedProfile(nodeHWID) {
+		logrus.Infof("ApplyConfigProfile: Node %s is included with a provisioned profile. Model profile skipped.", nodeHWID)
+		return
+	}
+	manufacturerID := goopenzwave.GetNodeManufacturerID(homeID, zwNodeID)
+	productType := goopenzwave.GetNodeProductType(homeID, zwNodeID)
+	productID := goopenzwave.GetNodeProductID(homeID, zwNodeID)
+
+	profile := FindConfigProfile(app.config.Profiles, manufacturerID, productType, productID)
+	if profile == nil {
+		return
+	}
+	app.applyConfigProfile(nodeHWID, profile)
+}
+
+// applyConfigProfile writes the configuration of a profile to a node and tracks the profile for drift reporting
+func (app *OpenZWaveApp) applyConfigProfile(nodeHWID string, profile *ConfigProfile) {
+	app.updateMutex.Lock()
+	app.profileByNodeHWID[nodeHWID] = profile
+	app.updateMutex.Unlock()
+	app.pub.UpdateNodeAttr(nodeHWID, types.NodeAttrMap{OzwAttrNameProfile: profile.Name})
+
+	for attrName, profileValue := range profile.Config {
+		zwValue := app.values.GetValueByAttrID(MakeAttrID(nodeHWID, types.NodeAttr(attrName)))
+		if zwValue == nil {
+			logrus.Warningf("ApplyConfigProfile: Node %s: Profile '%s' configuration '%s' is not a configuration of this node. Ignored.",
+				nodeHWID, profile.Name, attrName)
+			continue
+		}
+		currentValue := zwValue.GetAsString()
+		if sameConfigValue(currentValue, profileValue) {
+			continue
+		}
+		logrus.Infof("ApplyConfigProfile: Node %s: Profile '%s' configuration '%s': Old value=%s, new value=%s",
+			nodeHWID, profile.Name, attrName, currentValue, profileValue)
+		err := app.SetZWaveValue(zwValue, profileValue)
+		if err != nil {
+			logrus.Errorf("ApplyConfigProfile: Node %s: Failed applying configuration '%s': %v", nodeHWID, attrName, err)
+		}
+	}
+}
+
+// CheckConfigProfileDrift compares the node configuration with the profile applied to the node and publishes the
+// configuration values that differ from the profile in the profileDrift attribute. An empty attribute means the node
+// is in sync with its profile. Nodes without profile are ignored.
+func (app *OpenZWaveApp) CheckConfigProfileDrift(nodeHWID string) {
+	app.updateMutex.Lock()
+	profile := app.profileByNodeHWID[nodeHWID]
+	app.updateMutex.Unlock()
+	if profile == nil {
+		return
+	}
+	drift := make([]string, 0)
+	for attrName, profileValue := range profile.Config {
+		zwValue := app.values.GetValueByAttrID(MakeAttrID(nodeHWID, types.NodeAttr(attrName)))
+		if zwValue == nil {
+			continue
+		}
+		currentValue := zwValue.GetAsString()
+		if !sameConfigValue(currentValue, profileValue) {
+			drift = append(drift, fmt.Sprintf("%s=%s (profile %s)", attrName, currentValue, profileValue))
+		}
+	}
+	sort.Strings(drift)
+	driftReport := strings.Join(drift, ", ")
+	changed := app.pub.UpdateNodeAttr(nodeHWID, types.NodeAttrMap{OzwAttrNameProfileDrift: driftReport})
+	if changed && driftReport != "" {
+		logrus.Warningf("CheckConfigProfileDrift: Node %s differs from profile '%s': %s", nodeHWID, profile.Name, driftReport)
+	}
+}
+
+// sameConfigValue compares a node configuration value with a profile value
+// Numbers are compared by value and booleans and list items are case insensitive.
+func sameConfigValue(nodeValue string, profileValue string) bool {
+	nodeValue = strings.TrimSpace(nodeValue)
+	profileValue = strings.TrimSpace(profileValue)
+	number1, err1 := strconv.ParseFloat(nodeValue, 64)
+	number2, err2 := strconv.ParseFloat(profileValue, 64)
+	if err1 == nil && err2 == nil {
+		return number1 == number2
+	}
+	return strings.EqualFold(nodeValue, profileValue)
+}
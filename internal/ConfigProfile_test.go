@@ -0,0 +1,42 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+var testProfiles = []internal.ConfigProfile{
+	{Name: "multisensor", ManufacturerID: "0x0086", ProductType: "0x0002", ProductID: "0x0064",
+		Config: map[string]string{"101": "241", "111": "300"}},
+	{Name: "aeotec", ManufacturerID: "0086"},
+}
+
+func TestFindConfigProfile(t *testing.T) {
+	profile := internal.FindConfigProfile(testProfiles, "0x0086", "0x0002", "0x0064")
+	assert.NotNil(t, profile)
+	assert.Equal(t, "multisensor", profile.Name)
+
+	// other products of the same manufacturer match the catch-all profile
+	profile = internal.FindConfigProfile(testProfiles, "0x0086", "0x0003", "0x0060")
+	assert.NotNil(t, profile)
+	assert.Equal(t, "aeotec", profile.Name)
+
+	profile = internal.FindConfigProfile(testProfiles, "0x010f", "0x0002", "0x0064")
+	assert.Nil(t, profile)
+
+	// nodes that have not reported their model don't match
+	profile = internal.FindConfigProfile(testProfiles, "", "", "")
+	assert.Nil(t, profile)
+}
+
+func TestConfigProfileMatches(t *testing.T) {
+	profile := internal.ConfigProfile{ManufacturerID: "0x0086", ProductID: "0x0064"}
+	assert.True(t, profile.Matches("0x0086", "0x0002", "0x0064"))
+	assert.True(t, profile.Matches("86", "", "64"))
+	assert.False(t, profile.Matches("0x0086", "0x0002", "0x0065"))
+
+	noManufacturer := internal.ConfigProfile{ProductID: "0x0064"}
+	assert.False(t, noManufacturer.Matches("0x0086", "0x0002", "0x0064"))
+}
@@ -0,0 +1,113 @@
+// Package internal with the state of controller commands such as adding and removing nodes
+package internal
+
+import (
+	"fmt"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// NodeStatusControllerCommand is the controller node status attribute with the state of its running command
+const NodeStatusControllerCommand types.NodeStatus = "command"
+
+// NodeStatusControllerCommandName is the controller node status attribute with the name of the last controller
+// command that was started. Its progress is published in the NodeStatusControllerCommand status.
+const NodeStatusControllerCommandName types.NodeStatus = "commandName"
+
+// Controller command states reported with the controller command notification.
+const (
+	ControllerCommandNormal     = "normal"     // no command is running
+	ControllerCommandStarting   = "starting"   // the command is starting
+	ControllerCommandCancel     = "cancel"     // the command was cancelled
+	ControllerCommandError      = "error"      // the command failed
+	ControllerCommandWaiting    = "waiting"    // waiting for the user to press the button on the device
+	ControllerCommandSleeping   = "sleeping"   // the node is asleep
+	ControllerCommandInProgress = "inProgress" // the controller is communicating with the node
+	ControllerCommandCompleted  = "completed"  // the command has completed successfully
+	ControllerCommandFailed     = "failed"     // the command has failed
+	ControllerCommandNodeOK     = "nodeOK"     // the node is not failed
+	ControllerCommandNodeFailed = "nodeFailed" // the node is failed
+)
+
+// controllerCommandStates are the controller command states in the order of the openzwave ControllerState enum
+// Goopenzwave passes the state as the notification event without defining it.
+var controllerCommandStates = []string{
+	ControllerCommandNormal,
+	ControllerCommandStarting,
+	ControllerCommandCancel,
+	ControllerCommandError,
+	ControllerCommandWaiting,
+	ControllerCommandSleeping,
+	ControllerCommandInProgress,
+	ControllerCommandCompleted,
+	ControllerCommandFailed,
+	ControllerCommandNodeOK,
+	ControllerCommandNodeFailed,
+}
+
+// GetControllerCommandState returns the name of an openzwave controller command state
+func GetControllerCommandState(state uint8) string {
+	if int(state) < len(controllerCommandStates) {
+		return controllerCommandStates[state]
+	}
+	return fmt.Sprintf("unknown(%d)", state)
+}
+
+// IsControllerCommandDone returns true if the controller command state ends the command
+func IsControllerCommandDone(state string) bool {
+	switch state {
+	case ControllerCommandNormal, ControllerCommandCancel, ControllerCommandError,
+		ControllerCommandCompleted, ControllerCommandFailed, ControllerCommandNodeOK, ControllerCommandNodeFailed:
+		return true
+	}
+	return false
+}
+
+// startControllerCommand publishes the name of a controller command that is started in the status of the
+// controller node. The progress is published when openzwave reports it, see publishControllerCommandState.
+// Openzwave reports the progress without the command, so the command is remembered to interpret the progress.
+func (app *OpenZWaveApp) startControllerCommand(homeID uint32, command string) error {
+	controller := app.ozwAPI.GetControllerByHomeID(homeID)
+	if controller == nil {
+		return lib.MakeErrorf("startControllerCommand: No controller for network %x", homeID)
+	}
+	logrus.Infof("OpenZWaveApp.startControllerCommand: Controller of network %x starts %s", homeID, command)
+	app.updateMutex.Lock()
+	app.commandNameByHomeID[homeID] = command
+	app.updateMutex.Unlock()
+	app.pub.UpdateNodeStatus(app.MakeNodeHWID(homeID, app.ozwAPI.GetControllerState(controller).NodeID), map[types.NodeStatus]string{
+		NodeStatusControllerCommandName: command,
+	})
+	return nil
+}
+
+// getControllerCommandName returns the name of the last controller command started in a network
+func (app *OpenZWaveApp) getControllerCommandName(homeID uint32) string {
+	app.updateMutex.Lock()
+	defer app.updateMutex.Unlock()
+	return app.commandNameByHomeID[homeID]
+}
+
+// publishControllerCommandState publishes the state of the running controller command in the status of the
+// controller node, so the progress of adding and removing nodes can be followed.
+func (app *OpenZWaveApp) publishControllerCommandState(notification *goopenzwave.Notification) {
+	controller := app.ozwAPI.GetControllerByHomeID(notification.HomeID)
+	if controller == nil || notification.Event == nil {
+		return
+	}
+	state := GetControllerCommandState(*notification.Event)
+	logrus.Infof("OpenZWaveApp.publishControllerCommandState: Controller of network %x command state is %s",
+		notification.HomeID, state)
+	app.pub.UpdateNodeStatus(app.MakeNodeHWID(notification.HomeID, app.ozwAPI.GetControllerState(controller).NodeID), map[types.NodeStatus]string{
+		NodeStatusControllerCommand: state,
+	})
+	app.updateReplaceProgress(notification.HomeID, state)
+	app.updateProvisionedInclusion(notification.HomeID, state)
+	if IsControllerCommandDone(state) {
+		// learn mode and primary transfer change the role of the controller
+		app.publishControllerRoles(notification.HomeID)
+	}
+}
@@ -0,0 +1,143 @@
+// Package internal with the startup phases of the zwave controller drivers
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ControllerPhase is the startup phase of a controller driver as reported by openzwave
+type ControllerPhase string
+
+// Controller driver phases in the order they are reached
+const (
+	ControllerPhaseStarting          ControllerPhase = "starting"                // waiting for the driver to be ready
+	ControllerPhaseDriverReady       ControllerPhase = "driverReady"             // controller is ready, nodes are being queried
+	ControllerPhaseAwakeNodesQueried ControllerPhase = "awakeNodesQueried"       // listening and awake nodes are queried
+	ControllerPhaseAllNodesQueried   ControllerPhase = "allNodesQueried"         // all nodes are queried
+	ControllerPhaseSomeDead          ControllerPhase = "allNodesQueriedSomeDead" // all nodes are queried, some are dead
+	ControllerPhaseFailed            ControllerPhase = "failed"                  // the driver failed, eg the device is missing
+)
+
+// ControllerPhaseReady is the phase from which network management commands are accepted.
+// Sleeping nodes can take hours to be queried so this doesn't wait for all nodes.
+const ControllerPhaseReady = ControllerPhaseAwakeNodesQueried
+
+// NodeStatusControllerPhase is the controller node status attribute with its driver phase
+const NodeStatusControllerPhase types.NodeStatus = "phase"
+
+// ErrDriverFailed is returned by WaitForPhase when a controller driver failed
+var ErrDriverFailed = errors.New("openzwave driver failed")
+
+// ErrStartupTimeout is returned by WaitForPhase when the phase isn't reached in time
+var ErrStartupTimeout = errors.New("timeout waiting for the controller startup")
+
+// phaseRanks orders the phases. All nodes queried is reached with or without dead nodes.
+var phaseRanks = map[ControllerPhase]int{
+	ControllerPhaseStarting:          0,
+	ControllerPhaseDriverReady:       1,
+	ControllerPhaseAwakeNodesQueried: 2,
+	ControllerPhaseAllNodesQueried:   3,
+	ControllerPhaseSomeDead:          3,
+}
+
+// ParseControllerPhase returns the phase with the given name
+// The failed phase can't be waited for and is not accepted.
+func ParseControllerPhase(name string) (ControllerPhase, error) {
+	phase := ControllerPhase(name)
+	if _, found := phaseRanks[phase]; !found {
+		return "", lib.MakeErrorf("ParseControllerPhase: Unknown controller phase '%s'", name)
+	}
+	return phase, nil
+}
+
+// IsPhaseReached returns true if the given controller phases have all reached the target phase
+// Returns ErrDriverFailed if one of the controllers has failed.
+func IsPhaseReached(phases []ControllerPhase, target ControllerPhase) (bool, error) {
+	for _, phase := range phases {
+		if phase == ControllerPhaseFailed {
+			return false, ErrDriverFailed
+		}
+		if phaseRanks[phase] < phaseRanks[target] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GetNetworkPhase returns the phase that all given controller phases have reached
+// This is the failed phase if one of the controllers has failed.
+func GetNetworkPhase(phases []ControllerPhase) ControllerPhase {
+	networkPhase := ControllerPhaseAllNodesQueried
+	for _, phase := range phases {
+		if phase == ControllerPhaseFailed {
+			return ControllerPhaseFailed
+		} else if phaseRanks[phase] < phaseRanks[networkPhase] {
+			networkPhase = phase
+		}
+	}
+	return networkPhase
+}
+
+// publishControllerPhase publishes the driver phases of the controllers in the status of the gateway node
+// and the phase of the controller of the network in the status of its node.
+// The gateway node has the phase all controllers have reached and, with multiple controllers, the phase of
+// each controller in the order of the configured gateways, eg phase-2. The phase is published before the driver
+// is ready or when it fails, eg without home ID. The controller node is known once the driver is ready.
+func (app *OpenZWaveApp) publishControllerPhase(homeID uint32) {
+	gatewayStatus := map[types.NodeStatus]string{}
+	phases := make([]ControllerPhase, 0, len(app.ozwAPI.controllers))
+	for index, controller := range app.ozwAPI.controllers {
+		state := app.ozwAPI.GetControllerState(controller)
+		phases = append(phases, state.Phase)
+		if len(app.ozwAPI.controllers) > 1 {
+			gatewayStatus[types.NodeStatus(fmt.Sprintf("%s-%d", NodeStatusControllerPhase, index+1))] = string(state.Phase)
+		}
+	}
+	gatewayStatus[NodeStatusControllerPhase] = string(GetNetworkPhase(phases))
+	app.pub.UpdateNodeStatus(types.NodeIDGateway, gatewayStatus)
+
+	controller := app.ozwAPI.GetControllerByHomeID(homeID)
+	if controller == nil {
+		return
+	}
+	state := app.ozwAPI.GetControllerState(controller)
+	if state.NodeID == 0 {
+		return
+	}
+	logrus.Infof("OpenZWaveApp.publishControllerPhase: Controller of network %x is in phase %s", homeID, state.Phase)
+	app.pub.UpdateNodeStatus(app.MakeNodeHWID(homeID, state.NodeID), map[types.NodeStatus]string{
+		NodeStatusControllerPhase: string(state.Phase),
+	})
+}
+
+// CheckControllerReady returns an error if the controller of the network isn't ready for network
+// management commands, eg adding or removing nodes. See ControllerPhaseReady.
+func (app *OpenZWaveApp) CheckControllerReady(homeID uint32) error {
+	controller := app.ozwAPI.GetControllerByHomeID(homeID)
+	if controller == nil {
+		return lib.MakeErrorf("CheckControllerReady: No controller for network %x", homeID)
+	}
+	phase := app.ozwAPI.GetControllerPhase(controller)
+	reached, _ := IsPhaseReached([]ControllerPhase{phase}, ControllerPhaseReady)
+	if !reached {
+		return lib.MakeErrorf("CheckControllerReady: Controller of network %x is not ready. Phase is %s", homeID, phase)
+	}
+	return nil
+}
+
+// WaitForPhase waits until all controllers have reached the given phase. See also OzwAPI.WaitForPhase.
+func (app *OpenZWaveApp) WaitForPhase(phase ControllerPhase, timeout time.Duration) error {
+	return app.ozwAPI.WaitForPhase(phase, timeout)
+}
+
+// WaitForStartup waits until the initial node discovery has completed or the driver failed
+// The discovery is complete when the awake nodes are queried. See WaitForPhase.
+func (app *OpenZWaveApp) WaitForStartup(timeout time.Duration) error {
+	return app.WaitForPhase(ControllerPhaseReady, timeout)
+}
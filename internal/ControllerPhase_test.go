@@ -0,0 +1,53 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseControllerPhase(t *testing.T) {
+	phase, err := internal.ParseControllerPhase("allNodesQueried")
+	assert.NoError(t, err)
+	assert.Equal(t, internal.ControllerPhaseAllNodesQueried, phase)
+
+	for _, name := range []string{"", "failed", "ready"} {
+		_, err = internal.ParseControllerPhase(name)
+		assert.Error(t, err, "phase '%s' should be invalid", name)
+	}
+}
+
+func TestIsPhaseReached(t *testing.T) {
+	phases := []internal.ControllerPhase{internal.ControllerPhaseDriverReady, internal.ControllerPhaseAwakeNodesQueried}
+	reached, err := internal.IsPhaseReached(phases, internal.ControllerPhaseDriverReady)
+	assert.NoError(t, err)
+	assert.True(t, reached)
+	// all controllers must reach the phase
+	reached, err = internal.IsPhaseReached(phases, internal.ControllerPhaseAwakeNodesQueried)
+	assert.NoError(t, err)
+	assert.False(t, reached)
+
+	// dead nodes don't prevent completing the node queries
+	phases = []internal.ControllerPhase{internal.ControllerPhaseSomeDead, internal.ControllerPhaseAllNodesQueried}
+	reached, err = internal.IsPhaseReached(phases, internal.ControllerPhaseAllNodesQueried)
+	assert.NoError(t, err)
+	assert.True(t, reached)
+
+	// a failed driver ends the wait
+	phases = []internal.ControllerPhase{internal.ControllerPhaseAllNodesQueried, internal.ControllerPhaseFailed}
+	reached, err = internal.IsPhaseReached(phases, internal.ControllerPhaseStarting)
+	assert.Equal(t, internal.ErrDriverFailed, err)
+	assert.False(t, reached)
+}
+
+func TestGetNetworkPhase(t *testing.T) {
+	phases := []internal.ControllerPhase{internal.ControllerPhaseAllNodesQueried, internal.ControllerPhaseStarting}
+	assert.Equal(t, internal.ControllerPhaseStarting, internal.GetNetworkPhase(phases))
+	phases = []internal.ControllerPhase{internal.ControllerPhaseSomeDead, internal.ControllerPhaseAwakeNodesQueried}
+	assert.Equal(t, internal.ControllerPhaseAwakeNodesQueried, internal.GetNetworkPhase(phases))
+
+	// a failed driver fails the network, also before it is ready
+	phases = []internal.ControllerPhase{internal.ControllerPhaseStarting, internal.ControllerPhaseFailed}
+	assert.Equal(t, internal.ControllerPhaseFailed, internal.GetNetworkPhase(phases))
+}
@@ -0,0 +1,118 @@
+// Package internal with the soft and hard reset of controllers
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// ResetConfirmTimeout is the time in seconds a hard reset must be confirmed after it is requested
+const ResetConfirmTimeout = 60
+
+// CommandStatusConfirm is the command result status of a hard reset request that must be confirmed with
+// the token in the result
+const CommandStatusConfirm = "confirm"
+
+// resetRequest is a requested hard reset waiting for confirmation
+type resetRequest struct {
+	token    string
+	deadline time.Time
+}
+
+// ResetConfirmations tracks the hard reset requests of controllers. A hard reset erases the network, so it
+// must be confirmed with the token of the request before the request expires.
+type ResetConfirmations struct {
+	timeout         time.Duration
+	requestByHomeID map[uint32]resetRequest
+	updateMutex     sync.Mutex
+}
+
+// Request returns a new confirmation token for the hard reset of the controller of a network
+// This replaces a previous request of the network.
+func (confirmations *ResetConfirmations) Request(homeID uint32, now time.Time) string {
+	tokenBytes := make([]byte, 8)
+	_, _ = rand.Read(tokenBytes)
+	token := hex.EncodeToString(tokenBytes)
+	confirmations.updateMutex.Lock()
+	defer confirmations.updateMutex.Unlock()
+	confirmations.requestByHomeID[homeID] = resetRequest{token: token, deadline: now.Add(confirmations.timeout)}
+	return token
+}
+
+// Confirm returns true if the token confirms the pending hard reset request of the network
+// The request is no longer pending afterwards, also if the token is wrong.
+func (confirmations *ResetConfirmations) Confirm(homeID uint32, token string, now time.Time) bool {
+	confirmations.updateMutex.Lock()
+	defer confirmations.updateMutex.Unlock()
+	request, found := confirmations.requestByHomeID[homeID]
+	delete(confirmations.requestByHomeID, homeID)
+	return found && token != "" && token == request.token && now.Before(request.deadline)
+}
+
+// NewResetConfirmations creates the tracking of hard reset requests that expire after the timeout
+func NewResetConfirmations(timeout time.Duration) *ResetConfirmations {
+	confirmations := &ResetConfirmations{
+		timeout:         timeout,
+		requestByHomeID: make(map[uint32]resetRequest),
+	}
+	return confirmations
+}
+
+// SoftResetController resets the controller of a network without erasing its network, eg when it stops
+// responding. This doesn't require the controller to be ready.
+func (app *OpenZWaveApp) SoftResetController(homeID uint32) error {
+	logrus.Warningf("SoftResetController: network %x", homeID)
+	if app.ozwAPI.GetControllerByHomeID(homeID) == nil {
+		return lib.MakeErrorf("SoftResetController: No controller for network %x", homeID)
+	}
+	goopenzwave.SoftReset(homeID)
+	return nil
+}
+
+// RequestHardReset returns the token to confirm the hard reset of the controller of a network with
+// HardResetController. The token expires after ResetConfirmTimeout.
+func (app *OpenZWaveApp) RequestHardReset(homeID uint32) (string, error) {
+	if app.ozwAPI.GetControllerByHomeID(homeID) == nil {
+		return "", lib.MakeErrorf("RequestHardReset: No controller for network %x", homeID)
+	}
+	logrus.Warningf("RequestHardReset: Hard reset of the controller of network %x requested", homeID)
+	return app.resets.Request(homeID, time.Now()), nil
+}
+
+// HardResetController resets the controller of a network to factory defaults. This erases the network so
+// the nodes have to be added again. The token of RequestHardReset confirms the reset.
+// The nodes and values of the network are cleared when openzwave reports the driver is reset, and the controller
+// is discovered again with the home ID of its new empty network. A failed reset leaves the network intact.
+func (app *OpenZWaveApp) HardResetController(homeID uint32, token string) error {
+	if app.ozwAPI.GetControllerByHomeID(homeID) == nil {
+		return lib.MakeErrorf("HardResetController: No controller for network %x", homeID)
+	}
+	if !app.resets.Confirm(homeID, token, time.Now()) {
+		return lib.MakeErrorf("HardResetController: Invalid or expired confirmation token. Request a new one.")
+	}
+	logrus.Warningf("HardResetController: Resetting the controller of network %x to factory defaults", homeID)
+	// openzwave restarts the driver after the reset, which takes a while
+	go goopenzwave.ResetController(homeID)
+	return nil
+}
+
+// ClearNetwork deletes the nodes of a network and the registration of their values
+// This is invoked when openzwave reports the driver is reset, eg after a hard reset of the controller.
+func (app *OpenZWaveApp) ClearNetwork(homeID uint32) {
+	valueCount := app.values.RemoveNetwork(homeID)
+	nodeCount := 0
+	for _, node := range app.pub.GetNodes() {
+		if node.HWID != types.NodeIDGateway && app.IsNodeOfController(node.HWID, homeID) {
+			app.deleteNode(node.HWID)
+			nodeCount++
+		}
+	}
+	logrus.Warningf("ClearNetwork: Network %x cleared. Removed %d nodes and %d values", homeID, nodeCount, valueCount)
+}
@@ -0,0 +1,37 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResetConfirmations(t *testing.T) {
+	confirmations := internal.NewResetConfirmations(time.Minute)
+	now := time.Now()
+	assert.False(t, confirmations.Confirm(testHomeID, "", now))
+
+	token := confirmations.Request(testHomeID, now)
+	assert.NotEmpty(t, token)
+	assert.False(t, confirmations.Confirm(testHomeID+1, token, now))
+	assert.True(t, confirmations.Confirm(testHomeID, token, now))
+	// a token confirms once
+	assert.False(t, confirmations.Confirm(testHomeID, token, now))
+
+	// a wrong token cancels the request
+	token = confirmations.Request(testHomeID, now)
+	assert.False(t, confirmations.Confirm(testHomeID, "wrong", now))
+	assert.False(t, confirmations.Confirm(testHomeID, token, now))
+
+	// a new request replaces the previous one
+	oldToken := confirmations.Request(testHomeID, now)
+	token = confirmations.Request(testHomeID, now)
+	assert.NotEqual(t, oldToken, token)
+	assert.False(t, confirmations.Confirm(testHomeID, oldToken, now))
+
+	// expired tokens don't confirm
+	token = confirmations.Request(testHomeID, now)
+	assert.False(t, confirmations.Confirm(testHomeID, token, now.Add(2*time.Minute)))
+}
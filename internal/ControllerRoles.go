@@ -0,0 +1,175 @@
+// Package internal with the controller commands that change the role of the controller in the network
+package internal
+
+import (
+	"fmt"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// Controller node attributes with the role of the controller in the network
+const (
+	NodeAttrControllerRole   types.NodeAttr = "controllerRole"         // primary or secondary
+	NodeAttrStaticController types.NodeAttr = "staticUpdateController" // true if the controller is the SUC
+	NodeAttrSUCNodeID        types.NodeAttr = "sucNodeID"              // node ID of the SUC, 0 if the network has none
+	NodeAttrBridgeController types.NodeAttr = "bridgeController"       // true if the controller is a bridge controller
+)
+
+// Controller roles
+const (
+	ControllerRolePrimary   = "primary"
+	ControllerRoleSecondary = "secondary"
+)
+
+// ControllerCommandButtons are the inputs of the controller node that change its role in the network, reset
+// it, back up its network or include a provisioned device
+// Learn mode, create primary and transfer primary take a start or stop payload, see ParseStartStopPayload.
+// Replication takes the secondary controller node as payload, see ParseNodeCommandPayload. Hard reset takes
+// the confirmation token as payload, see ParseTokenPayload. Restore takes the backup file, see ParseFilePayload.
+// Including a provisioned device takes its DSK, see ParseDSKPayload.
+var ControllerCommandButtons = map[string]string{
+	ButtonInstanceLearnMode:          "Join another network. Start add node on the primary controller of the other network.",
+	ButtonInstanceReplicate:          "Copy the network information to the secondary controller node in the payload",
+	ButtonInstanceCreatePrimary:      "Become the primary controller when the old primary has failed. Requires a SUC.",
+	ButtonInstanceTransferPrimary:    "Transfer the primary role to another controller, this controller becomes secondary",
+	ButtonInstanceSoftReset:          "Restart the controller without erasing its network",
+	ButtonInstanceHardReset:          "Reset the controller to factory defaults. Press without payload for a confirmation token.",
+	ButtonInstanceBackupNetwork:      "Save the network cache, node IDs and node configuration in a backup archive in the cache folder",
+	ButtonInstanceRestoreNetwork:     "Restore the network from the backup archive in the payload. The home ID must match.",
+	ButtonInstanceIncludeProvisioned: "Start the provisioned inclusion of the device with the DSK in the payload",
+}
+
+// publishControllerRoles publishes the role of the controller in its network as controller node attributes
+// This is updated when the driver is ready and after each controller command.
+func (app *OpenZWaveApp) publishControllerRoles(homeID uint32) {
+	controller := app.ozwAPI.GetControllerByHomeID(homeID)
+	if controller == nil {
+		return
+	}
+	role := ControllerRoleSecondary
+	if goopenzwave.IsPrimaryController(homeID) {
+		role = ControllerRolePrimary
+	}
+	app.pub.UpdateNodeAttr(app.MakeNodeHWID(homeID, app.ozwAPI.GetControllerState(controller).NodeID), types.NodeAttrMap{
+		NodeAttrControllerRole:   role,
+		NodeAttrStaticController: fmt.Sprint(goopenzwave.IsStaticUpdateController(homeID)),
+		NodeAttrSUCNodeID:        fmt.Sprint(app.ozwAPI.GetSucNodeID(homeID)),
+		NodeAttrBridgeController: fmt.Sprint(goopenzwave.IsBridgeController(homeID)),
+	})
+}
+
+// SetLearnMode starts or stops learn mode to join another network
+// The primary controller of the other network must be adding a node. Once completed the controller has the
+// home ID of the other network and its nodes are discovered under that network.
+func (app *OpenZWaveApp) SetLearnMode(homeID uint32, start bool) error {
+	logrus.Infof("SetLearnMode: network %x, start=%v", homeID, start)
+	if !start {
+		goopenzwave.CancelControllerCommand(homeID)
+		return nil
+	}
+	err := app.CheckControllerReady(homeID)
+	if err == nil {
+		err = app.startControllerCommand(homeID, ButtonInstanceLearnMode)
+	}
+	if err == nil && !app.ozwAPI.AddControllerToOtherNetwork(homeID) {
+		err = lib.MakeErrorf("SetLearnMode: The controller of network %x rejected learn mode", homeID)
+	}
+	return err
+}
+
+// ReplicateController sends the network information to a secondary controller node
+// This requires the controller to be the primary.
+func (app *OpenZWaveApp) ReplicateController(nodeHWID string) error {
+	logrus.Infof("ReplicateController: Node %s", nodeHWID)
+	homeID, zwNodeID, err := app.GetNodeAddress(nodeHWID)
+	if err == nil {
+		err = app.CheckControllerReady(homeID)
+	}
+	if err != nil {
+		return err
+	}
+	if !goopenzwave.IsPrimaryController(homeID) {
+		return lib.MakeErrorf("ReplicateController: The controller of network %x is not the primary", homeID)
+	}
+	err = app.startControllerCommand(homeID, ButtonInstanceReplicate)
+	if err == nil && !goopenzwave.ReplicationSend(homeID, zwNodeID) {
+		err = lib.MakeErrorf("ReplicateController: The controller rejected replication to node %s", nodeHWID)
+	}
+	return err
+}
+
+// CreateNewPrimary starts or stops becoming the primary controller when the old primary has failed
+// This requires a SUC in the network and the controller not to be the primary already.
+func (app *OpenZWaveApp) CreateNewPrimary(homeID uint32, start bool) error {
+	logrus.Infof("CreateNewPrimary: network %x, start=%v", homeID, start)
+	if !start {
+		goopenzwave.CancelControllerCommand(homeID)
+		return nil
+	}
+	err := app.CheckControllerReady(homeID)
+	if err != nil {
+		return err
+	}
+	if goopenzwave.IsPrimaryController(homeID) {
+		return lib.MakeErrorf("CreateNewPrimary: The controller of network %x is already the primary", homeID)
+	}
+	if app.ozwAPI.GetSucNodeID(homeID) == 0 {
+		return lib.MakeErrorf("CreateNewPrimary: Network %x has no SUC", homeID)
+	}
+	err = app.startControllerCommand(homeID, ButtonInstanceCreatePrimary)
+	if err == nil && !goopenzwave.CreateNewPrimary(homeID) {
+		err = lib.MakeErrorf("CreateNewPrimary: The controller of network %x rejected the command", homeID)
+	}
+	return err
+}
+
+// TransferPrimaryRole starts or stops transferring the primary role to another controller
+// The other controller is added to the network if needed and becomes the primary. This controller becomes
+// a secondary controller. This requires the controller to be the primary.
+func (app *OpenZWaveApp) TransferPrimaryRole(homeID uint32, start bool) error {
+	logrus.Infof("TransferPrimaryRole: network %x, start=%v", homeID, start)
+	if !start {
+		goopenzwave.CancelControllerCommand(homeID)
+		return nil
+	}
+	err := app.CheckControllerReady(homeID)
+	if err != nil {
+		return err
+	}
+	if !goopenzwave.IsPrimaryController(homeID) {
+		return lib.MakeErrorf("TransferPrimaryRole: The controller of network %x is not the primary", homeID)
+	}
+	err = app.startControllerCommand(homeID, ButtonInstanceTransferPrimary)
+	if err == nil && !goopenzwave.TransferPrimaryRole(homeID) {
+		err = lib.MakeErrorf("TransferPrimaryRole: The controller of network %x rejected the command", homeID)
+	}
+	return err
+}
+
+// AssignReturnRoute requests a node to update its return route to the controller
+func (app *OpenZWaveApp) AssignReturnRoute(nodeHWID string) error {
+	logrus.Infof("AssignReturnRoute: Node %s", nodeHWID)
+	homeID, zwNodeID, err := app.GetNodeAddress(nodeHWID)
+	if err != nil {
+		return err
+	}
+	err = app.startControllerCommand(homeID, ButtonInstanceAssignReturnRoute)
+	if err == nil && !goopenzwave.AssignReturnRoute(homeID, zwNodeID) {
+		err = lib.MakeErrorf("AssignReturnRoute: The controller rejected the command for node %s", nodeHWID)
+	}
+	return err
+}
+
+// createControllerCommandInputs creates the inputs of the controller node to change its role, see
+// ControllerCommandButtons
+func (app *OpenZWaveApp) createControllerCommandInputs(nodeHWID string) {
+	for instance, description := range ControllerCommandButtons {
+		if app.pub.GetInputByNodeHWID(nodeHWID, types.InputTypePushButton, instance) == nil {
+			input := app.pub.CreateInput(nodeHWID, types.InputTypePushButton, instance, app.HandleInputCommand)
+			input.Attr[types.NodeAttrDescription] = description
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package internal with supervision of the connection to the zwave controller
+package internal
+
+import (
+	"os"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Reconnect backoff delays in seconds
+const (
+	ReconnectMinDelay = 1
+	ReconnectMaxDelay = 60
+)
+
+// CheckAlive checks if openzwave controller can still be reached
+func (app *OpenZWaveApp) CheckAlive(controller *ZWaveController) bool {
+	isAlive := app.ozwAPI.IsAlive(controller)
+	address := app.ozwAPI.GetControllerState(controller).Address
+	if isAlive && address != "" {
+		isAlive = app.IsGatewayAvailable(controller, address)
+	}
+	if !isAlive {
+		logrus.Errorf("OpenZWaveApp.CheckAlive. ZWave Controller Connection Lost (gateway '%s')", controller.gateway)
+	}
+	return isAlive
+}
+
+// StartSupervisor starts the periodic liveness check of the controller connections and the nodes
+// Each controller is supervised separately. When a controller is no longer reachable it is reconnected.
+// See ReconnectController. Nodes are checked unless pinging is disabled, see CheckNodesAlive. Communication
+// statistics are published periodically unless disabled, see PublishCommStatistics.
+func (app *OpenZWaveApp) StartSupervisor() {
+	app.stopSupervisor = make(chan bool)
+	for _, controller := range app.ozwAPI.controllers {
+		app.supervisorWG.Add(1)
+		go app.superviseLoop(controller)
+	}
+	if app.config.PingInterval >= 0 {
+		app.supervisorWG.Add(1)
+		go app.livenessLoop()
+	}
+	statisticsInterval := app.config.StatisticsInterval
+	if statisticsInterval == 0 {
+		statisticsInterval = DefaultStatisticsInterval
+	}
+	if statisticsInterval > 0 {
+		app.supervisorWG.Add(1)
+		go app.statisticsLoop(statisticsInterval)
+	}
+}
+
+// StopSupervisor stops the periodic liveness check and waits for a reconnect in progress to end
+func (app *OpenZWaveApp) StopSupervisor() {
+	if app.stopSupervisor == nil {
+		return
+	}
+	close(app.stopSupervisor)
+	app.supervisorWG.Wait()
+	app.stopSupervisor = nil
+}
+
+// superviseLoop runs the liveness check of a controller every CheckAliveInterval seconds until stopped
+func (app *OpenZWaveApp) superviseLoop(controller *ZWaveController) {
+	logrus.Infof("OpenZWaveApp.superviseLoop: Checking controller '%s' every %d seconds", controller.gateway, CheckAliveInterval)
+	ticker := time.NewTicker(CheckAliveInterval * time.Second)
+	defer ticker.Stop()
+	defer app.supervisorWG.Done()
+
+	for {
+		select {
+		case <-app.stopSupervisor:
+			logrus.Infof("OpenZWaveApp.superviseLoop: Stopped")
+			return
+		case <-ticker.C:
+			if !app.CheckAlive(controller) {
+				app.ReconnectController(controller)
+			}
+		}
+	}
+}
+
+// FindGatewayAddress returns the address of an available controller for openzwave, or "" if none is available.
+// This is the configured gateway device, the pseudo-terminal of a connected serial server bridge, or the
+// detected USB controller.
+func (app *OpenZWaveApp) FindGatewayAddress(controller *ZWaveController) string {
+	address := controller.gateway
+	if controller.tcpBridge != nil {
+		address = controller.tcpBridge.PtyPath()
+	} else if address == "" {
+		address = app.FindUsbStickAddress(controller)
+	}
+	if address == "" || !app.IsGatewayAvailable(controller, address) {
+		return ""
+	}
+	return address
+}
+
+// IsGatewayAvailable returns true if the controller at the given address can be reached
+// Bridged controllers are available while the bridge is connected to the serial server. Local
+// controllers are available while their device exists.
+func (app *OpenZWaveApp) IsGatewayAvailable(controller *ZWaveController, address string) bool {
+	if controller.tcpBridge != nil {
+		return controller.tcpBridge.IsConnected()
+	}
+	_, err := os.Stat(address)
+	return err == nil
+}
+
+// ReconnectController tears down the openzwave driver, waits for the controller device to (re)appear and
+// adds the driver again. Openzwave resynchronises the nodes after the driver is ready.
+// The controller is lost while it is unavailable and initializing while reconnecting until the driver is
+// ready. The publisher status is derived from the state of all controllers, see GetPublisherRunState. This returns false when stopped before reconnecting.
+// Only the nodes in the network of the controller are affected.
+func (app *OpenZWaveApp) ReconnectController(controller *ZWaveController) bool {
+	pub := app.pub
+	state := app.ozwAPI.GetControllerState(controller)
+	if state.Address != "" {
+		logrus.Warningf("OpenZWaveApp.ReconnectController: Controller connection lost. Reconnecting.")
+		homeID := state.HomeID
+		app.ozwAPI.SetControllerLost(controller, true)
+		app.ozwAPI.RemoveDriver(controller)
+		app.updatePublisherRunState()
+
+		// nodes can't be reached until the controller is back
+		for _, node := range pub.GetNodes() {
+			if node.HWID != types.NodeIDGateway && app.IsNodeOfController(node.HWID, homeID) {
+				pub.UpdateNodeErrorStatus(node.HWID, types.NodeRunStateLost, "Controller connection lost")
+			}
+		}
+	} else {
+		logrus.Warningf("OpenZWaveApp.ReconnectController: Waiting for the controller to appear.")
+	}
+
+	delay := ReconnectMinDelay
+	for {
+		select {
+		case <-app.stopSupervisor:
+			logrus.Warningf("OpenZWaveApp.ReconnectController: Stopped while reconnecting")
+			return false
+		case <-time.After(time.Duration(delay) * time.Second):
+		}
+		// the controller can come back at a different address
+		address := app.FindGatewayAddress(controller)
+		if address != "" {
+			err := app.ozwAPI.AddDriver(controller, address)
+			if err == nil {
+				logrus.Warningf("OpenZWaveApp.ReconnectController: Controller reconnected at %s", address)
+				app.ozwAPI.SetControllerLost(controller, false)
+				app.updatePublisherRunState()
+				return true
+			}
+			app.updatePublisherRunState()
+		}
+		logrus.Infof("OpenZWaveApp.ReconnectController: Controller not available. Retry in %d seconds", delay)
+		delay = delay * 2
+		if delay > ReconnectMaxDelay {
+			delay = ReconnectMaxDelay
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package internal_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControllerAvailability(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	devFile := path.Join(testFolder, "ttyACM0")
+	ozwAPI := internal.NewOzwAPI()
+	controller := ozwAPI.AddController(devFile)
+
+	// the configured device is only used while it exists
+	assert.Equal(t, "", app.FindGatewayAddress(controller))
+	err := ioutil.WriteFile(devFile, []byte{}, 0644)
+	require.NoError(t, err)
+	assert.Equal(t, devFile, app.FindGatewayAddress(controller))
+
+	// a controller that is initializing is alive while its device exists
+	ozwAPI.SetControllerAddress(controller, devFile)
+	assert.True(t, app.CheckAlive(controller))
+	require.NoError(t, os.Remove(devFile))
+	assert.False(t, app.CheckAlive(controller))
+	assert.Equal(t, "", app.FindGatewayAddress(controller))
+}
+
+func TestStartStopSupervisor(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	config.PingInterval = -1
+	app := internal.NewOpenZwaveApp(config, pub)
+
+	// stopping waits for the supervisor loops to end and can be repeated
+	app.StopSupervisor()
+	app.StartSupervisor()
+	stopped := make(chan bool)
+	go func() {
+		app.StopSupervisor()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		assert.Fail(t, "StopSupervisor didn't stop the supervisor")
+	}
+	app.StopSupervisor()
+}
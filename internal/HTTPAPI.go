@@ -0,0 +1,542 @@
+// Package internal with the local HTTP JSON API for managing the zwave network
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// APIPathPrefix is the path of the HTTP API
+const APIPathPrefix = "/api/"
+
+// DefaultAPIAddress is the default address of the HTTP API
+const DefaultAPIAddress = "localhost:9292"
+
+// APIMaxRequestSize is the max size in bytes of a HTTP API request body
+const APIMaxRequestSize = 64 * 1024
+
+// APITokenHeader is the request header with the API token, see the apiToken configuration
+const APITokenHeader = "X-API-Token"
+
+// APIValue describes a zwave value of a node in the HTTP API
+// The value ID is a decimal string as it doesn't fit in a javascript number.
+type APIValue struct {
+	ID       string `json:"id"`
+	Label    string `json:"label"`
+	Units    string `json:"units,omitempty"`
+	Genre    string `json:"genre"`
+	Type     string `json:"type"`
+	ReadOnly bool   `json:"readOnly"`
+	Value    string `json:"value"`
+	InputID  string `json:"inputID,omitempty"`  // input that controls the value
+	OutputID string `json:"outputID,omitempty"` // output that publishes the value
+}
+
+// APIController describes a controller and the state of its network in the HTTP API
+type APIController struct {
+	Gateway   string `json:"gateway"`             // configured gateway address, "" for automatic detection
+	HomeID    string `json:"homeID,omitempty"`    // home ID of the network in hex, once the driver is ready
+	NodeHWID  string `json:"nodeHWID,omitempty"`  // HWID of the controller node, once the driver is ready
+	Phase     string `json:"phase"`               // driver startup phase, see ControllerPhase
+	Command   string `json:"command,omitempty"`   // state of the last controller command, see ControllerCommandState
+	Role      string `json:"role,omitempty"`      // primary or secondary, see NodeAttrControllerRole
+	SUCNodeID string `json:"sucNodeID,omitempty"` // node ID of the SUC, 0 if the network has none
+}
+
+// APISetValue is the request body to set a zwave value
+type APISetValue struct {
+	Value string `json:"value"`
+}
+
+// APIStatus is the response to an accepted command or a failed request
+type APIStatus struct {
+	Status string `json:"status,omitempty"` // "accepted" for commands, "confirm" for a hard reset request
+	Error  string `json:"error,omitempty"`
+	Token  string `json:"token,omitempty"` // token to confirm a hard reset with
+	File   string `json:"file,omitempty"`  // network backup archive in the cache folder
+}
+
+// apiError is an error of a HTTP API request with its HTTP status code
+type apiError struct {
+	statusCode int
+	err        error
+}
+
+// newAPIError returns an API error with the given status code and message
+func newAPIError(statusCode int, format string, args ...interface{}) *apiError {
+	return &apiError{statusCode: statusCode, err: lib.MakeErrorf(format, args...)}
+}
+
+// writeAPIResponse writes a JSON response body with the given status code
+func writeAPIResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logrus.Warningf("writeAPIResponse: %v", err)
+	}
+}
+
+// readAPIRequest decodes the JSON body of a request
+func readAPIRequest(r *http.Request, request interface{}) *apiError {
+	err := json.NewDecoder(io.LimitReader(r.Body, APIMaxRequestSize)).Decode(request)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "Invalid request body: %v", err)
+	}
+	return nil
+}
+
+// checkAPIMethod returns an error if the request doesn't use the given method
+func checkAPIMethod(w http.ResponseWriter, r *http.Request, method string) *apiError {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		return newAPIError(http.StatusMethodNotAllowed, "Method %s not allowed. Use %s", r.Method, method)
+	}
+	return nil
+}
+
+// isLoopbackHost returns true for localhost and loopback IP addresses
+func isLoopbackHost(hostName string) bool {
+	ip := net.ParseIP(hostName)
+	return strings.EqualFold(hostName, "localhost") || (ip != nil && ip.IsLoopback())
+}
+
+// IsAPIHostAllowed returns true if a Host or Origin host of a request addresses the API listen address
+// This rejects DNS names that resolve to the listen address, eg through DNS rebinding. A loopback listen
+// address accepts localhost and the loopback IP addresses. A listen address without host, eg :9292, accepts
+// localhost and IP addresses as names of the host can't be verified.
+func IsAPIHostAllowed(listenAddress string, host string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return false
+	}
+	hostName, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostName, port = strings.Trim(host, "[]"), "80"
+	}
+	listenIP := net.ParseIP(listenHost)
+	if port != listenPort || hostName == "" {
+		return false
+	} else if strings.EqualFold(hostName, listenHost) {
+		return true
+	} else if listenHost == "" || (listenIP != nil && listenIP.IsUnspecified()) {
+		return strings.EqualFold(hostName, "localhost") || net.ParseIP(hostName) != nil
+	}
+	return isLoopbackHost(listenHost) && isLoopbackHost(hostName)
+}
+
+// checkAPIRequest rejects requests that don't address the configured API listen address, requests without
+// the configured API token and commands that aren't JSON requests.
+// Browsers can't send a cross-origin JSON request without asking the API first, which it doesn't answer, so
+// this protects the API against requests from web pages.
+func (app *OpenZWaveApp) checkAPIRequest(r *http.Request) *apiError {
+	listenAddress := app.config.APIAddress
+	if listenAddress == "" {
+		listenAddress = DefaultAPIAddress
+	}
+	if !IsAPIHostAllowed(listenAddress, r.Host) {
+		return newAPIError(http.StatusForbidden, "Host '%s' is not the API address", r.Host)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		originURL, err := url.Parse(origin)
+		if err != nil || !IsAPIHostAllowed(listenAddress, originURL.Host) {
+			return newAPIError(http.StatusForbidden, "Origin '%s' is not allowed", origin)
+		}
+	}
+	token := r.Header.Get(APITokenHeader)
+	if app.config.APIToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(app.config.APIToken)) != 1 {
+		return newAPIError(http.StatusUnauthorized, "Missing or invalid %s header", APITokenHeader)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			return newAPIError(http.StatusUnsupportedMediaType, "Content-Type of %s requests must be application/json",
+				r.Method)
+		}
+	}
+	return nil
+}
+
+// getAPIValue returns the API description of a zwave value
+func (app *OpenZWaveApp) getAPIValue(zwValue *goopenzwave.ValueID) *APIValue {
+	return &APIValue{
+		ID:       strconv.FormatUint(zwValue.ID, 10),
+		Label:    zwValue.GetLabel(),
+		Units:    zwValue.GetUnits(),
+		Genre:    zwValue.Genre.String(),
+		Type:     zwValue.Type.String(),
+		ReadOnly: zwValue.IsReadOnly(),
+		Value:    zwValue.GetAsString(),
+		InputID:  app.values.GetInputID(zwValue),
+		OutputID: app.values.GetOutputID(zwValue),
+	}
+}
+
+// getAPIHomeID returns the home ID of the network in the homeID query parameter, in hex
+// Without parameter this is the network of the first controller.
+func (app *OpenZWaveApp) getAPIHomeID(r *http.Request) (uint32, *apiError) {
+	homeIDText := r.URL.Query().Get("homeID")
+	if homeIDText == "" {
+		if len(app.ozwAPI.controllers) == 0 {
+			return 0, newAPIError(http.StatusConflict, "No controller")
+		}
+		return app.ozwAPI.GetControllerState(app.ozwAPI.controllers[0]).HomeID, nil
+	}
+	homeID, err := strconv.ParseUint(homeIDText, 16, 32)
+	if err != nil {
+		return 0, newAPIError(http.StatusBadRequest, "Invalid homeID '%s'", homeIDText)
+	}
+	return uint32(homeID), nil
+}
+
+// getAPIControllers returns the API description of the controllers
+func (app *OpenZWaveApp) getAPIControllers() []*APIController {
+	controllers := make([]*APIController, 0, len(app.ozwAPI.controllers))
+	for _, controller := range app.ozwAPI.controllers {
+		state := app.ozwAPI.GetControllerState(controller)
+		apiController := &APIController{
+			Gateway: controller.gateway,
+			Phase:   string(state.Phase),
+		}
+		if state.HomeID != 0 {
+			apiController.HomeID = fmt.Sprintf("%08x", state.HomeID)
+			apiController.NodeHWID = app.MakeNodeHWID(state.HomeID, state.NodeID)
+			apiController.Command, _ = app.pub.GetNodeStatus(apiController.NodeHWID, NodeStatusControllerCommand)
+			if node := app.pub.GetNodeByHWID(apiController.NodeHWID); node != nil {
+				apiController.Role = node.Attr[NodeAttrControllerRole]
+				apiController.SUCNodeID = node.Attr[NodeAttrSUCNodeID]
+			}
+		}
+		controllers = append(controllers, apiController)
+	}
+	return controllers
+}
+
+// checkAPIControllerReady returns a conflict error if the controller of the network isn't ready
+func (app *OpenZWaveApp) checkAPIControllerReady(homeID uint32) *apiError {
+	err := app.CheckControllerReady(homeID)
+	if err != nil {
+		return &apiError{statusCode: http.StatusConflict, err: err}
+	}
+	return nil
+}
+
+// serveAPINetwork handles the network commands
+// GET network returns the controllers. POST to network/inclusion/start or stop to start or stop adding nodes, to network/exclusion/start or stop
+// to start or stop removing nodes, and to network/heal to heal the network. POST to network/learnmode,
+// network/createprimary and network/transferprimary with /start or /stop change the role of the controller.
+// The SUC can't be assigned as goopenzwave doesn't expose SetSUCNodeId. POST to network/softreset restarts
+// the controller. POST to network/hardreset returns a confirmation token and POST to network/hardreset?token=
+// with the token resets the controller to factory defaults. POST to network/backup saves the network in a backup
+// archive in the cache folder and POST to network/restore?file= restores the network from the archive.
+// POST to network/inclusion/start?dsk= includes a device of the provisioning list, see IncludeProvisionedNode.
+func (app *OpenZWaveApp) serveAPINetwork(w http.ResponseWriter, r *http.Request, parts []string) *apiError {
+	if len(parts) == 0 {
+		if err := checkAPIMethod(w, r, http.MethodGet); err != nil {
+			return err
+		}
+		writeAPIResponse(w, http.StatusOK, app.getAPIControllers())
+		return nil
+	}
+	if err := checkAPIMethod(w, r, http.MethodPost); err != nil {
+		return err
+	}
+	command := strings.Join(parts, "/")
+	homeID, apiErr := app.getAPIHomeID(r)
+	if apiErr != nil {
+		return apiErr
+	}
+	logrus.Infof("OpenZWaveApp.serveAPINetwork: Command %s for network %x", command, homeID)
+	var err error
+	switch command {
+	case "inclusion/start", "inclusion/stop":
+		if dsk := r.URL.Query().Get("dsk"); dsk != "" && command == "inclusion/start" {
+			err = app.IncludeProvisionedNode(homeID, dsk)
+			break
+		}
+		err = app.AddZWaveNode(homeID, command == "inclusion/start")
+	case "exclusion/start", "exclusion/stop":
+		err = app.RemoveZWaveNode(homeID, command == "exclusion/start")
+	case "heal":
+		err = app.StartHealNetwork(homeID)
+	case "learnmode/start", "learnmode/stop":
+		err = app.SetLearnMode(homeID, command == "learnmode/start")
+	case "createprimary/start", "createprimary/stop":
+		err = app.CreateNewPrimary(homeID, command == "createprimary/start")
+	case "transferprimary/start", "transferprimary/stop":
+		err = app.TransferPrimaryRole(homeID, command == "transferprimary/start")
+	case "softreset":
+		err = app.SoftResetController(homeID)
+	case "hardreset":
+		token := r.URL.Query().Get("token")
+		if token != "" {
+			err = app.HardResetController(homeID, token)
+			break
+		}
+		token, err = app.RequestHardReset(homeID)
+		if err == nil {
+			writeAPIResponse(w, http.StatusOK, &APIStatus{Status: CommandStatusConfirm, Token: token})
+			return nil
+		}
+	case "backup":
+		var filename string
+		filename, _, err = app.BackupNetwork(homeID)
+		if err == nil {
+			writeAPIResponse(w, http.StatusOK, &APIStatus{Status: "accepted", File: filename})
+			return nil
+		}
+	case "restore":
+		filename := r.URL.Query().Get("file")
+		if filename == "" {
+			return newAPIError(http.StatusBadRequest, "Missing backup file")
+		}
+		_, err = app.RestoreNetwork(homeID, filename)
+	default:
+		return newAPIError(http.StatusNotFound, "Unknown network command '%s'", command)
+	}
+	if err != nil {
+		return &apiError{statusCode: http.StatusConflict, err: err}
+	}
+	writeAPIResponse(w, http.StatusAccepted, &APIStatus{Status: "accepted"})
+	return nil
+}
+
+// serveAPIProvisioning handles the provisioning list
+// GET provisioning returns the provisioned devices. POST provisioning with body {"dsk": "...", "name": "...",
+// "location": "...", "profile": "..."} adds a device and DELETE provisioning/{dsk} removes it.
+func (app *OpenZWaveApp) serveAPIProvisioning(w http.ResponseWriter, r *http.Request, parts []string) *apiError {
+	if len(parts) > 1 {
+		return newAPIError(http.StatusNotFound, "Unknown path '%s'", r.URL.Path)
+	} else if len(parts) == 1 {
+		if err := checkAPIMethod(w, r, http.MethodDelete); err != nil {
+			return err
+		}
+		err := app.RemoveProvisioningEntry(parts[0])
+		if err != nil {
+			return &apiError{statusCode: http.StatusNotFound, err: err}
+		}
+		writeAPIResponse(w, http.StatusOK, &APIStatus{Status: "accepted"})
+		return nil
+	}
+	if r.Method == http.MethodGet {
+		writeAPIResponse(w, http.StatusOK, app.provisioning.GetEntries())
+		return nil
+	}
+	if err := checkAPIMethod(w, r, http.MethodPost); err != nil {
+		return err
+	}
+	entry := ProvisioningEntry{}
+	if apiErr := readAPIRequest(r, &entry); apiErr != nil {
+		return apiErr
+	}
+	newEntry, err := app.AddProvisioningEntry(entry)
+	if err != nil {
+		return &apiError{statusCode: http.StatusBadRequest, err: err}
+	}
+	writeAPIResponse(w, http.StatusOK, newEntry)
+	return nil
+}
+
+// serveAPINodeValue gets a zwave value of a node with GET nodes/{hwid}/values/{valueID}, or sets it
+// with PUT and body {"value": "new value"}
+func (app *OpenZWaveApp) serveAPINodeValue(w http.ResponseWriter, r *http.Request,
+	node *types.NodeDiscoveryMessage, valueIDText string) *apiError {
+
+	homeID, zwNodeID, err := app.GetNodeAddress(node.HWID)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, "Node %s is not a zwave node", node.HWID)
+	}
+	valueID, err := strconv.ParseUint(valueIDText, 10, 64)
+	zwValue := app.values.GetNodeValue(homeID, zwNodeID, valueID)
+	if err != nil || zwValue == nil {
+		return newAPIError(http.StatusNotFound, "Node %s has no value '%s'", node.HWID, valueIDText)
+	}
+	if r.Method == http.MethodGet {
+		writeAPIResponse(w, http.StatusOK, app.getAPIValue(zwValue))
+		return nil
+	}
+	if apiErr := checkAPIMethod(w, r, http.MethodPut); apiErr != nil {
+		return apiErr
+	}
+	setValue := APISetValue{}
+	if apiErr := readAPIRequest(r, &setValue); apiErr != nil {
+		return apiErr
+	}
+	if zwValue.IsReadOnly() {
+		return newAPIError(http.StatusBadRequest, "Value %d of node %s is read-only", valueID, node.HWID)
+	}
+	logrus.Infof("OpenZWaveApp.serveAPINodeValue: Node %s value %d set to '%s'", node.HWID, valueID, setValue.Value)
+	app.commStats.RecordSent(node.HWID)
+	app.metrics.CommandSent(homeID, valueID, time.Now())
+	err = app.SetZWaveValue(zwValue, setValue.Value)
+	if err != nil {
+		return &apiError{statusCode: http.StatusBadRequest, err: err}
+	}
+	writeAPIResponse(w, http.StatusAccepted, &APIStatus{Status: "accepted"})
+	return nil
+}
+
+// serveAPINode handles the requests for a node
+// GET nodes/{hwid} returns the node and GET nodes/{hwid}/values the registered zwave values of the node.
+// PUT nodes/{hwid}/config with body {"attrName": "value"} updates the node configuration and returns status 400
+// with the error of each rejected attribute, see ApplyNodeConfig. POST to
+// nodes/{hwid}/refresh refreshes the node info, POST to nodes/{hwid}/removefailed removes a failed node,
+// POST to nodes/{hwid}/replacefailed replaces a failed node, see ReplaceFailedNode, POST to
+// nodes/{hwid}/assignreturnroute updates the return route of the node and POST to nodes/{hwid}/replicate
+// copies the network information to a secondary controller node.
+// The neighbors of a node are not available as goopenzwave doesn't expose the neighbor lists.
+func (app *OpenZWaveApp) serveAPINode(w http.ResponseWriter, r *http.Request, parts []string) *apiError {
+	node := app.pub.GetNodeByHWID(parts[0])
+	if node == nil {
+		return newAPIError(http.StatusNotFound, "Unknown node '%s'", parts[0])
+	}
+	if len(parts) == 1 {
+		if err := checkAPIMethod(w, r, http.MethodGet); err != nil {
+			return err
+		}
+		writeAPIResponse(w, http.StatusOK, node)
+		return nil
+	}
+	if parts[1] == "values" && len(parts) == 3 {
+		return app.serveAPINodeValue(w, r, node, parts[2])
+	}
+	if len(parts) > 2 {
+		return newAPIError(http.StatusNotFound, "Unknown path '%s'", r.URL.Path)
+	}
+	homeID, zwNodeID, addressErr := app.GetNodeAddress(node.HWID)
+	switch parts[1] {
+	case "values":
+		if err := checkAPIMethod(w, r, http.MethodGet); err != nil {
+			return err
+		}
+		nodeValues := make([]*APIValue, 0)
+		if addressErr == nil {
+			for _, zwValue := range app.values.GetNodeValues(homeID, zwNodeID) {
+				nodeValues = append(nodeValues, app.getAPIValue(zwValue))
+			}
+		}
+		writeAPIResponse(w, http.StatusOK, nodeValues)
+		return nil
+	case "config":
+		if err := checkAPIMethod(w, r, http.MethodPut); err != nil {
+			return err
+		}
+		changes := types.NodeAttrMap{}
+		if err := readAPIRequest(r, &changes); err != nil {
+			return err
+		}
+		rejected := app.ApplyNodeConfig(node, changes)
+		if len(rejected) > 0 {
+			errorTexts := make([]string, 0, len(rejected))
+			for attrName, err := range rejected {
+				errorTexts = append(errorTexts, fmt.Sprintf("%s: %v", attrName, err))
+			}
+			sort.Strings(errorTexts)
+			return newAPIError(http.StatusBadRequest, "Node %s rejected the configuration of %s",
+				node.HWID, strings.Join(errorTexts, "; "))
+		}
+	case "refresh", "removefailed", "replacefailed", "assignreturnroute", "replicate":
+		if err := checkAPIMethod(w, r, http.MethodPost); err != nil {
+			return err
+		}
+		if addressErr != nil {
+			return newAPIError(http.StatusBadRequest, "Node %s is not a zwave node", node.HWID)
+		}
+		if err := app.checkAPIControllerReady(homeID); err != nil {
+			return err
+		}
+		var err error
+		switch parts[1] {
+		case "refresh":
+			app.RefreshNodeInfo(node.HWID)
+		case "removefailed":
+			err = app.RemoveFailedNode(node.HWID)
+		case "replacefailed":
+			err = app.ReplaceFailedNode(node.HWID)
+		case "assignreturnroute":
+			err = app.AssignReturnRoute(node.HWID)
+		case "replicate":
+			err = app.ReplicateController(node.HWID)
+		}
+		if err != nil {
+			return &apiError{statusCode: http.StatusConflict, err: err}
+		}
+	default:
+		return newAPIError(http.StatusNotFound, "Unknown path '%s'", r.URL.Path)
+	}
+	writeAPIResponse(w, http.StatusAccepted, &APIStatus{Status: "accepted"})
+	return nil
+}
+
+// ServeAPI is the HTTP handler of the local JSON API for managing the zwave network
+// The API is intended for local tooling that doesn't use the IoTDomain message bus. It should only listen
+// on a local address. Requests must be addressed to the listen address and, if configured, include the API
+// token. Commands must be JSON requests, see checkAPIRequest. Commands use the same methods as the
+// controller pushbuttons and are rejected with status 409 while the controller isn't ready.
+// GET /api/nodes returns all nodes. See serveAPINode and serveAPINetwork for the other requests.
+func (app *OpenZWaveApp) ServeAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPathPrefix), "/")
+	parts := strings.Split(path, "/")
+	apiErr := app.checkAPIRequest(r)
+	switch {
+	case apiErr != nil:
+	case path == "nodes":
+		apiErr = checkAPIMethod(w, r, http.MethodGet)
+		if apiErr == nil {
+			writeAPIResponse(w, http.StatusOK, app.pub.GetNodes())
+		}
+	case parts[0] == "nodes":
+		apiErr = app.serveAPINode(w, r, parts[1:])
+	case parts[0] == "network":
+		apiErr = app.serveAPINetwork(w, r, parts[1:])
+	case parts[0] == "provisioning":
+		apiErr = app.serveAPIProvisioning(w, r, parts[1:])
+	default:
+		apiErr = newAPIError(http.StatusNotFound, "Unknown path '%s'", r.URL.Path)
+	}
+	if apiErr != nil {
+		logrus.Warningf("OpenZWaveApp.ServeAPI: %s %s: %v", r.Method, r.URL.Path, apiErr.err)
+		writeAPIResponse(w, apiErr.statusCode, &APIStatus{Error: apiErr.err.Error()})
+	}
+}
+
+// StartAPIServer starts the HTTP listener of the API at /api/
+func (app *OpenZWaveApp) StartAPIServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(APIPathPrefix, app.ServeAPI)
+	app.apiServer = &http.Server{Addr: address, Handler: mux}
+	logrus.Warningf("OpenZWaveApp.StartAPIServer: Serving the API on %s%s", address, APIPathPrefix)
+	go func(server *http.Server) {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("OpenZWaveApp.StartAPIServer: %v", err)
+		}
+	}(app.apiServer)
+}
+
+// StopAPIServer stops the HTTP listener of the API
+func (app *OpenZWaveApp) StopAPIServer() {
+	if app.apiServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	app.apiServer.Shutdown(ctx)
+	app.apiServer = nil
+}
@@ -0,0 +1,226 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// apiRequest sends a request to the API handler and returns the response
+func apiRequest(app *internal.OpenZWaveApp, method string, path string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Host = internal.DefaultAPIAddress
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	app.ServeAPI(response, request)
+	return response
+}
+
+func TestAPINodes(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	pub.CreateNode("12", types.NodeTypeSensor)
+
+	response := apiRequest(app, http.MethodGet, "/api/nodes", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+	nodes := make([]*types.NodeDiscoveryMessage, 0)
+	err := json.Unmarshal(response.Body.Bytes(), &nodes)
+	assert.NoError(t, err)
+	hwids := make([]string, 0)
+	for _, node := range nodes {
+		hwids = append(hwids, node.HWID)
+	}
+	assert.Contains(t, hwids, "12")
+
+	response = apiRequest(app, http.MethodGet, "/api/nodes/12", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	node := types.NodeDiscoveryMessage{}
+	err = json.Unmarshal(response.Body.Bytes(), &node)
+	assert.NoError(t, err)
+	assert.Equal(t, "12", node.HWID)
+
+	// a node without registered values
+	response = apiRequest(app, http.MethodGet, "/api/nodes/12/values", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "[]\n", response.Body.String())
+
+	response = apiRequest(app, http.MethodDelete, "/api/nodes", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+	assert.Equal(t, http.MethodGet, response.Header().Get("Allow"))
+}
+
+func TestAPIErrors(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	pub.CreateNode("12", types.NodeTypeSensor)
+
+	testCases := []struct {
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{http.MethodGet, "/api/unknown", "", http.StatusNotFound},
+		{http.MethodGet, "/api/nodes/99", "", http.StatusNotFound},
+		{http.MethodGet, "/api/nodes/12/unknown", "", http.StatusNotFound},
+		{http.MethodGet, "/api/nodes/12/neighbors", "", http.StatusNotFound},
+		{http.MethodGet, "/api/nodes/12/values/1001", "", http.StatusNotFound},
+		{http.MethodGet, "/api/nodes/12/values/notanumber", "", http.StatusNotFound},
+		{http.MethodPut, "/api/nodes/12/config", "not json", http.StatusBadRequest},
+		{http.MethodGet, "/api/nodes/12/config", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/network/heal", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/network/unknown", "", http.StatusNotFound},
+		{http.MethodPost, "/api/network/heal?homeID=xyz", "", http.StatusBadRequest},
+		// network management is rejected until the controller is ready
+		{http.MethodPost, "/api/network/heal", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/inclusion/start", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/exclusion/start", "", http.StatusConflict},
+		{http.MethodPost, "/api/nodes/12/refresh", "", http.StatusConflict},
+		{http.MethodPost, "/api/nodes/12/removefailed", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/learnmode/start", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/createprimary/start", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/transferprimary/start", "", http.StatusConflict},
+		{http.MethodPost, "/api/nodes/12/replicate", "", http.StatusConflict},
+		{http.MethodPost, "/api/nodes/12/assignreturnroute", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/suc", "", http.StatusNotFound},
+		{http.MethodPost, "/api/network/softreset", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/hardreset", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/hardreset?token=abc", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/backup", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/restore?file=backup.zip", "", http.StatusConflict},
+		{http.MethodPost, "/api/network/inclusion/start?dsk=" + testDSK, "", http.StatusConflict},
+		{http.MethodPost, "/api/provisioning", `{"dsk": "12345"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/provisioning", `{"dsk": "` + testDSK + `", "profile": "unknown"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/api/provisioning/" + testDSK, "", http.StatusNotFound},
+		{http.MethodPut, "/api/provisioning", "", http.StatusMethodNotAllowed},
+	}
+	for _, testCase := range testCases {
+		response := apiRequest(app, testCase.method, testCase.path, testCase.body)
+		assert.Equal(t, testCase.statusCode, response.Code, "%s %s", testCase.method, testCase.path)
+		status := internal.APIStatus{}
+		err := json.Unmarshal(response.Body.Bytes(), &status)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, status.Error, "%s %s", testCase.method, testCase.path)
+	}
+}
+
+func TestAPIProvisioning(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+
+	response := apiRequest(app, http.MethodPost, "/api/provisioning",
+		`{"dsk": "3402823669209384634633746074315682114553", "name": "sensor", "location": "kitchen"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	entry := internal.ProvisioningEntry{}
+	err := json.Unmarshal(response.Body.Bytes(), &entry)
+	assert.NoError(t, err)
+	assert.Equal(t, testDSK, entry.DSK)
+
+	response = apiRequest(app, http.MethodGet, "/api/provisioning", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	entries := make([]internal.ProvisioningEntry, 0)
+	err = json.Unmarshal(response.Body.Bytes(), &entries)
+	assert.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "kitchen", entries[0].Location)
+
+	// the list is saved in the cache folder
+	app2 := internal.NewOpenZwaveApp(config, pub)
+	err = app2.LoadProvisioningList()
+	assert.NoError(t, err)
+	response = apiRequest(app2, http.MethodGet, "/api/provisioning", "")
+	assert.Contains(t, response.Body.String(), testDSK)
+
+	response = apiRequest(app, http.MethodDelete, "/api/provisioning/"+testDSK, "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = apiRequest(app, http.MethodGet, "/api/provisioning", "")
+	assert.Equal(t, "[]\n", response.Body.String())
+}
+
+func TestIsAPIHostAllowed(t *testing.T) {
+	testCases := []struct {
+		listenAddress string
+		host          string
+		allowed       bool
+	}{
+		{"localhost:9292", "localhost:9292", true},
+		{"localhost:9292", "127.0.0.1:9292", true},
+		{"localhost:9292", "[::1]:9292", true},
+		{"127.0.0.1:9292", "LOCALHOST:9292", true},
+		{"localhost:9292", "localhost:80", false},
+		{"localhost:9292", "rebind.example.com:9292", false},
+		{"192.168.1.20:9292", "192.168.1.20:9292", true},
+		{"192.168.1.20:9292", "localhost:9292", false},
+		{":9292", "192.168.1.20:9292", true},
+		{":9292", "localhost:9292", true},
+		{"0.0.0.0:9292", "rebind.example.com:9292", false},
+		{"example.com:80", "example.com", true},
+		{"localhost:9292", "", false},
+		{"invalid", "localhost:9292", false},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.allowed, internal.IsAPIHostAllowed(testCase.listenAddress, testCase.host),
+			"listen %s, host %s", testCase.listenAddress, testCase.host)
+	}
+}
+
+func TestAPIRequestChecks(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	pub.CreateNode("12", types.NodeTypeSensor)
+	body := `{"name": "kitchen sensor"}`
+
+	// requests to another host name or from another origin are rejected
+	request := httptest.NewRequest(http.MethodGet, "/api/nodes", nil)
+	request.Host = "rebind.example.com:9292"
+	response := httptest.NewRecorder()
+	app.ServeAPI(response, request)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+
+	request = httptest.NewRequest(http.MethodGet, "/api/nodes", nil)
+	request.Host = internal.DefaultAPIAddress
+	request.Header.Set("Origin", "http://attacker.example.com")
+	response = httptest.NewRecorder()
+	app.ServeAPI(response, request)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+
+	// commands must be JSON requests
+	request = httptest.NewRequest(http.MethodPut, "/api/nodes/12/config", strings.NewReader(body))
+	request.Host = internal.DefaultAPIAddress
+	request.Header.Set("Content-Type", "text/plain")
+	response = httptest.NewRecorder()
+	app.ServeAPI(response, request)
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+	// the configured token is required
+	config.APIToken = "secret"
+	response = apiRequest(app, http.MethodGet, "/api/nodes", "")
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	request = httptest.NewRequest(http.MethodGet, "/api/nodes", nil)
+	request.Host = internal.DefaultAPIAddress
+	request.Header.Set(internal.APITokenHeader, "secret")
+	response = httptest.NewRecorder()
+	app.ServeAPI(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	config.APIToken = ""
+
+	// rejected configuration attributes are reported
+	response = apiRequest(app, http.MethodPut, "/api/nodes/12/config", body)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), "name: ")
+	response = apiRequest(app, http.MethodPut, "/api/nodes/12/config", `{"color": "blue"}`)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+}
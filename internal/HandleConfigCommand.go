@@ -1,7 +1,6 @@
 package internal
 
 import (
-	"fmt"
 	"strconv"
 
 	"github.com/iotdomain/iotdomain-go/lib"
@@ -13,76 +12,124 @@ import (
 // HandleConfigCommand handles configuration updates for openzwave nodes and
 // returns configuration attributes that can be applied immediately. ZWave node configuration
 // settings are not applied until the controller sends a notification with the configuration
-// changes.
+// changes. See ApplyNodeConfig.
 func (app *OpenZWaveApp) HandleConfigCommand(nodeAddress string, changes types.NodeAttrMap) {
-
-	var err error
-	var attr *types.ConfigAttr
-	var applyChanges = types.NodeAttrMap{}
-
-	// After the zwave node accepts the configuration the controller will send a notification which
-	// in turn will update the node configuration.
-	// through a value notification. The downside of this approach is that there is no confirmation of the
-	// update.
 	node := app.pub.GetNodeByAddress(nodeAddress)
 	if node == nil {
 		logrus.Warningf("HandleConfigCommand: Unknown node with address '%s'", nodeAddress)
 		return // nothing to apply
 	}
+	for attrName, err := range app.ApplyNodeConfig(node, changes) {
+		logrus.Errorf("HandleConfigCommand: Failed handling configuration update of %s for node %s: %v",
+			attrName, node.HWID, err)
+	}
+}
+
+// ApplyNodeConfig applies configuration updates to a node and returns the error of each rejected attribute
+// Configuration attributes that aren't zwave values are applied immediately.
+func (app *OpenZWaveApp) ApplyNodeConfig(node *types.NodeDiscoveryMessage, changes types.NodeAttrMap) map[types.NodeAttr]error {
+	var applyChanges = types.NodeAttrMap{}
+	var rejected = map[types.NodeAttr]error{}
+
 	for attrName, configValue := range changes {
-		// ZWave node config attribute IDs are set during discovery of the config value
-		// See handleZWaveConfigAttrDiscovery()
-		attrID := fmt.Sprintf("%s/%s", node.HWID, attrName)
-		zwValue := app.zwValueByAttrID[attrID]
-		if zwValue == nil {
-			// a non-zwave node configuration is applied immediately
+		applyNow, err := app.setNodeConfigAttr(node, attrName, configValue)
+		if err != nil {
+			rejected[attrName] = err
+		} else if applyNow {
 			applyChanges[attrName] = configValue
-			oldValue := node.Attr[attrName]
-			logrus.Infof("HandleConfigCommand: Node address '%s' (HWID=%s); Configuration %s: Old value=%s, new value=%s",
-				nodeAddress, node.HWID, attrName, oldValue, configValue)
-		} else {
-			// a zwave node configuration. Update the zwave node and wait for a change notification to update the notification
-			zwValueID := zwValue.ID
-
-			switch zwValue.Type {
-			case goopenzwave.ValueIDTypeBool:
-				valueBool, _ := strconv.ParseBool(configValue)
-				err = goopenzwave.SetValueBool(app.ozwHomeID, zwValueID, valueBool)
-			case goopenzwave.ValueIDTypeButton:
-				valueOnOff, _ := strconv.ParseBool(configValue)
-				err = goopenzwave.SetValueBool(app.ozwHomeID, zwValueID, valueOnOff)
-			case goopenzwave.ValueIDTypeString:
-				err = goopenzwave.SetValueString(app.ozwHomeID, zwValueID, configValue)
-			case goopenzwave.ValueIDTypeList:
-				err = goopenzwave.SetValueListSelection(app.ozwHomeID, zwValueID, configValue)
-			case goopenzwave.ValueIDTypeShort:
-				valueInt16, _ := strconv.ParseInt(configValue, 10, 16)
-				err = goopenzwave.SetValueInt16(app.ozwHomeID, zwValueID, int16(valueInt16))
-			case goopenzwave.ValueIDTypeInt:
-				valueInt, _ := strconv.ParseInt(configValue, 10, 32)
-				err = goopenzwave.SetValueInt32(app.ozwHomeID, zwValueID, int32(valueInt))
-			case goopenzwave.ValueIDTypeDecimal:
-				valueFloat, _ := strconv.ParseFloat(configValue, 32)
-				err = goopenzwave.SetValueFloat(app.ozwHomeID, zwValueID, float32(valueFloat))
-			case goopenzwave.ValueIDTypeByte:
-				valueByte, _ := strconv.ParseUint(configValue, 10, 8)
-				err = goopenzwave.SetValueUint8(app.ozwHomeID, zwValueID, uint8(valueByte))
-			default:
-				err = lib.MakeErrorf("HandleConfigCommand: Handling of datatype %v (%s) not supported", zwValue.Type, attr.DataType)
-			}
-			if err != nil {
-				logrus.Errorf("HandleConfigCommand: Failed handling configuration update for node %s: %v", node.HWID, err)
-			} else {
-				// for testing, include readback
-				//time.Sleep(time.Second*1)
-				//stuff := goopenzwave.GetValueAsString(adapter.ozwHomeID, zwValueId)
-				//logrus.Infof("Updating configuration for device %s.%s with value %v (readback = %v)", device.Alias, attr.Name, value, stuff)
-				logrus.Infof("HandleConfigCommand: Updating configuration for node %s, config %s with value %v (type=%s)", node.HWID, attrName, configValue, zwValue.Type)
-			}
 		}
 	}
 	// apply configurations that are not zwave device configs
 	if len(applyChanges) > 0 {
 		app.pub.UpdateNodeConfigValues(node.HWID, applyChanges)
 	}
+	return rejected
+}
+
+// setNodeConfigAttr updates a configuration attribute of a node
+// Returns true if the attribute can be applied immediately, or an error if the update is rejected.
+func (app *OpenZWaveApp) setNodeConfigAttr(node *types.NodeDiscoveryMessage, attrName types.NodeAttr,
+	configValue string) (applyNow bool, err error) {
+
+	// Name and location are stored in the zwave node and in the node itself if it supports node naming
+	if attrName == types.NodeAttrName || attrName == types.NodeAttrLocationName {
+		err = app.SetZWaveNodeNaming(node.HWID, attrName, configValue)
+		return err == nil, err
+	}
+	// Output poll configuration is handled by openzwave
+	if app.values.GetValueByPollAttrID(MakeAttrID(node.HWID, attrName)) != nil {
+		err = app.SetOutputPollIntensity(node.HWID, attrName, configValue)
+		return err == nil, err
+	}
+	// ZWave node config attribute IDs are set during discovery of the config value
+	// See handleZWaveConfigAttrDiscovery()
+	zwValue := app.values.GetValueByAttrID(MakeAttrID(node.HWID, attrName))
+	if zwValue == nil {
+		// a non-zwave node configuration is applied immediately
+		logrus.Infof("setNodeConfigAttr: Node address '%s' (HWID=%s); Configuration %s: Old value=%s, new value=%s",
+			node.Address, node.HWID, attrName, node.Attr[attrName], configValue)
+		return true, nil
+	}
+	// a zwave node configuration. Update the zwave node and wait for a change notification to update the configuration.
+	// The downside of this approach is that there is no confirmation of the update.
+	err = app.SetZWaveValue(zwValue, configValue)
+	if err == nil {
+		logrus.Infof("setNodeConfigAttr: Updating configuration for node %s, config %s with value %v (type=%s)",
+			node.HWID, attrName, configValue, zwValue.Type)
+	}
+	return false, err
+}
+
+// SetZWaveValue writes a new value to a zwave value. The value is converted from its string representation
+// to the zwave value type. The new value is not confirmed until openzwave sends a value change notification.
+func (app *OpenZWaveApp) SetZWaveValue(zwValue *goopenzwave.ValueID, newValue string) error {
+	var err error
+	homeID := zwValue.HomeID
+	zwValueID := zwValue.ID
+
+	switch zwValue.Type {
+	case goopenzwave.ValueIDTypeBool:
+		valueBool, _ := strconv.ParseBool(newValue)
+		err = goopenzwave.SetValueBool(homeID, zwValueID, valueBool)
+	case goopenzwave.ValueIDTypeButton:
+		valueOnOff, _ := strconv.ParseBool(newValue)
+		err = goopenzwave.SetValueBool(homeID, zwValueID, valueOnOff)
+	case goopenzwave.ValueIDTypeString:
+		err = goopenzwave.SetValueString(homeID, zwValueID, newValue)
+	case goopenzwave.ValueIDTypeList:
+		err = goopenzwave.SetValueListSelection(homeID, zwValueID, newValue)
+	case goopenzwave.ValueIDTypeShort:
+		valueInt16, _ := strconv.ParseInt(newValue, 10, 16)
+		err = goopenzwave.SetValueInt16(homeID, zwValueID, int16(valueInt16))
+	case goopenzwave.ValueIDTypeInt:
+		valueInt, _ := strconv.ParseInt(newValue, 10, 32)
+		err = goopenzwave.SetValueInt32(homeID, zwValueID, int32(valueInt))
+	case goopenzwave.ValueIDTypeDecimal:
+		valueFloat, _ := strconv.ParseFloat(newValue, 32)
+		err = goopenzwave.SetValueFloat(homeID, zwValueID, float32(valueFloat))
+	case goopenzwave.ValueIDTypeByte:
+		valueByte, _ := strconv.ParseUint(newValue, 10, 8)
+		err = goopenzwave.SetValueUint8(homeID, zwValueID, uint8(valueByte))
+	default:
+		err = lib.MakeErrorf("SetZWaveValue: Handling of datatype %v not supported", zwValue.Type)
+	}
+	return err
+}
+
+// SetZWaveNodeNaming sets the name or location of a zwave node
+// Openzwave stores the name and location with the node information and sends it to the device
+// if the device supports the Node Naming command class.
+// Returns an error if the network of the node isn't known yet, eg the controller isn't ready.
+func (app *OpenZWaveApp) SetZWaveNodeNaming(nodeHWID string, attrName types.NodeAttr, newValue string) error {
+	homeID, zwNodeID, err := app.GetNodeAddress(nodeHWID)
+	if err != nil || homeID == 0 {
+		return lib.MakeErrorf("SetZWaveNodeNaming: Node %s: network of the node is not known", nodeHWID)
+	}
+	logrus.Infof("SetZWaveNodeNaming: Node %s: %s=%s", nodeHWID, attrName, newValue)
+	if attrName == types.NodeAttrName {
+		goopenzwave.SetNodeName(homeID, zwNodeID, newValue)
+	} else if attrName == types.NodeAttrLocationName {
+		goopenzwave.SetNodeLocation(homeID, zwNodeID, newValue)
+	}
+	return nil
 }
@@ -0,0 +1,42 @@
+package internal_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/nodes"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleConfigCommand(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	node := pub.CreateNode("12", types.NodeTypeSensor)
+	pub.UpdateNodeConfig("12", "color", nodes.NewNodeConfig(types.DataTypeString, "Color of the node", ""))
+	pub.UpdateNodeConfig("12", types.NodeAttrName, nodes.NewNodeConfig(types.DataTypeString, "Name of the node", ""))
+	pub.UpdateNodeConfig("12", types.NodeAttrLocationName,
+		nodes.NewNodeConfig(types.DataTypeString, "Location of the node", ""))
+
+	// unknown nodes are ignored
+	app.HandleConfigCommand("test/openzwave/99", types.NodeAttrMap{"color": "blue"})
+	assert.Nil(t, pub.GetNodeByHWID("99"))
+
+	// a configuration that isn't a zwave value is applied immediately
+	app.HandleConfigCommand(node.Address, types.NodeAttrMap{"color": "blue"})
+	assert.Equal(t, "blue", pub.GetNodeAttr("12", "color"))
+
+	// the name and location are stored in the zwave node, which isn't possible until the controller is ready
+	err := app.SetZWaveNodeNaming("12", types.NodeAttrName, "kitchen sensor")
+	assert.Error(t, err)
+	app.HandleConfigCommand(node.Address, types.NodeAttrMap{
+		types.NodeAttrName:         "kitchen sensor",
+		types.NodeAttrLocationName: "kitchen",
+		"color":                    "green",
+	})
+	assert.Empty(t, pub.GetNodeAttr("12", types.NodeAttrName))
+	assert.Empty(t, pub.GetNodeAttr("12", types.NodeAttrLocationName))
+	assert.Equal(t, "green", pub.GetNodeAttr("12", "color"))
+}
@@ -4,6 +4,7 @@ package internal
 import (
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/jimjibone/goopenzwave"
@@ -12,20 +13,36 @@ import (
 
 // InputID's of buttons to manage ZWave nodes
 const (
-	ButtonInstanceAddNode          = "addnode"
-	ButtonInstanceRemoveNode       = "removenode"
-	ButtonInstanceRemoveFailedNode = "removefailednode"
-	ButtonInstanceHealNetwork      = "healnetwork"
-	ButtonInstanceRefreshNodeInfo  = "refreshnodeinfo"
-	ButtonInstanceRequestNodeValue = "requestnodevalue"
-	ButtonInstanceUpdateNeighbors  = "updateneighbors"
+	ButtonInstanceAddNode            = "addnode"
+	ButtonInstanceRemoveNode         = "removenode"
+	ButtonInstanceRemoveFailedNode   = "removefailednode"
+	ButtonInstanceHealNetwork        = "healnetwork"
+	ButtonInstanceRefreshNodeInfo    = "refreshnodeinfo"
+	ButtonInstanceRequestNodeValue   = "requestnodevalue"
+	ButtonInstanceUpdateNeighbors    = "updateneighbors"
+	ButtonInstanceHealNode           = "healnode"
+	ButtonInstanceReplaceNode        = "replacefailednode"
+	ButtonInstanceAssignReturnRoute  = "assignreturnroute"
+	ButtonInstanceLearnMode          = "learnmode"
+	ButtonInstanceReplicate          = "replicatecontroller"
+	ButtonInstanceCreatePrimary      = "createnewprimary"
+	ButtonInstanceTransferPrimary    = "transferprimaryrole"
+	ButtonInstanceSoftReset          = "softreset"
+	ButtonInstanceHardReset          = "hardreset"
+	ButtonInstanceBackupNetwork      = "backupnetwork"
+	ButtonInstanceRestoreNetwork     = "restorenetwork"
+	ButtonInstanceIncludeProvisioned = "includeprovisioned"
+	ButtonInstanceAddProvisioning    = "addprovisioning"
+	ButtonInstanceRemoveProvisioning = "removeprovisioning"
+	ButtonInstanceExportNodeConfig   = "exportnodeconfig"
+	ButtonInstanceImportNodeConfig   = "importnodeconfig"
 )
 
 // HandleInputCommand for openzwave node
-// Currently very basic. Only switch status is supported.
+// Currently very basic. Only switch status is supported. Pushbuttons are handled by HandleButtonCommand.
 func (app *OpenZWaveApp) HandleInputCommand(input *types.InputDiscoveryMessage, sender string, payloadStr string) {
-	valueID := app.valueIDByInputID[input.InputID]
-	if valueID == 0 {
+	zwValue := app.values.GetValueByInputID(input.InputID)
+	if zwValue == nil {
 		// This is not a known openzwave sensor, check for button commands
 		if input == nil {
 			logrus.Warn("HandleInputCommand: Command for input but input is not yet discovered in Zwave")
@@ -34,32 +51,13 @@ func (app *OpenZWaveApp) HandleInputCommand(input *types.InputDiscoveryMessage,
 		if input.InputType != types.InputTypePushButton {
 			return
 		}
-		// Virtual push buttons for the controller
-		startStop, _ := strconv.ParseBool(payloadStr)
-		nodeID, _ := strconv.ParseInt(payloadStr, 10, 8)
-		logrus.Infof("HandleInputCommand: PushButton '%s'. Value=%v", input.Instance, payloadStr)
-		if input.Instance == ButtonInstanceHealNetwork {
-			app.StartHealNetwork()
-		} else if input.Instance == ButtonInstanceAddNode {
-			app.AddZWaveNode(startStop)
-		} else if input.Instance == ButtonInstanceRemoveNode {
-			app.RemoveZWaveNode(startStop)
-		} else if input.Instance == ButtonInstanceRemoveFailedNode {
-			goopenzwave.RemoveFailedNode(app.ozwHomeID, uint8(nodeID))
-		} else if input.Instance == ButtonInstanceRefreshNodeInfo {
-			goopenzwave.RefreshNodeInfo(app.ozwHomeID, uint8(nodeID))
-		} else if input.Instance == ButtonInstanceRequestNodeValue {
-			goopenzwave.RequestNodeAllConfigParam(app.ozwHomeID, uint8(nodeID))
-		} else if input.Instance == ButtonInstanceUpdateNeighbors {
-			goopenzwave.RequestNodeNeighborUpdate(app.ozwHomeID, uint8(nodeID))
-		} else {
-			// unknown button ignored
-			logrus.Warningf("HandleInputCommand: PushButton '%s' is not a known command. Ignored.",
-				input.Instance)
-		}
+		// Management push buttons of the controller and of nodes
+		app.HandleButtonCommand(input, payloadStr)
 		return
 	}
 	var err error
+	app.commStats.RecordSent(input.NodeHWID)
+	app.metrics.CommandSent(zwValue.HomeID, zwValue.ID, time.Now())
 
 	// for now only support on/off
 	dataType := types.DataType(input.DataType)
@@ -69,12 +67,12 @@ func (app *OpenZWaveApp) HandleInputCommand(input *types.InputDiscoveryMessage,
 		app.SwitchOnOff(input.NodeHWID, input, payloadStr)
 	case types.DataTypeString:
 		//device.UpdateSensorCommand(sensor, payloadStr)
-		err = goopenzwave.SetValueString(app.ozwHomeID, valueID, payloadStr)
+		err = goopenzwave.SetValueString(zwValue.HomeID, zwValue.ID, payloadStr)
 	case types.DataTypeNumber:
 		//device.UpdateSensorCommand(sensor, payloadStr)
 		//err = goopenzwave.SetValueString(adapter.ozwHomeID, valueId, payloadStr) // let the library handle conversion
 		valueInt, _ := strconv.ParseInt(payloadStr, 10, 32)
-		err = goopenzwave.SetValueInt32(app.ozwHomeID, valueID, int32(valueInt))
+		err = goopenzwave.SetValueInt32(zwValue.HomeID, zwValue.ID, int32(valueInt))
 	default:
 		logrus.Warningf("HandleInputCommand: Device %s: Unexpected data type %s for property %s",
 			input.NodeHWID, dataType, input.InputType)
@@ -86,68 +84,100 @@ func (app *OpenZWaveApp) HandleInputCommand(input *types.InputDiscoveryMessage,
 }
 
 // AddZWaveNode Starts the inclusion process to add a node with secure mode enabled.
-// Do not start this until all nodes have been discovered, eg 'ready' state
+// This is rejected until the controller is ready, see CheckControllerReady. Cancelling is always accepted.
 // Unfortunately there is no way to determine if this is ongoing or completed/cancelled
-func (app *OpenZWaveApp) AddZWaveNode(startStop bool) {
-	logrus.Infof("AddZWaveNode")
+func (app *OpenZWaveApp) AddZWaveNode(homeID uint32, startStop bool) error {
+	logrus.Infof("AddZWaveNode: network %x", homeID)
 	if startStop == true {
-		goopenzwave.AddNode(app.ozwHomeID, true)
+		err := app.CheckControllerReady(homeID)
+		if err != nil {
+			return err
+		}
+		app.startControllerCommand(homeID, ButtonInstanceAddNode)
+		goopenzwave.AddNode(homeID, true)
 	} else {
-		goopenzwave.CancelControllerCommand(app.ozwHomeID)
+		goopenzwave.CancelControllerCommand(homeID)
 	}
+	return nil
 }
 
 // RemoveZWaveNode Starts the exclusion process to remove a node
-// Do not start this until all nodes have been discovered, eg 'ready' state
+// This is rejected until the controller is ready, see CheckControllerReady. Cancelling is always accepted.
 // Unfortunately there is no way to determine if this is ongoing or completed/cancelled
-func (app *OpenZWaveApp) RemoveZWaveNode(startStop bool) {
-	logrus.Infof("RemoveZWaveNode")
+func (app *OpenZWaveApp) RemoveZWaveNode(homeID uint32, startStop bool) error {
+	logrus.Infof("RemoveZWaveNode: network %x", homeID)
 	if startStop == true {
-		goopenzwave.RemoveNode(app.ozwHomeID)
+		err := app.CheckControllerReady(homeID)
+		if err != nil {
+			return err
+		}
+		app.removals.StartExclusion(homeID)
+		app.startControllerCommand(homeID, ButtonInstanceRemoveNode)
+		goopenzwave.RemoveNode(homeID)
 	} else {
-		goopenzwave.CancelControllerCommand(app.ozwHomeID)
+		app.removals.EndExclusion(homeID)
+		goopenzwave.CancelControllerCommand(homeID)
 	}
+	return nil
 }
 
 // GetNeighbors Not supported by goopenzwave
 func (app *OpenZWaveApp) GetNeighbors(nodeHWID string) {
 	logrus.Warningf("GetNeighbors: Not supported by goopenzwave")
-	// nodeID, _ := strconv.Atoi(nodeHWID)
-	// goopenzwave.GetNodeNeighbors(app.ozwHomeID, uint8(nodeID))
+	// homeID, nodeID, _ := app.GetNodeAddress(nodeHWID)
+	// goopenzwave.GetNodeNeighbors(homeID, nodeID)
 }
 
 // RefreshNodeInfo Refresh the node info
 func (app *OpenZWaveApp) RefreshNodeInfo(nodeHWID string) {
-	zwNodeID, _ := strconv.Atoi(nodeHWID)
-	goopenzwave.RefreshNodeInfo(app.ozwHomeID, uint8(zwNodeID))
+	homeID, zwNodeID, _ := app.GetNodeAddress(nodeHWID)
+	goopenzwave.RefreshNodeInfo(homeID, zwNodeID)
 }
 
-// RemoveFailedNode This requires the node to be in a failed state.
-func (app *OpenZWaveApp) RemoveFailedNode(nodeHWID string) {
+// RemoveFailedNode This requires the node to be in a failed state and the controller to be ready.
+func (app *OpenZWaveApp) RemoveFailedNode(nodeHWID string) error {
 	logrus.Infof("RemovefailedNode: Node %s", nodeHWID)
-	zwNodeID, _ := strconv.Atoi(nodeHWID)
-	goopenzwave.RemoveFailedNode(app.ozwHomeID, uint8(zwNodeID))
+	homeID, zwNodeID, err := app.GetNodeAddress(nodeHWID)
+	if err == nil {
+		err = app.CheckControllerReady(homeID)
+	}
+	if err != nil {
+		return err
+	}
+	app.removals.AddNodeRemoval(nodeHWID)
+	app.startControllerCommand(homeID, ButtonInstanceRemoveFailedNode)
+	goopenzwave.RemoveFailedNode(homeID, zwNodeID)
+	return nil
 }
 
 // StartHealNetwork starts the heal network process
-func (app *OpenZWaveApp) StartHealNetwork() {
-	logrus.Infof("StartHealNetwork")
-	goopenzwave.HealNetwork(app.ozwHomeID, true)
+// This is rejected until the controller is ready, see CheckControllerReady.
+func (app *OpenZWaveApp) StartHealNetwork(homeID uint32) error {
+	logrus.Infof("StartHealNetwork: network %x", homeID)
+	err := app.CheckControllerReady(homeID)
+	if err != nil {
+		return err
+	}
+	app.startControllerCommand(homeID, ButtonInstanceHealNetwork)
+	goopenzwave.HealNetwork(homeID, true)
+	return nil
 }
 
 // StartHealNode tells a node to rediscover its neighbors including return routes
 // Unfortunately there is no way to determine if this is ongoing or completed
 func (app *OpenZWaveApp) StartHealNode(nodeHWID string) {
 	logrus.Infof("StartHealNode")
-	zwNodeID, _ := strconv.Atoi(nodeHWID)
-	goopenzwave.HealNetworkNode(app.ozwHomeID, uint8(zwNodeID), true)
+	homeID, zwNodeID, _ := app.GetNodeAddress(nodeHWID)
+	app.startControllerCommand(homeID, ButtonInstanceHealNode)
+	goopenzwave.HealNetworkNode(homeID, zwNodeID, true)
 }
 
 // UpdateNeighbors to request a device to update its neighbors. Useful after device has moved.
 func (app *OpenZWaveApp) UpdateNeighbors(nodeHWID string) {
 	logrus.Infof("UpdateNeighbors: Node %s", nodeHWID)
-	zwNodeID, _ := strconv.Atoi(nodeHWID)
-	goopenzwave.RequestNodeNeighborUpdate(app.ozwHomeID, uint8(zwNodeID))
+	homeID, zwNodeID, _ := app.GetNodeAddress(nodeHWID)
+	app.startControllerCommand(homeID, ButtonInstanceUpdateNeighbors)
+	goopenzwave.RequestNodeNeighborUpdate(homeID, zwNodeID)
 }
 
 // SwitchOnOff enable/disable actuators
@@ -157,12 +187,16 @@ func (app *OpenZWaveApp) SwitchOnOff(nodeHWID string, input *types.InputDiscover
 
 	// any non-zero, false or off value is considered on
 	onoff := !(newValue == "0" || strings.ToLower(newValue) == "off" || strings.ToLower(newValue) == "false")
-	valueID := app.valueIDByInputID[input.InputID]
-	currentValue := goopenzwave.GetValueAsString(app.ozwHomeID, valueID)
+	zwValue := app.values.GetValueByInputID(input.InputID)
+	if zwValue == nil {
+		logrus.Warnf("SwitchOnOff: Node %s: Input %s has no zwave value", nodeHWID, input.InputID)
+		return
+	}
+	currentValue := goopenzwave.GetValueAsString(zwValue.HomeID, zwValue.ID)
 	logrus.Infof("SwitchOnOff. Device %s: Property %s: current value=%s. new value=%s, changing to: %t",
 		nodeHWID, input.InputType, currentValue, newValue, onoff)
 
-	err = goopenzwave.SetValueBool(app.ozwHomeID, valueID, onoff)
+	err = goopenzwave.SetValueBool(zwValue.HomeID, zwValue.ID, onoff)
 	if err != nil {
 		logrus.Warnf("SwitchOnOff: Node %s: Property %s. Error: %v", nodeHWID, input.InputType, err)
 	}
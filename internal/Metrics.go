@@ -0,0 +1,234 @@
+// Package internal with the Prometheus metrics of the publisher
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// CommandLatencyTimeout is the max time in seconds between a command and the value update that confirms it
+const CommandLatencyTimeout = 60
+
+// commandLatencyBuckets are the upper bounds in seconds of the command latency histogram buckets
+var commandLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics counts the notifications and measures the latency of commands for the metrics endpoint
+// The latency of a command is the time from setting a value until openzwave reports the value as updated.
+type Metrics struct {
+	notificationsByType map[string]uint64
+	pendingCommands     map[valueKey]time.Time // time a value was set
+	latencyBucketCounts []uint64               // nr of commands per latency bucket, not cumulative
+	latencySum          float64
+	latencyCount        uint64
+	updateMutex         sync.Mutex
+}
+
+// CountNotification counts a notification of the given type
+func (metrics *Metrics) CountNotification(notificationType string) {
+	metrics.updateMutex.Lock()
+	defer metrics.updateMutex.Unlock()
+	metrics.notificationsByType[notificationType]++
+}
+
+// CommandSent records the time a command to set a zwave value is sent
+func (metrics *Metrics) CommandSent(homeID uint32, valueID uint64, now time.Time) {
+	metrics.updateMutex.Lock()
+	defer metrics.updateMutex.Unlock()
+	metrics.pendingCommands[valueKey{homeID: homeID, valueID: valueID}] = now
+}
+
+// ValueUpdated completes the command that set the zwave value, if any, and adds its latency
+func (metrics *Metrics) ValueUpdated(homeID uint32, valueID uint64, now time.Time) {
+	metrics.updateMutex.Lock()
+	defer metrics.updateMutex.Unlock()
+	key := valueKey{homeID: homeID, valueID: valueID}
+	sentTime, found := metrics.pendingCommands[key]
+	if !found {
+		return
+	}
+	delete(metrics.pendingCommands, key)
+	latency := now.Sub(sentTime).Seconds()
+	if latency > CommandLatencyTimeout {
+		// not a response to the command
+		return
+	}
+	bucketIndex := sort.SearchFloat64s(commandLatencyBuckets, latency)
+	metrics.latencyBucketCounts[bucketIndex]++
+	metrics.latencySum += latency
+	metrics.latencyCount++
+}
+
+// WriteMetrics writes the notification counts and command latency histogram in the Prometheus text format
+func (metrics *Metrics) WriteMetrics(w io.Writer) {
+	metrics.updateMutex.Lock()
+	defer metrics.updateMutex.Unlock()
+
+	writeMetricHeader(w, "ozw_notifications_total", "counter", "Openzwave notifications handled by type")
+	notificationTypes := make([]string, 0, len(metrics.notificationsByType))
+	for notificationType := range metrics.notificationsByType {
+		notificationTypes = append(notificationTypes, notificationType)
+	}
+	sort.Strings(notificationTypes)
+	for _, notificationType := range notificationTypes {
+		writeMetric(w, "ozw_notifications_total", metrics.notificationsByType[notificationType],
+			"type", notificationType)
+	}
+
+	writeMetricHeader(w, "ozw_command_latency_seconds", "histogram",
+		"Time from setting a value until openzwave reports the value updated")
+	cumulativeCount := uint64(0)
+	for index, upperBound := range commandLatencyBuckets {
+		cumulativeCount += metrics.latencyBucketCounts[index]
+		writeMetric(w, "ozw_command_latency_seconds_bucket", cumulativeCount,
+			"le", strconv.FormatFloat(upperBound, 'g', -1, 64))
+	}
+	writeMetric(w, "ozw_command_latency_seconds_bucket", metrics.latencyCount, "le", "+Inf")
+	writeMetric(w, "ozw_command_latency_seconds_sum", metrics.latencySum)
+	writeMetric(w, "ozw_command_latency_seconds_count", metrics.latencyCount)
+}
+
+// NewMetrics creates the notification and command metrics
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		notificationsByType: make(map[string]uint64),
+		pendingCommands:     make(map[valueKey]time.Time),
+		latencyBucketCounts: make([]uint64, len(commandLatencyBuckets)+1),
+	}
+	return metrics
+}
+
+// writeMetricHeader writes the help and type lines of a metric
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeMetric writes a sample of a metric with label name-value pairs
+func writeMetric(w io.Writer, name string, value interface{}, labels ...string) {
+	labelText := ""
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for index := 0; index+1 < len(labels); index += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[index], escapeLabelValue(labels[index+1])))
+		}
+		labelText = "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s%s %v\n", name, labelText, value)
+}
+
+// escapeLabelValue escapes backslash, double quote and newline in a label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// ServeMetrics is the HTTP handler of the metrics endpoint
+// This writes the notification and command metrics, the notification queue, the send queue and failed nodes of
+// the ready controllers, the nr of nodes by run state, and the battery level and ping round-trip time of nodes.
+func (app *OpenZWaveApp) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	app.metrics.WriteMetrics(w)
+
+	notificationStats := app.ozwAPI.GetNotificationStats()
+	writeMetricHeader(w, "ozw_notifications_dropped_total", "counter", "Openzwave notifications dropped because the queue was full")
+	writeMetric(w, "ozw_notifications_dropped_total", notificationStats.Dropped)
+	writeMetricHeader(w, "ozw_notification_queue_length", "gauge", "Openzwave notifications waiting to be handled")
+	writeMetric(w, "ozw_notification_queue_length", notificationStats.QueueLength+notificationStats.Backlog)
+
+	writeMetricHeader(w, "ozw_send_queue_length", "gauge", "Messages waiting to be sent by the controller")
+	failedByHomeID := make(map[uint32]int)
+	for _, controller := range app.ozwAPI.controllers {
+		state := app.ozwAPI.GetControllerState(controller)
+		if state.HomeID == 0 || app.CheckControllerReady(state.HomeID) != nil {
+			continue
+		}
+		failedByHomeID[state.HomeID] = 0
+		writeMetric(w, "ozw_send_queue_length", app.ozwAPI.GetSendQueueCount(state.HomeID),
+			"home_id", fmt.Sprintf("%08x", state.HomeID))
+	}
+
+	countByRunState := make(map[string]int)
+	for _, node := range app.pub.GetNodes() {
+		if node.HWID == types.NodeIDGateway {
+			continue
+		}
+		runState := node.Status[types.NodeStatusRunState]
+		if runState == "" {
+			runState = "unknown"
+		}
+		countByRunState[runState]++
+		homeID, zwNodeID, err := app.GetNodeAddress(node.HWID)
+		if _, isReady := failedByHomeID[homeID]; err == nil && isReady && goopenzwave.IsNodeFailed(homeID, zwNodeID) {
+			failedByHomeID[homeID]++
+		}
+	}
+	writeMetricHeader(w, "ozw_nodes", "gauge", "Zwave nodes by run state")
+	runStates := make([]string, 0, len(countByRunState))
+	for runState := range countByRunState {
+		runStates = append(runStates, runState)
+	}
+	sort.Strings(runStates)
+	for _, runState := range runStates {
+		writeMetric(w, "ozw_nodes", countByRunState[runState], "state", runState)
+	}
+	writeMetricHeader(w, "ozw_failed_nodes", "gauge", "Zwave nodes the controller has marked as failed")
+	for homeID, failedCount := range failedByHomeID {
+		writeMetric(w, "ozw_failed_nodes", failedCount, "home_id", fmt.Sprintf("%08x", homeID))
+	}
+
+	writeMetricHeader(w, "ozw_node_battery_level", "gauge", "Battery level of zwave nodes in percent")
+	for _, output := range app.pub.GetOutputs() {
+		if output.OutputType != types.OutputTypeBattery {
+			continue
+		}
+		outputValue := app.pub.GetOutputValueByID(output.OutputID)
+		if outputValue == nil {
+			continue
+		}
+		level, err := strconv.ParseFloat(outputValue.Value, 64)
+		if err == nil {
+			writeMetric(w, "ozw_node_battery_level", level, "node", output.NodeHWID)
+		}
+	}
+	writeMetricHeader(w, "ozw_node_rtt_seconds", "gauge", "Average ping round-trip time of zwave nodes")
+	for _, nodeHWID := range app.commStats.GetNodeHWIDs() {
+		nodeStats, _ := app.commStats.GetNodeStats(nodeHWID)
+		if nodeStats.AverageRTT > 0 {
+			writeMetric(w, "ozw_node_rtt_seconds", nodeStats.AverageRTT.Seconds(), "node", nodeHWID)
+		}
+	}
+}
+
+// StartMetricsServer starts the HTTP listener of the metrics endpoint at /metrics
+func (app *OpenZWaveApp) StartMetricsServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", app.ServeMetrics)
+	app.metricsServer = &http.Server{Addr: address, Handler: mux}
+	logrus.Warningf("OpenZWaveApp.StartMetricsServer: Serving metrics on %s/metrics", address)
+	go func(server *http.Server) {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("OpenZWaveApp.StartMetricsServer: %v", err)
+		}
+	}(app.metricsServer)
+}
+
+// StopMetricsServer stops the HTTP listener of the metrics endpoint
+func (app *OpenZWaveApp) StopMetricsServer() {
+	if app.metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	app.metricsServer.Shutdown(ctx)
+	app.metricsServer = nil
+}
@@ -0,0 +1,52 @@
+package internal_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsNotifications(t *testing.T) {
+	metrics := internal.NewMetrics()
+	metrics.CountNotification("ValueChanged")
+	metrics.CountNotification("ValueChanged")
+	metrics.CountNotification("Node \"Event\"")
+
+	buffer := bytes.Buffer{}
+	metrics.WriteMetrics(&buffer)
+	text := buffer.String()
+	assert.Contains(t, text, "# TYPE ozw_notifications_total counter\n")
+	assert.Contains(t, text, "ozw_notifications_total{type=\"ValueChanged\"} 2\n")
+	// label values are escaped
+	assert.Contains(t, text, "ozw_notifications_total{type=\"Node \\\"Event\\\"\"} 1\n")
+}
+
+func TestMetricsCommandLatency(t *testing.T) {
+	metrics := internal.NewMetrics()
+	start := time.Now()
+	metrics.CommandSent(testHomeID, 1, start)
+	metrics.ValueUpdated(testHomeID, 1, start.Add(200*time.Millisecond))
+	metrics.CommandSent(testHomeID, 2, start)
+	metrics.ValueUpdated(testHomeID, 2, start.Add(3*time.Second))
+	// updates without command and late updates are ignored
+	metrics.ValueUpdated(testHomeID, 3, start.Add(time.Second))
+	metrics.CommandSent(testHomeID, 4, start)
+	metrics.ValueUpdated(testHomeID, 4, start.Add(2*time.Minute))
+	// a command is completed once
+	metrics.ValueUpdated(testHomeID, 1, start.Add(time.Second))
+
+	buffer := bytes.Buffer{}
+	metrics.WriteMetrics(&buffer)
+	text := buffer.String()
+	assert.Contains(t, text, "# TYPE ozw_command_latency_seconds histogram\n")
+	assert.Contains(t, text, "ozw_command_latency_seconds_bucket{le=\"0.1\"} 0\n")
+	assert.Contains(t, text, "ozw_command_latency_seconds_bucket{le=\"0.25\"} 1\n")
+	assert.Contains(t, text, "ozw_command_latency_seconds_bucket{le=\"2.5\"} 1\n")
+	assert.Contains(t, text, "ozw_command_latency_seconds_bucket{le=\"5\"} 2\n")
+	assert.Contains(t, text, "ozw_command_latency_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(t, text, "ozw_command_latency_seconds_sum 3.2\n")
+	assert.Contains(t, text, "ozw_command_latency_seconds_count 2\n")
+}
@@ -0,0 +1,327 @@
+// Package internal with backup and restore of the zwave network of a controller
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// BackupFormatVersion is the version of the network backup archive format
+const BackupFormatVersion = 1
+
+// BackupManifestName is the name of the manifest in a network backup archive
+const BackupManifestName = "manifest.json"
+
+// BackupManifest describes the content of a network backup archive
+// Openzwave can't read or write the memory (NVM) of the controller, so the backup holds the openzwave
+// network cache with the node IDs instead.
+type BackupManifest struct {
+	Version          int          `json:"version"`              // archive format version, see BackupFormatVersion
+	HomeID           string       `json:"homeID"`               // home ID of the network in hex
+	ControllerNodeID uint8        `json:"controllerNodeID"`     // node ID of the controller
+	NodeIDs          []uint8      `json:"nodeIDs"`              // node IDs of the nodes in the network
+	OzwVersion       string       `json:"ozwVersion"`           // version of the openzwave library
+	Timestamp        string       `json:"timestamp"`            // time of the backup
+	NetworkKey       string       `json:"networkKey,omitempty"` // network key, only with the backupNetworkKey option
+	Files            []BackupFile `json:"files"`                // files in the archive
+}
+
+// BackupFile is a file in a network backup archive with its checksum
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupReport is published after a network backup or restore
+type BackupReport struct {
+	File      string `json:"file"`            // archive in the cache folder
+	HomeID    string `json:"homeID"`          // home ID of the network in hex
+	NodeCount int    `json:"nodeCount"`       // nr of nodes in the backup
+	Error     string `json:"error,omitempty"` // error that prevented the backup or restore
+}
+
+// SelectRestoreFiles returns the network cache and the node configuration exports of a backup to restore
+// to the network of a controller. Openzwave can't write the memory of a controller, so only a backup of the
+// same network and controller node ID can be restored. Only the configuration exports of the nodes listed in
+// the manifest are restored, other files in the archive are ignored. Use withHomeID for the node HWIDs of
+// multiple controllers, see MakeNodeHWID.
+func SelectRestoreFiles(manifest *BackupManifest, files map[string][]byte, homeID uint32,
+	controllerNodeID uint8, withHomeID bool) (cacheXML []byte, exports map[string][]byte, err error) {
+
+	backupHomeID, err := strconv.ParseUint(manifest.HomeID, 16, 32)
+	if err != nil {
+		return nil, nil, lib.MakeErrorf("SelectRestoreFiles: Invalid home ID '%s' in the backup", manifest.HomeID)
+	}
+	if uint32(backupHomeID) != homeID || manifest.ControllerNodeID != controllerNodeID {
+		return nil, nil, lib.MakeErrorf("SelectRestoreFiles: The backup of network %s with controller node %d "+
+			"can't be restored to network %08x with controller node %d. Openzwave can't write the memory of the controller",
+			manifest.HomeID, manifest.ControllerNodeID, homeID, controllerNodeID)
+	}
+	cacheName := GetNetworkCacheName(homeID)
+	cacheXML, found := files[cacheName]
+	if !found {
+		return nil, nil, lib.MakeErrorf("SelectRestoreFiles: The backup has no network cache %s", cacheName)
+	}
+	exports = make(map[string][]byte)
+	for _, zwNodeID := range manifest.NodeIDs {
+		exportName := getNodeConfigExportName(MakeNodeHWID(homeID, zwNodeID, withHomeID))
+		if content, found := files[exportName]; found {
+			exports[exportName] = content
+		}
+	}
+	if len(files) > len(exports)+1 {
+		logrus.Warningf("SelectRestoreFiles: Ignoring %d files of the backup that aren't node configuration exports",
+			len(files)-len(exports)-1)
+	}
+	return cacheXML, exports, nil
+}
+
+// WriteBackupArchive writes the files with the manifest to a backup archive
+// The manifest lists the checksum of each file.
+func WriteBackupArchive(filename string, manifest *BackupManifest, files map[string][]byte) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifest.Files = make([]BackupFile, 0, len(names))
+	for _, name := range names {
+		checksum := sha256.Sum256(files[name])
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name: name, Size: len(files[name]), SHA256: hex.EncodeToString(checksum[:]),
+		})
+	}
+	manifestJSON, _ := json.MarshalIndent(manifest, "", "  ")
+
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	err := writeZipFile(zipWriter, BackupManifestName, manifestJSON)
+	for _, name := range names {
+		if err == nil {
+			err = writeZipFile(zipWriter, name, files[name])
+		}
+	}
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filename, archive.Bytes(), 0600)
+	}
+	if err != nil {
+		return lib.MakeErrorf("WriteBackupArchive: Unable to write %s: %v", filename, err)
+	}
+	return nil
+}
+
+// writeZipFile adds a file to a zip archive
+func writeZipFile(zipWriter *zip.Writer, name string, content []byte) error {
+	fileWriter, err := zipWriter.Create(name)
+	if err == nil {
+		_, err = fileWriter.Write(content)
+	}
+	return err
+}
+
+// ReadBackupArchive reads a backup archive and verifies its integrity
+// This returns an error if the format version is not supported, or if a file is missing, unlisted or
+// doesn't match its checksum.
+func ReadBackupArchive(filename string) (*BackupManifest, map[string][]byte, error) {
+	zipReader, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, nil, lib.MakeErrorf("ReadBackupArchive: Unable to open %s: %v", filename, err)
+	}
+	defer zipReader.Close()
+	files := make(map[string][]byte)
+	for _, zipFile := range zipReader.File {
+		reader, err := zipFile.Open()
+		if err != nil {
+			return nil, nil, lib.MakeErrorf("ReadBackupArchive: Unable to read %s: %v", zipFile.Name, err)
+		}
+		files[zipFile.Name], err = ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, nil, lib.MakeErrorf("ReadBackupArchive: Unable to read %s: %v", zipFile.Name, err)
+		}
+	}
+	manifest := &BackupManifest{}
+	manifestJSON, found := files[BackupManifestName]
+	if !found {
+		return nil, nil, lib.MakeErrorf("ReadBackupArchive: %s has no manifest", filename)
+	}
+	delete(files, BackupManifestName)
+	err = json.Unmarshal(manifestJSON, manifest)
+	if err != nil {
+		return nil, nil, lib.MakeErrorf("ReadBackupArchive: Invalid manifest: %v", err)
+	}
+	if manifest.Version != BackupFormatVersion {
+		return nil, nil, lib.MakeErrorf("ReadBackupArchive: Unsupported backup version %d", manifest.Version)
+	}
+	if len(manifest.Files) != len(files) {
+		return nil, nil, lib.MakeErrorf("ReadBackupArchive: The manifest lists %d files, the archive has %d",
+			len(manifest.Files), len(files))
+	}
+	for _, backupFile := range manifest.Files {
+		content, found := files[backupFile.Name]
+		checksum := sha256.Sum256(content)
+		if !found || len(content) != backupFile.Size || hex.EncodeToString(checksum[:]) != backupFile.SHA256 {
+			return nil, nil, lib.MakeErrorf("ReadBackupArchive: File %s is missing or corrupt", backupFile.Name)
+		}
+	}
+	return manifest, files, nil
+}
+
+// BackupNetwork saves the openzwave network cache of a network with its node IDs and node configuration
+// in a backup archive in the cache folder. Returns the name of the archive.
+func (app *OpenZWaveApp) BackupNetwork(homeID uint32) (string, *BackupManifest, error) {
+	err := app.CheckControllerReady(homeID)
+	if err != nil {
+		return "", nil, err
+	}
+	controllerNodeID := app.ozwAPI.GetControllerState(app.ozwAPI.GetControllerByHomeID(homeID)).NodeID
+	// openzwave only writes its network cache when asked or when the driver is removed
+	cacheName := GetNetworkCacheName(homeID)
+	cacheXML, err := app.readNetworkCache(homeID)
+	if err != nil {
+		return "", nil, lib.MakeErrorf("BackupNetwork: Unable to read the openzwave network cache: %v", err)
+	}
+	files := map[string][]byte{cacheName: cacheXML}
+	manifest := &BackupManifest{
+		Version:          BackupFormatVersion,
+		HomeID:           fmt.Sprintf("%08x", homeID),
+		ControllerNodeID: controllerNodeID,
+		NodeIDs:          make([]uint8, 0),
+		OzwVersion:       goopenzwave.GetVersionAsString(),
+		Timestamp:        time.Now().Format(time.RFC3339),
+	}
+	if app.config.BackupNetworkKey {
+		// the archive is only readable by the owner, see WriteBackupArchive
+		manifest.NetworkKey = app.ozwAPI.networkKey
+	}
+	for _, node := range app.pub.GetNodes() {
+		if node.HWID == types.NodeIDGateway || !app.IsNodeOfController(node.HWID, homeID) {
+			continue
+		}
+		_, zwNodeID, err := app.GetNodeAddress(node.HWID)
+		if err != nil {
+			continue
+		}
+		manifest.NodeIDs = append(manifest.NodeIDs, zwNodeID)
+		if zwNodeID == controllerNodeID {
+			continue
+		}
+		// the configuration can be imported into a node of the same model, see ImportNodeConfig
+		doc, err := app.ExportNodeConfig(node.HWID)
+		if err == nil {
+			files[getNodeConfigExportName(node.HWID)], _ = json.MarshalIndent(doc, "", "  ")
+		}
+	}
+	sort.Slice(manifest.NodeIDs, func(i, j int) bool { return manifest.NodeIDs[i] < manifest.NodeIDs[j] })
+
+	filename := fmt.Sprintf("%s-network-%08x-%s.zip", AppID, homeID, time.Now().Format("20060102-150405"))
+	err = WriteBackupArchive(path.Join(app.GetCacheFolder(), filename), manifest, files)
+	if err != nil {
+		return "", nil, err
+	}
+	logrus.Warningf("BackupNetwork: Network %x with %d nodes saved in %s", homeID, len(manifest.NodeIDs), filename)
+	return filename, manifest, nil
+}
+
+// RestoreNetwork restores the openzwave network cache of a backup archive in the cache folder and restarts
+// the driver of the controller to load it. The node configuration exports are restored in the cache folder
+// for use with the import node config command.
+// Openzwave can't write the memory of a controller, so the backup of another network, eg of a replaced
+// controller, is rejected. See SelectRestoreFiles.
+func (app *OpenZWaveApp) RestoreNetwork(homeID uint32, filename string) (*BackupManifest, error) {
+	err := app.CheckControllerReady(homeID)
+	if err != nil {
+		return nil, err
+	}
+	controller := app.ozwAPI.GetControllerByHomeID(homeID)
+	state := app.ozwAPI.GetControllerState(controller)
+	// only files from the cache folder can be restored
+	manifest, files, err := ReadBackupArchive(path.Join(app.GetCacheFolder(), path.Base(filename)))
+	if err != nil {
+		return nil, err
+	}
+	cacheXML, exports, err := SelectRestoreFiles(manifest, files, homeID, state.NodeID, len(app.ozwAPI.controllers) > 1)
+	if err != nil {
+		return nil, err
+	}
+	// secure nodes can't be reached without the network key they were included with
+	if manifest.NetworkKey != "" && manifest.NetworkKey != app.ozwAPI.networkKey {
+		return nil, lib.MakeErrorf("RestoreNetwork: The network key of the backup differs from the configured networkKey")
+	}
+	for name, content := range exports {
+		err = ioutil.WriteFile(path.Join(app.GetCacheFolder(), name), content, 0644)
+		if err != nil {
+			return nil, lib.MakeErrorf("RestoreNetwork: Unable to restore %s: %v", name, err)
+		}
+	}
+	// openzwave writes the cache when the driver is removed, so restore it after removing the driver
+	app.ozwAPI.RemoveDriver(controller)
+	err = ioutil.WriteFile(path.Join(app.getOzwUserFolder(), GetNetworkCacheName(homeID)), cacheXML, 0644)
+	if err != nil {
+		err = lib.MakeErrorf("RestoreNetwork: Unable to restore the openzwave network cache: %v", err)
+	}
+	// the driver is added again, also if the cache can't be restored
+	addErr := app.ozwAPI.AddDriver(controller, state.Address)
+	if err == nil {
+		err = addErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	logrus.Warningf("RestoreNetwork: Network %x restored from %s", homeID, filename)
+	return manifest, nil
+}
+
+// HandleBackupNetworkCommand backs up the network of the controller and publishes the report on the
+// controller's node config output
+func (app *OpenZWaveApp) HandleBackupNetworkCommand(controllerHWID string, homeID uint32) error {
+	filename, manifest, err := app.BackupNetwork(homeID)
+	report := &BackupReport{File: filename, HomeID: fmt.Sprintf("%08x", homeID)}
+	if manifest != nil {
+		report.NodeCount = len(manifest.NodeIDs)
+	}
+	app.publishBackupReport(controllerHWID, NodeConfigInstanceBackup, report, err)
+	return err
+}
+
+// HandleRestoreNetworkCommand restores the network of the controller from the backup archive in the payload
+// and publishes the report on the controller's node config output
+func (app *OpenZWaveApp) HandleRestoreNetworkCommand(controllerHWID string, homeID uint32, filename string) error {
+	manifest, err := app.RestoreNetwork(homeID, filename)
+	report := &BackupReport{File: filename, HomeID: fmt.Sprintf("%08x", homeID)}
+	if manifest != nil {
+		report.NodeCount = len(manifest.NodeIDs)
+	}
+	app.publishBackupReport(controllerHWID, NodeConfigInstanceRestore, report, err)
+	return err
+}
+
+// publishBackupReport publishes a backup or restore report on the controller's node config output
+func (app *OpenZWaveApp) publishBackupReport(controllerHWID string, instance string, report *BackupReport, err error) {
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if app.pub.GetOutputByNodeHWID(controllerHWID, OutputTypeNodeConfig, instance) == nil {
+		app.pub.CreateOutput(controllerHWID, OutputTypeNodeConfig, instance)
+	}
+	reportJSON, _ := json.Marshal(report)
+	app.pub.UpdateOutputValue(controllerHWID, OutputTypeNodeConfig, instance, string(reportJSON))
+}
@@ -0,0 +1,130 @@
+package internal_test
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestZip writes a zip archive with the given files
+func writeTestZip(t *testing.T, filename string, files map[string][]byte) {
+	archive, err := os.Create(filename)
+	require.NoError(t, err)
+	defer archive.Close()
+	zipWriter := zip.NewWriter(archive)
+	for name, content := range files {
+		fileWriter, err := zipWriter.Create(name)
+		require.NoError(t, err)
+		_, err = fileWriter.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+}
+
+func TestBackupArchive(t *testing.T) {
+	folder, err := ioutil.TempDir("", "openzwave-backup")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+	filename := path.Join(folder, "backup.zip")
+	cacheName := internal.GetNetworkCacheName(testHomeID)
+	assert.Equal(t, "zwcfg_0xe1f2a3b4.xml", cacheName)
+	files := map[string][]byte{
+		cacheName:                      []byte("<Driver home_id=\"0xe1f2a3b4\" node_id=\"1\"/>"),
+		"openzwave-node-5-config.json": []byte("{}"),
+	}
+	manifest := &internal.BackupManifest{
+		Version:          internal.BackupFormatVersion,
+		HomeID:           "e1f2a3b4",
+		ControllerNodeID: 1,
+		NodeIDs:          []uint8{1, 5},
+	}
+	err = internal.WriteBackupArchive(filename, manifest, files)
+	require.NoError(t, err)
+	assert.Len(t, manifest.Files, 2)
+
+	restored, restoredFiles, err := internal.ReadBackupArchive(filename)
+	require.NoError(t, err)
+	assert.Equal(t, manifest, restored)
+	assert.Equal(t, files, restoredFiles)
+
+	// a file that doesn't match its checksum
+	manifestJSON, _ := json.Marshal(manifest)
+	corrupted := map[string][]byte{
+		internal.BackupManifestName:    manifestJSON,
+		cacheName:                      []byte("<Driver home_id=\"0xe1f2a3b5\" node_id=\"1\"/>"),
+		"openzwave-node-5-config.json": []byte("{}"),
+	}
+	writeTestZip(t, filename, corrupted)
+	_, _, err = internal.ReadBackupArchive(filename)
+	assert.Error(t, err)
+
+	// a file that isn't in the manifest
+	corrupted[cacheName] = files[cacheName]
+	corrupted["extra.xml"] = []byte("extra")
+	writeTestZip(t, filename, corrupted)
+	_, _, err = internal.ReadBackupArchive(filename)
+	assert.Error(t, err)
+
+	// a missing file
+	delete(corrupted, "extra.xml")
+	delete(corrupted, "openzwave-node-5-config.json")
+	corrupted["openzwave-node-6-config.json"] = []byte("{}")
+	writeTestZip(t, filename, corrupted)
+	_, _, err = internal.ReadBackupArchive(filename)
+	assert.Error(t, err)
+
+	// an unsupported version
+	manifest.Version = internal.BackupFormatVersion + 1
+	err = internal.WriteBackupArchive(filename, manifest, files)
+	require.NoError(t, err)
+	_, _, err = internal.ReadBackupArchive(filename)
+	assert.Error(t, err)
+
+	// not an archive
+	err = ioutil.WriteFile(filename, []byte("not a zip"), 0600)
+	require.NoError(t, err)
+	_, _, err = internal.ReadBackupArchive(filename)
+	assert.Error(t, err)
+}
+
+func TestSelectRestoreFiles(t *testing.T) {
+	cacheName := internal.GetNetworkCacheName(testHomeID)
+	files := map[string][]byte{
+		cacheName:                      []byte("<Driver home_id=\"0xe1f2a3b4\" node_id=\"1\"/>"),
+		"openzwave-node-5-config.json": []byte("{}"),
+		"openzwave-node-7-config.json": []byte("{}"),
+		"../options.xml":               []byte("<Options/>"),
+	}
+	manifest := &internal.BackupManifest{HomeID: "e1f2a3b4", ControllerNodeID: 1, NodeIDs: []uint8{1, 5}}
+
+	// only the exports of the nodes in the manifest are restored
+	cacheXML, exports, err := internal.SelectRestoreFiles(manifest, files, testHomeID, 1, false)
+	require.NoError(t, err)
+	assert.Equal(t, files[cacheName], cacheXML)
+	assert.Equal(t, map[string][]byte{"openzwave-node-5-config.json": []byte("{}")}, exports)
+	_, exports, err = internal.SelectRestoreFiles(manifest, files, testHomeID, 1, true)
+	require.NoError(t, err)
+	assert.Empty(t, exports)
+
+	// a backup of another network or controller is rejected
+	_, _, err = internal.SelectRestoreFiles(manifest, files, 0xc0ffee01, 1, false)
+	assert.Error(t, err)
+	_, _, err = internal.SelectRestoreFiles(manifest, files, testHomeID, 2, false)
+	assert.Error(t, err)
+	manifest.HomeID = "bad"
+	_, _, err = internal.SelectRestoreFiles(manifest, files, testHomeID, 1, false)
+	assert.Error(t, err)
+
+	// a backup without network cache
+	manifest.HomeID = "e1f2a3b4"
+	delete(files, cacheName)
+	_, _, err = internal.SelectRestoreFiles(manifest, files, testHomeID, 1, false)
+	assert.Error(t, err)
+}
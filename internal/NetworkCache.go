@@ -0,0 +1,50 @@
+// Package internal with reading the openzwave network cache of a network
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/jimjibone/goopenzwave"
+)
+
+// NetworkCacheWriteTimeout is the max time in seconds to wait for openzwave to write its network cache
+const NetworkCacheWriteTimeout = 10
+
+// GetNetworkCacheName returns the name of the openzwave network cache file of a network
+func GetNetworkCacheName(homeID uint32) string {
+	return fmt.Sprintf("zwcfg_0x%08x.xml", homeID)
+}
+
+// readNetworkCache asks openzwave to write the network cache of a network and returns it once written
+// Openzwave writes the cache in its driver thread. The cache is read when its modification time has changed
+// and it no longer grows. Returns an error if it isn't written within NetworkCacheWriteTimeout seconds.
+func (app *OpenZWaveApp) readNetworkCache(homeID uint32) ([]byte, error) {
+	filename := path.Join(app.getOzwUserFolder(), GetNetworkCacheName(homeID))
+	var lastWrite time.Time
+	if info, err := os.Stat(filename); err == nil {
+		lastWrite = info.ModTime()
+	}
+	goopenzwave.WriteConfig(homeID)
+	deadline := time.Now().Add(NetworkCacheWriteTimeout * time.Second)
+	var prevInfo os.FileInfo
+	for {
+		info, err := os.Stat(filename)
+		if err == nil && info.ModTime().After(lastWrite) {
+			if prevInfo != nil && info.ModTime() == prevInfo.ModTime() && info.Size() == prevInfo.Size() {
+				break
+			}
+			prevInfo = info
+		}
+		if time.Now().After(deadline) {
+			return nil, lib.MakeErrorf("readNetworkCache: Openzwave didn't write %s within %d seconds",
+				filename, NetworkCacheWriteTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return ioutil.ReadFile(filename)
+}
@@ -0,0 +1,366 @@
+// Package internal with the management commands of the controller and of nodes
+package internal
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxZWaveNodeID is the highest valid zwave node ID
+const MaxZWaveNodeID = 232
+
+// OutputTypeCommandResult is the output type that publishes the result of each management command.
+// The output instance is the instance of the command input.
+const OutputTypeCommandResult types.OutputType = "commandresult"
+
+// Command result status
+const (
+	CommandStatusAccepted = "accepted" // the command is sent to the controller
+	CommandStatusRejected = "rejected" // the command is invalid or the controller isn't ready
+)
+
+// NodeCommandButtons are the management commands that are inputs of each node
+// The same commands on the controller node apply to the node in the payload, see ParseNodeCommandPayload.
+var NodeCommandButtons = map[string]string{
+	ButtonInstanceRemoveFailedNode:  "Remove the node from the network if it has failed",
+	ButtonInstanceRefreshNodeInfo:   "Refresh the node information. Use when node information is incomplete.",
+	ButtonInstanceRequestNodeValue:  "Refresh the node configuration values",
+	ButtonInstanceUpdateNeighbors:   "Request the node to update its neighbors. Use after network changes.",
+	ButtonInstanceHealNode:          "Heal the node by rediscovering its neighbors and return routes",
+	ButtonInstanceReplaceNode:       "Replace the failed node with a new device that keeps its node ID and configuration",
+	ButtonInstanceAssignReturnRoute: "Request the node to update its return route to the controller",
+}
+
+// NodeCommandPayload is the JSON payload of a management command on the controller node
+type NodeCommandPayload struct {
+	Node  string `json:"node,omitempty"`  // HWID or zwave node ID of the node the command applies to
+	Start *bool  `json:"start,omitempty"` // start or stop adding or removing nodes
+	Token string `json:"token,omitempty"` // confirmation token of a hard reset
+	File  string `json:"file,omitempty"`  // backup archive in the cache folder to restore
+	DSK   string `json:"dsk,omitempty"`   // DSK of a device in the provisioning list
+}
+
+// CommandResult is published for each management command on the command result output of its node
+type CommandResult struct {
+	Command   string `json:"command"`            // instance of the command input, eg removefailednode
+	NodeHWID  string `json:"nodeHWID,omitempty"` // node the command applies to
+	Status    string `json:"status"`             // accepted or rejected
+	Error     string `json:"error,omitempty"`    // reason the command is rejected
+	Token     string `json:"token,omitempty"`    // token to confirm a hard reset with
+	Timestamp string `json:"timestamp"`
+}
+
+// ParseStartStopPayload returns whether to start or stop adding or removing nodes
+// The payload is a NodeCommandPayload with the start field or a boolean, eg true, 1 or false.
+func ParseStartStopPayload(payload string) (bool, error) {
+	payload = strings.TrimSpace(payload)
+	if strings.HasPrefix(payload, "{") {
+		cmd := NodeCommandPayload{}
+		err := json.Unmarshal([]byte(payload), &cmd)
+		if err != nil {
+			return false, lib.MakeErrorf("ParseStartStopPayload: Invalid payload: %v", err)
+		}
+		if cmd.Start == nil {
+			return false, lib.MakeErrorf("ParseStartStopPayload: Missing start in payload")
+		}
+		return *cmd.Start, nil
+	}
+	start, err := strconv.ParseBool(payload)
+	if err != nil {
+		return false, lib.MakeErrorf("ParseStartStopPayload: Payload '%s' is not true or false", payload)
+	}
+	return start, nil
+}
+
+// ParseNodeCommandPayload returns the node in the payload of a node command on the controller
+// The payload is a NodeCommandPayload with the node field or the node HWID or zwave node ID itself.
+func ParseNodeCommandPayload(payload string) (string, error) {
+	node := strings.TrimSpace(payload)
+	if strings.HasPrefix(node, "{") {
+		cmd := NodeCommandPayload{}
+		err := json.Unmarshal([]byte(node), &cmd)
+		if err != nil {
+			return "", lib.MakeErrorf("ParseNodeCommandPayload: Invalid payload: %v", err)
+		}
+		node = strings.TrimSpace(cmd.Node)
+	}
+	if node == "" {
+		return "", lib.MakeErrorf("ParseNodeCommandPayload: Missing node in payload")
+	}
+	return node, nil
+}
+
+// ParseTokenPayload returns the confirmation token in the payload of a hard reset
+// The payload is a NodeCommandPayload with the token field or the token itself. An empty payload requests a
+// new token.
+func ParseTokenPayload(payload string) (string, error) {
+	token := strings.TrimSpace(payload)
+	if strings.HasPrefix(token, "{") {
+		cmd := NodeCommandPayload{}
+		err := json.Unmarshal([]byte(token), &cmd)
+		if err != nil {
+			return "", lib.MakeErrorf("ParseTokenPayload: Invalid payload: %v", err)
+		}
+		token = strings.TrimSpace(cmd.Token)
+	}
+	return token, nil
+}
+
+// ParseFilePayload returns the backup archive in the payload of a network restore
+// The payload is a NodeCommandPayload with the file field or the file name itself.
+func ParseFilePayload(payload string) (string, error) {
+	file := strings.TrimSpace(payload)
+	if strings.HasPrefix(file, "{") {
+		cmd := NodeCommandPayload{}
+		err := json.Unmarshal([]byte(file), &cmd)
+		if err != nil {
+			return "", lib.MakeErrorf("ParseFilePayload: Invalid payload: %v", err)
+		}
+		file = strings.TrimSpace(cmd.File)
+	}
+	if file == "" {
+		return "", lib.MakeErrorf("ParseFilePayload: Missing backup file")
+	}
+	return file, nil
+}
+
+// ParseDSKPayload returns the DSK in the payload of a provisioning command
+// The payload is a NodeCommandPayload with the dsk field or the DSK itself. See also ParseDSK.
+func ParseDSKPayload(payload string) (string, error) {
+	dsk := strings.TrimSpace(payload)
+	if strings.HasPrefix(dsk, "{") {
+		cmd := NodeCommandPayload{}
+		err := json.Unmarshal([]byte(dsk), &cmd)
+		if err != nil {
+			return "", lib.MakeErrorf("ParseDSKPayload: Invalid payload: %v", err)
+		}
+		dsk = cmd.DSK
+	}
+	return ParseDSK(dsk)
+}
+
+// isControllerNode returns true if the node is the node of a controller
+func (app *OpenZWaveApp) isControllerNode(nodeHWID string) bool {
+	homeID, zwNodeID, err := app.GetNodeAddress(nodeHWID)
+	if err != nil {
+		return false
+	}
+	controller := app.ozwAPI.GetControllerByHomeID(homeID)
+	return controller != nil && app.ozwAPI.GetControllerState(controller).NodeID == zwNodeID
+}
+
+// GetCommandTarget returns the HWID of the node a management command applies to
+// Commands on a node apply to the node itself. Commands on the controller node apply to the node in the
+// payload, which must be a known node in the network of the controller.
+func (app *OpenZWaveApp) GetCommandTarget(inputNodeHWID string, payload string) (string, error) {
+	if !app.isControllerNode(inputNodeHWID) {
+		return inputNodeHWID, nil
+	}
+	node, err := ParseNodeCommandPayload(payload)
+	if err != nil {
+		return "", err
+	}
+	homeID, zwNodeID, err := app.GetCommandNodeAddress(inputNodeHWID, node)
+	if err != nil || zwNodeID == 0 || zwNodeID > MaxZWaveNodeID {
+		return "", lib.MakeErrorf("GetCommandTarget: Invalid node '%s'", node)
+	}
+	controllerHomeID, _, _ := app.GetNodeAddress(inputNodeHWID)
+	if homeID != controllerHomeID {
+		return "", lib.MakeErrorf("GetCommandTarget: Node '%s' is not in the network of controller %s", node, inputNodeHWID)
+	}
+	targetHWID := app.MakeNodeHWID(homeID, zwNodeID)
+	if app.pub.GetNodeByHWID(targetHWID) == nil {
+		return "", lib.MakeErrorf("GetCommandTarget: Unknown node '%s'", node)
+	}
+	return targetHWID, nil
+}
+
+// publishCommandResult publishes the result of a management command on the node of the command input
+func (app *OpenZWaveApp) publishCommandResult(input *types.InputDiscoveryMessage, targetHWID string, err error) {
+	result := CommandResult{
+		Command:   input.Instance,
+		NodeHWID:  targetHWID,
+		Status:    CommandStatusAccepted,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		// eg the controller isn't ready yet
+		logrus.Warningf("HandleButtonCommand: PushButton '%s' of node %s rejected: %v", input.Instance, input.NodeHWID, err)
+		result.Status = CommandStatusRejected
+		result.Error = err.Error()
+		app.pub.UpdateNodeStatus(input.NodeHWID, map[types.NodeStatus]string{
+			types.NodeStatusLastError: err.Error(),
+		})
+	}
+	app.updateCommandResult(input, result)
+}
+
+// updateCommandResult publishes a command result on the node of the command input
+func (app *OpenZWaveApp) updateCommandResult(input *types.InputDiscoveryMessage, result CommandResult) {
+	if app.pub.GetOutputByNodeHWID(input.NodeHWID, OutputTypeCommandResult, input.Instance) == nil {
+		app.pub.CreateOutput(input.NodeHWID, OutputTypeCommandResult, input.Instance)
+	}
+	resultJSON, _ := json.Marshal(result)
+	app.pub.UpdateOutputValue(input.NodeHWID, OutputTypeCommandResult, input.Instance, string(resultJSON))
+}
+
+// HandleButtonCommand handles a management pushbutton of the controller or of a node and publishes
+// the result, see CommandResult. Invalid payloads are rejected instead of applying to a default node.
+func (app *OpenZWaveApp) HandleButtonCommand(input *types.InputDiscoveryMessage, payload string) {
+	logrus.Infof("HandleButtonCommand: PushButton '%s' of node %s. Value=%v", input.Instance, input.NodeHWID, payload)
+	var err error
+	var start bool
+	targetHWID := ""
+	homeID, _, _ := app.GetNodeAddress(input.NodeHWID)
+
+	switch input.Instance {
+	case ButtonInstanceHealNetwork:
+		err = app.StartHealNetwork(homeID)
+	case ButtonInstanceAddNode:
+		start, err = ParseStartStopPayload(payload)
+		if err == nil {
+			err = app.AddZWaveNode(homeID, start)
+		}
+	case ButtonInstanceRemoveNode:
+		start, err = ParseStartStopPayload(payload)
+		if err == nil {
+			err = app.RemoveZWaveNode(homeID, start)
+		}
+	case ButtonInstanceRemoveFailedNode, ButtonInstanceRefreshNodeInfo, ButtonInstanceRequestNodeValue,
+		ButtonInstanceUpdateNeighbors, ButtonInstanceHealNode, ButtonInstanceReplaceNode, ButtonInstanceAssignReturnRoute:
+		targetHWID, err = app.GetCommandTarget(input.NodeHWID, payload)
+		if err == nil {
+			err = app.CheckControllerReady(homeID)
+		}
+		if err == nil {
+			err = app.runNodeCommand(input.Instance, targetHWID)
+		}
+	case ButtonInstanceLearnMode:
+		start, err = ParseStartStopPayload(payload)
+		if err == nil {
+			err = app.SetLearnMode(homeID, start)
+		}
+	case ButtonInstanceCreatePrimary:
+		start, err = ParseStartStopPayload(payload)
+		if err == nil {
+			err = app.CreateNewPrimary(homeID, start)
+		}
+	case ButtonInstanceTransferPrimary:
+		start, err = ParseStartStopPayload(payload)
+		if err == nil {
+			err = app.TransferPrimaryRole(homeID, start)
+		}
+	case ButtonInstanceReplicate:
+		// only the controller node has this button, so the payload names the secondary controller
+		targetHWID, err = app.GetCommandTarget(input.NodeHWID, payload)
+		if err == nil {
+			err = app.ReplicateController(targetHWID)
+		}
+	case ButtonInstanceSoftReset:
+		err = app.SoftResetController(homeID)
+	case ButtonInstanceHardReset:
+		var token string
+		token, err = ParseTokenPayload(payload)
+		if err == nil && token == "" {
+			// first step, the result has the token to confirm the reset with
+			token, err = app.RequestHardReset(homeID)
+			if err == nil {
+				app.updateCommandResult(input, CommandResult{
+					Command:   input.Instance,
+					Status:    CommandStatusConfirm,
+					Token:     token,
+					Timestamp: time.Now().Format(time.RFC3339),
+				})
+				return
+			}
+		} else if err == nil {
+			err = app.HardResetController(homeID, token)
+		}
+	case ButtonInstanceBackupNetwork:
+		// the backup publishes its report on the node config output
+		err = app.HandleBackupNetworkCommand(input.NodeHWID, homeID)
+	case ButtonInstanceRestoreNetwork:
+		var file string
+		file, err = ParseFilePayload(payload)
+		if err == nil {
+			err = app.HandleRestoreNetworkCommand(input.NodeHWID, homeID, file)
+		}
+	case ButtonInstanceIncludeProvisioned:
+		var dsk string
+		dsk, err = ParseDSKPayload(payload)
+		if err == nil {
+			err = app.IncludeProvisionedNode(homeID, dsk)
+		}
+	case ButtonInstanceAddProvisioning:
+		// only the gateway node has the provisioning buttons
+		entry := ProvisioningEntry{}
+		err = json.Unmarshal([]byte(payload), &entry)
+		if err == nil {
+			_, err = app.AddProvisioningEntry(entry)
+		} else {
+			err = lib.MakeErrorf("HandleButtonCommand: Invalid provisioning entry: %v", err)
+		}
+	case ButtonInstanceRemoveProvisioning:
+		var dsk string
+		dsk, err = ParseDSKPayload(payload)
+		if err == nil {
+			err = app.RemoveProvisioningEntry(dsk)
+		}
+	case ButtonInstanceExportNodeConfig:
+		targetHWID, err = app.GetCommandTarget(input.NodeHWID, payload)
+		if err == nil {
+			err = app.HandleExportNodeConfigCommand(input.NodeHWID, targetHWID)
+		}
+	case ButtonInstanceImportNodeConfig:
+		// the import publishes its own report
+		app.HandleImportNodeConfigCommand(input.NodeHWID, payload)
+		return
+	default:
+		// unknown button ignored
+		logrus.Warningf("HandleButtonCommand: PushButton '%s' is not a known command. Ignored.", input.Instance)
+		return
+	}
+	app.publishCommandResult(input, targetHWID, err)
+}
+
+// runNodeCommand runs a management command for a node
+func (app *OpenZWaveApp) runNodeCommand(command string, nodeHWID string) error {
+	homeID, zwNodeID, err := app.GetNodeAddress(nodeHWID)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case ButtonInstanceRemoveFailedNode:
+		return app.RemoveFailedNode(nodeHWID)
+	case ButtonInstanceReplaceNode:
+		return app.ReplaceFailedNode(nodeHWID)
+	case ButtonInstanceAssignReturnRoute:
+		return app.AssignReturnRoute(nodeHWID)
+	case ButtonInstanceRefreshNodeInfo:
+		app.RefreshNodeInfo(nodeHWID)
+	case ButtonInstanceRequestNodeValue:
+		goopenzwave.RequestNodeAllConfigParam(homeID, zwNodeID)
+	case ButtonInstanceUpdateNeighbors:
+		app.UpdateNeighbors(nodeHWID)
+	case ButtonInstanceHealNode:
+		app.StartHealNode(nodeHWID)
+	}
+	return nil
+}
+
+// createNodeCommandInputs creates the management command inputs of a node, see NodeCommandButtons
+func (app *OpenZWaveApp) createNodeCommandInputs(nodeHWID string) {
+	for instance, description := range NodeCommandButtons {
+		if app.pub.GetInputByNodeHWID(nodeHWID, types.InputTypePushButton, instance) == nil {
+			input := app.pub.CreateInput(nodeHWID, types.InputTypePushButton, instance, app.HandleInputCommand)
+			input.Attr[types.NodeAttrDescription] = description
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/publisher"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStartStopPayload(t *testing.T) {
+	start, err := internal.ParseStartStopPayload("true")
+	assert.NoError(t, err)
+	assert.True(t, start)
+	start, err = internal.ParseStartStopPayload(" 0 ")
+	assert.NoError(t, err)
+	assert.False(t, start)
+	start, err = internal.ParseStartStopPayload(`{"start": true}`)
+	assert.NoError(t, err)
+	assert.True(t, start)
+
+	// invalid payloads don't stop the command
+	for _, payload := range []string{"", "5", "maybe", `{"node": "5"}`, `{"start": "yes"}`} {
+		_, err = internal.ParseStartStopPayload(payload)
+		assert.Error(t, err, "payload '%s'", payload)
+	}
+}
+
+func TestParseTokenPayload(t *testing.T) {
+	token, err := internal.ParseTokenPayload(" ")
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+	token, err = internal.ParseTokenPayload("a1b2")
+	assert.NoError(t, err)
+	assert.Equal(t, "a1b2", token)
+	token, err = internal.ParseTokenPayload(`{"token": "a1b2"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "a1b2", token)
+	_, err = internal.ParseTokenPayload("{bad json")
+	assert.Error(t, err)
+}
+
+func TestParseFilePayload(t *testing.T) {
+	file, err := internal.ParseFilePayload(" backup.zip ")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup.zip", file)
+	file, err = internal.ParseFilePayload(`{"file": "backup.zip"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "backup.zip", file)
+	for _, payload := range []string{"", "{}", "{bad json"} {
+		_, err = internal.ParseFilePayload(payload)
+		assert.Error(t, err, "payload '%s'", payload)
+	}
+}
+
+func TestParseDSKPayload(t *testing.T) {
+	dsk, err := internal.ParseDSKPayload(testDSK)
+	assert.NoError(t, err)
+	assert.Equal(t, testDSK, dsk)
+	dsk, err = internal.ParseDSKPayload(`{"dsk": "` + testDSK + `"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, testDSK, dsk)
+	for _, payload := range []string{"", "{}", "{bad json", "12345"} {
+		_, err = internal.ParseDSKPayload(payload)
+		assert.Error(t, err, "payload '%s'", payload)
+	}
+}
+
+func TestParseNodeCommandPayload(t *testing.T) {
+	node, err := internal.ParseNodeCommandPayload("5")
+	assert.NoError(t, err)
+	assert.Equal(t, "5", node)
+	node, err = internal.ParseNodeCommandPayload(`{"node": "e1f2a3b4-5"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "e1f2a3b4-5", node)
+
+	// invalid payloads don't become node 0
+	for _, payload := range []string{"", " ", "{}", `{"node": ""}`, "{bad json"} {
+		_, err = internal.ParseNodeCommandPayload(payload)
+		assert.Error(t, err, "payload '%s'", payload)
+	}
+}
+
+// getCommandResult returns the published result of a command input
+func getCommandResult(t *testing.T, pub *publisher.Publisher, nodeHWID string, instance string) internal.CommandResult {
+	result := internal.CommandResult{}
+	output := pub.GetOutputByNodeHWID(nodeHWID, internal.OutputTypeCommandResult, instance)
+	require.NotNil(t, output)
+	outputValue := pub.GetOutputValueByID(output.OutputID)
+	require.NotNil(t, outputValue)
+	err := json.Unmarshal([]byte(outputValue.Value), &result)
+	assert.NoError(t, err)
+	return result
+}
+
+func TestHandleButtonCommandResult(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	pub.CreateNode("12", types.NodeTypeSensor)
+
+	// a command on the node itself applies to the node. The controller isn't ready.
+	input := pub.CreateInput("12", types.InputTypePushButton, internal.ButtonInstanceRemoveFailedNode, nil)
+	app.HandleButtonCommand(input, "")
+	result := getCommandResult(t, pub, "12", internal.ButtonInstanceRemoveFailedNode)
+	assert.Equal(t, internal.ButtonInstanceRemoveFailedNode, result.Command)
+	assert.Equal(t, "12", result.NodeHWID)
+	assert.Equal(t, internal.CommandStatusRejected, result.Status)
+	assert.Contains(t, result.Error, "CheckControllerReady")
+	lastError, _ := pub.GetNodeStatus("12", types.NodeStatusLastError)
+	assert.Equal(t, result.Error, lastError)
+
+	// invalid payloads are rejected
+	input = pub.CreateInput("12", types.InputTypePushButton, internal.ButtonInstanceAddNode, nil)
+	app.HandleButtonCommand(input, "maybe")
+	result = getCommandResult(t, pub, "12", internal.ButtonInstanceAddNode)
+	assert.Equal(t, internal.CommandStatusRejected, result.Status)
+	assert.Contains(t, result.Error, "maybe")
+	input = pub.CreateInput("12", types.InputTypePushButton, internal.ButtonInstanceLearnMode, nil)
+	app.HandleButtonCommand(input, "")
+	result = getCommandResult(t, pub, "12", internal.ButtonInstanceLearnMode)
+	assert.Equal(t, internal.CommandStatusRejected, result.Status)
+}
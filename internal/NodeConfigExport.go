@@ -0,0 +1,215 @@
+// Package internal with export and import of zwave node configuration
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// OutputTypeNodeConfig is the controller output that publishes export documents, import reports and network
+// backup reports
+const OutputTypeNodeConfig types.OutputType = "nodeconfig"
+
+// Instances of the node configuration output
+const (
+	NodeConfigInstanceExport  = "export"
+	NodeConfigInstanceImport  = "import"
+	NodeConfigInstanceBackup  = "backup"
+	NodeConfigInstanceRestore = "restore"
+)
+
+// NodeConfigDocument contains the exported zwave configuration of a node
+// The model IDs are used on import to verify the document applies to the target node.
+type NodeConfigDocument struct {
+	NodeHWID       string                `json:"nodeHWID"`       // node the configuration was exported from
+	Manufacturer   string                `json:"manufacturer"`   // manufacturer name for reference
+	Model          string                `json:"model"`          // product name for reference
+	ManufacturerID string                `json:"manufacturerID"` // manufacturer ID, eg 0x0086
+	ProductType    string                `json:"productType"`    // product type, eg 0x0002
+	ProductID      string                `json:"productID"`      // product ID, eg 0x0064
+	Timestamp      string                `json:"timestamp"`      // time of export
+	Parameters     []NodeConfigParameter `json:"parameters"`     // configuration values
+}
+
+// NodeConfigParameter is a single exported zwave configuration value
+type NodeConfigParameter struct {
+	Attr  string `json:"attr"`  // configuration attribute name, eg parameter nr
+	Label string `json:"label"` // zwave value label
+	Type  string `json:"type"`  // zwave value type, eg Byte, List
+	Value string `json:"value"` // current value
+}
+
+// NodeConfigImportCommand is the payload of the import node config command
+// The document to import is either included or loaded from a file in the cache folder.
+type NodeConfigImportCommand struct {
+	NodeHWID string              `json:"node"`     // node to import the configuration into
+	File     string              `json:"file"`     // optional export file to load the document from
+	Document *NodeConfigDocument `json:"document"` // optional document to import
+}
+
+// NodeConfigImportReport reports the result of an import
+type NodeConfigImportReport struct {
+	NodeHWID     string   `json:"nodeHWID"`        // node the configuration was imported into
+	Source       string   `json:"source"`          // node the configuration was exported from
+	Applied      []string `json:"applied"`         // parameters written to the node
+	Skipped      []string `json:"skipped"`         // parameters that already have the value or are read-only
+	Incompatible []string `json:"incompatible"`    // parameters the node doesn't have or of a different type
+	Error        string   `json:"error,omitempty"` // error that prevented the import
+}
+
+// GetCacheFolder returns the folder for storing exports, backups and other publisher data
+func (app *OpenZWaveApp) GetCacheFolder() string {
+	if app.config.CacheFolder != "" {
+		return app.config.CacheFolder
+	}
+	return lib.DefaultCacheFolder
+}
+
+// getNodeConfigExportName returns the name of the file in the cache folder with the configuration export of a node
+func getNodeConfigExportName(nodeHWID string) string {
+	return fmt.Sprintf("%s-node-%s-config.json", AppID, nodeHWID)
+}
+
+// getNodeModelIDs returns the manufacturer ID, product type and product ID of a node
+func (app *OpenZWaveApp) getNodeModelIDs(nodeHWID string) (manufacturerID string, productType string, productID string) {
+	homeID, zwNodeID, _ := app.GetNodeAddress(nodeHWID)
+	manufacturerID = goopenzwave.GetNodeManufacturerID(homeID, zwNodeID)
+	productType = goopenzwave.GetNodeProductType(homeID, zwNodeID)
+	productID = goopenzwave.GetNodeProductID(homeID, zwNodeID)
+	return manufacturerID, productType, productID
+}
+
+// ExportNodeConfig returns a document with the zwave configuration values of a node
+// This contains all writable values registered during discovery of the node configuration.
+func (app *OpenZWaveApp) ExportNodeConfig(nodeHWID string) (*NodeConfigDocument, error) {
+	node := app.pub.GetNodeByHWID(nodeHWID)
+	if node == nil {
+		return nil, lib.MakeErrorf("ExportNodeConfig: Unknown node '%s'", nodeHWID)
+	}
+	doc := &NodeConfigDocument{
+		NodeHWID:     nodeHWID,
+		Manufacturer: node.Attr[types.NodeAttrManufacturer],
+		Model:        node.Attr[types.NodeAttrModel],
+		Timestamp:    time.Now().Format("2006-01-02T15:04:05.000-0700"),
+		Parameters:   make([]NodeConfigParameter, 0),
+	}
+	doc.ManufacturerID, doc.ProductType, doc.ProductID = app.getNodeModelIDs(nodeHWID)
+	for attrName, zwValue := range app.values.GetNodeConfigValues(nodeHWID) {
+		doc.Parameters = append(doc.Parameters, NodeConfigParameter{
+			Attr:  string(attrName),
+			Label: zwValue.GetLabel(),
+			Type:  zwValue.Type.String(),
+			Value: zwValue.GetAsString(),
+		})
+	}
+	sort.Slice(doc.Parameters, func(i, j int) bool {
+		return doc.Parameters[i].Attr < doc.Parameters[j].Attr
+	})
+	logrus.Infof("ExportNodeConfig: Node %s: exported %d configuration values", nodeHWID, len(doc.Parameters))
+	return doc, nil
+}
+
+// ImportNodeConfig writes the configuration values from a document into a node of the same model
+// Parameters are applied using the same write path as configuration commands. The node confirms the
+// changes through value notifications.
+func (app *OpenZWaveApp) ImportNodeConfig(nodeHWID string, doc *NodeConfigDocument) *NodeConfigImportReport {
+	report := &NodeConfigImportReport{
+		NodeHWID:     nodeHWID,
+		Source:       doc.NodeHWID,
+		Applied:      make([]string, 0),
+		Skipped:      make([]string, 0),
+		Incompatible: make([]string, 0),
+	}
+	if app.pub.GetNodeByHWID(nodeHWID) == nil {
+		report.Error = fmt.Sprintf("Unknown node '%s'", nodeHWID)
+		return report
+	}
+	manufacturerID, productType, productID := app.getNodeModelIDs(nodeHWID)
+	if !sameModelID(doc.ManufacturerID, manufacturerID) || !sameModelID(doc.ProductType, productType) ||
+		!sameModelID(doc.ProductID, productID) {
+		// nothing can be applied to a different model
+		report.Error = fmt.Sprintf("Node '%s' is not the same model as node '%s'", nodeHWID, doc.NodeHWID)
+		for _, param := range doc.Parameters {
+			report.Incompatible = append(report.Incompatible, param.Attr)
+		}
+		return report
+	}
+	for _, param := range doc.Parameters {
+		zwValue := app.values.GetValueByAttrID(MakeAttrID(nodeHWID, types.NodeAttr(param.Attr)))
+		if zwValue == nil || zwValue.Type.String() != param.Type {
+			report.Incompatible = append(report.Incompatible, param.Attr)
+			continue
+		}
+		if zwValue.IsReadOnly() || sameConfigValue(zwValue.GetAsString(), param.Value) {
+			report.Skipped = append(report.Skipped, param.Attr)
+			continue
+		}
+		err := app.SetZWaveValue(zwValue, param.Value)
+		if err != nil {
+			logrus.Errorf("ImportNodeConfig: Node %s: Failed applying configuration '%s': %v", nodeHWID, param.Attr, err)
+			report.Incompatible = append(report.Incompatible, param.Attr)
+		} else {
+			report.Applied = append(report.Applied, param.Attr)
+		}
+	}
+	logrus.Infof("ImportNodeConfig: Node %s from node %s: applied=%v, skipped=%v, incompatible=%v",
+		nodeHWID, doc.NodeHWID, report.Applied, report.Skipped, report.Incompatible)
+	return report
+}
+
+// HandleExportNodeConfigCommand exports the configuration of the node in the payload to a file in the
+// cache folder and publishes the document on the controller's node config output.
+// Returns an error if the node is unknown. The document is published also when it can't be saved.
+func (app *OpenZWaveApp) HandleExportNodeConfigCommand(controllerHWID string, nodeHWID string) error {
+	doc, err := app.ExportNodeConfig(nodeHWID)
+	if err != nil {
+		return err
+	}
+	docJSON, _ := json.MarshalIndent(doc, "", "  ")
+	filename := path.Join(app.GetCacheFolder(), getNodeConfigExportName(nodeHWID))
+	err = ioutil.WriteFile(filename, docJSON, 0644)
+	if err != nil {
+		logrus.Errorf("HandleExportNodeConfigCommand: Unable to save export of node %s to %s: %v", nodeHWID, filename, err)
+	} else {
+		logrus.Infof("HandleExportNodeConfigCommand: Saved export of node %s to %s", nodeHWID, filename)
+	}
+	app.pub.UpdateOutputValue(controllerHWID, OutputTypeNodeConfig, NodeConfigInstanceExport, string(docJSON))
+	return nil
+}
+
+// HandleImportNodeConfigCommand imports a node configuration document using a NodeConfigImportCommand JSON payload
+// and publishes the import report on the controller's node config output.
+func (app *OpenZWaveApp) HandleImportNodeConfigCommand(controllerHWID string, payload string) {
+	var report *NodeConfigImportReport
+	cmd := NodeConfigImportCommand{}
+	err := json.Unmarshal([]byte(payload), &cmd)
+	if err == nil && cmd.Document == nil && cmd.File != "" {
+		// only files from the cache folder can be imported
+		filename := path.Join(app.GetCacheFolder(), path.Base(cmd.File))
+		var docJSON []byte
+		docJSON, err = ioutil.ReadFile(filename)
+		if err == nil {
+			cmd.Document = &NodeConfigDocument{}
+			err = json.Unmarshal(docJSON, cmd.Document)
+		}
+	}
+	if err == nil && cmd.Document == nil {
+		err = lib.MakeErrorf("HandleImportNodeConfigCommand: Missing document or file to import")
+	}
+	if err != nil {
+		report = &NodeConfigImportReport{NodeHWID: cmd.NodeHWID, Error: err.Error()}
+	} else {
+		report = app.ImportNodeConfig(cmd.NodeHWID, cmd.Document)
+	}
+	reportJSON, _ := json.Marshal(report)
+	app.pub.UpdateOutputValue(controllerHWID, OutputTypeNodeConfig, NodeConfigInstanceImport, string(reportJSON))
+}
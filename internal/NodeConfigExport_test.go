@@ -0,0 +1,83 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/publisher"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getImportReport returns the import report published on the node config output of the node
+func getImportReport(t *testing.T, pub *publisher.Publisher, nodeHWID string) internal.NodeConfigImportReport {
+	report := internal.NodeConfigImportReport{}
+	output := pub.GetOutputByNodeHWID(nodeHWID, internal.OutputTypeNodeConfig, internal.NodeConfigInstanceImport)
+	require.NotNil(t, output)
+	outputValue := pub.GetOutputValueByID(output.OutputID)
+	require.NotNil(t, outputValue)
+	err := json.Unmarshal([]byte(outputValue.Value), &report)
+	assert.NoError(t, err)
+	return report
+}
+
+func TestExportNodeConfigUnknownNode(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+
+	_, err := app.ExportNodeConfig("13")
+	assert.Error(t, err)
+
+	// the command is rejected and nothing is exported
+	input := pub.CreateInput("13", types.InputTypePushButton, internal.ButtonInstanceExportNodeConfig, nil)
+	app.HandleButtonCommand(input, "")
+	result := getCommandResult(t, pub, "13", internal.ButtonInstanceExportNodeConfig)
+	assert.Equal(t, internal.CommandStatusRejected, result.Status)
+	assert.Contains(t, result.Error, "Unknown node")
+	_, err = os.Stat(path.Join(testFolder, internal.AppID+"-node-13-config.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestImportNodeConfigCommand(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+	pub.CreateNode("12", types.NodeTypeSensor)
+	pub.CreateOutput("12", internal.OutputTypeNodeConfig, internal.NodeConfigInstanceImport)
+
+	// invalid payloads are reported
+	for _, payload := range []string{"{bad json", `{"node": "13"}`, `{"node": "13", "file": "missing.json"}`} {
+		app.HandleImportNodeConfigCommand("12", payload)
+		report := getImportReport(t, pub, "12")
+		assert.NotEmpty(t, report.Error, "payload '%s'", payload)
+		assert.Empty(t, report.Applied)
+	}
+
+	// only files in the cache folder are imported
+	doc := internal.NodeConfigDocument{
+		NodeHWID:       "13",
+		ManufacturerID: "0x0086",
+		Parameters:     []internal.NodeConfigParameter{{Attr: "3", Label: "Timeout", Type: "Short", Value: "240"}},
+	}
+	docJSON, _ := json.Marshal(doc)
+	err := ioutil.WriteFile(path.Join(testFolder, "export.json"), docJSON, 0644)
+	require.NoError(t, err)
+	app.HandleImportNodeConfigCommand("12", `{"node": "14", "file": "../elsewhere/export.json"}`)
+	report := getImportReport(t, pub, "12")
+	assert.Equal(t, "14", report.NodeHWID)
+	assert.Contains(t, report.Error, "Unknown node")
+	assert.Equal(t, "13", report.Source)
+
+	// an included document into an unknown node
+	payload, _ := json.Marshal(internal.NodeConfigImportCommand{NodeHWID: "14", Document: &doc})
+	app.HandleImportNodeConfigCommand("12", string(payload))
+	report = getImportReport(t, pub, "12")
+	assert.Contains(t, report.Error, "Unknown node")
+	assert.Empty(t, report.Applied)
+}
@@ -0,0 +1,234 @@
+// Package internal with the liveness monitoring of zwave nodes
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// Liveness monitoring defaults
+const (
+	DefaultPingInterval     = 300 // seconds of silence after which a listening node is pinged
+	LivenessCheckInterval   = 30  // interval in seconds of the liveness check
+	LastSeenPublishInterval = 60  // min interval in seconds between publications of the last seen time of a node
+)
+
+// NodeActivity is the result of recording the activity of a node
+type NodeActivity struct {
+	LastSeen time.Time     // time the node was seen
+	Latency  time.Duration // round-trip time of an outstanding ping, 0 if no ping was outstanding
+	WasLost  bool          // the node was lost before this activity
+	Publish  bool          // the node status should be published
+}
+
+// nodeLivenessState holds the liveness of a node
+type nodeLivenessState struct {
+	lastSeen      time.Time // last activity of the node, or the start of monitoring
+	lastPublished time.Time // last publication of the last seen time
+	pingSent      time.Time // time of the outstanding ping, zero if none
+	isLost        bool      // the node has been silent too long
+}
+
+// NodeLiveness tracks when nodes were last seen and which nodes need a ping or are silent too long.
+// Activity is recorded from the notification handler while the monitor checks the nodes periodically.
+type NodeLiveness struct {
+	pingInterval   time.Duration // silence after which a node is pinged
+	silenceTimeout time.Duration // silence after which a node is lost
+	nodes          map[string]*nodeLivenessState
+	updateMutex    sync.Mutex
+}
+
+// getState returns the liveness of a node, creating it if needed. Must be called with the lock held.
+// The monitoring of a new node starts now.
+func (liveness *NodeLiveness) getState(nodeHWID string, now time.Time) *nodeLivenessState {
+	state := liveness.nodes[nodeHWID]
+	if state == nil {
+		state = &nodeLivenessState{lastSeen: now}
+		liveness.nodes[nodeHWID] = state
+	}
+	return state
+}
+
+// NodeSeen records activity of a node and returns the ping round-trip time if a ping was outstanding
+func (liveness *NodeLiveness) NodeSeen(nodeHWID string, now time.Time) NodeActivity {
+	liveness.updateMutex.Lock()
+	defer liveness.updateMutex.Unlock()
+	state := liveness.getState(nodeHWID, now)
+	activity := NodeActivity{LastSeen: now, WasLost: state.isLost}
+	if !state.pingSent.IsZero() {
+		activity.Latency = now.Sub(state.pingSent)
+		state.pingSent = time.Time{}
+	}
+	state.lastSeen = now
+	state.isLost = false
+	activity.Publish = activity.Latency > 0 || activity.WasLost ||
+		now.Sub(state.lastPublished) >= LastSeenPublishInterval*time.Second
+	if activity.Publish {
+		state.lastPublished = now
+	}
+	return activity
+}
+
+// NeedsPing returns true if the node has been silent for the ping interval since it was last seen or pinged.
+// The ping is recorded as sent when true is returned.
+func (liveness *NodeLiveness) NeedsPing(nodeHWID string, now time.Time) bool {
+	liveness.updateMutex.Lock()
+	defer liveness.updateMutex.Unlock()
+	state := liveness.getState(nodeHWID, now)
+	lastActivity := state.lastSeen
+	if state.pingSent.After(lastActivity) {
+		lastActivity = state.pingSent
+	}
+	if now.Sub(lastActivity) < liveness.pingInterval {
+		return false
+	}
+	state.pingSent = now
+	return true
+}
+
+// IsSilent returns true when the node has become silent for longer than the silence timeout.
+// This returns true once until the node is seen again.
+func (liveness *NodeLiveness) IsSilent(nodeHWID string, now time.Time) bool {
+	liveness.updateMutex.Lock()
+	defer liveness.updateMutex.Unlock()
+	state := liveness.getState(nodeHWID, now)
+	if state.isLost || now.Sub(state.lastSeen) < liveness.silenceTimeout {
+		return false
+	}
+	state.isLost = true
+	return true
+}
+
+// GetLastSeen returns the time the node was last seen, or the zero time if the node isn't monitored
+func (liveness *NodeLiveness) GetLastSeen(nodeHWID string) time.Time {
+	liveness.updateMutex.Lock()
+	defer liveness.updateMutex.Unlock()
+	state := liveness.nodes[nodeHWID]
+	if state == nil {
+		return time.Time{}
+	}
+	return state.lastSeen
+}
+
+// Remove stops monitoring a node
+func (liveness *NodeLiveness) Remove(nodeHWID string) {
+	liveness.updateMutex.Lock()
+	defer liveness.updateMutex.Unlock()
+	delete(liveness.nodes, nodeHWID)
+}
+
+// NewNodeLiveness creates the liveness tracking of nodes with the given ping interval and silence timeout
+func NewNodeLiveness(pingInterval time.Duration, silenceTimeout time.Duration) *NodeLiveness {
+	liveness := &NodeLiveness{
+		pingInterval:   pingInterval,
+		silenceTimeout: silenceTimeout,
+		nodes:          make(map[string]*nodeLivenessState),
+	}
+	return liveness
+}
+
+// isNodeActivity returns true if the notification shows that the node is alive
+func isNodeActivity(notification *goopenzwave.Notification) bool {
+	if notification.NodeID == 0 {
+		return false
+	}
+	switch notification.Type {
+	case goopenzwave.NotificationTypeValueChanged,
+		goopenzwave.NotificationTypeValueRefreshed,
+		goopenzwave.NotificationTypeNodeEvent,
+		goopenzwave.NotificationTypeNodeQueriesComplete,
+		goopenzwave.NotificationTypeButtonOn,
+		goopenzwave.NotificationTypeButtonOff:
+		return true
+	case goopenzwave.NotificationTypeNotification:
+		// the completion of a ping, or a node that reports to be awake or alive
+		code := notification.Notification
+		return code != nil && (*code == goopenzwave.NotificationCodeNoOperation ||
+			*code == goopenzwave.NotificationCodeAwake ||
+			*code == goopenzwave.NotificationCodeAlive)
+	}
+	return false
+}
+
+// UpdateNodeLastSeen records the activity of a node from a notification and publishes its last seen time
+// and the round-trip time of a ping. A node that was lost is no longer lost.
+func (app *OpenZWaveApp) UpdateNodeLastSeen(notification *goopenzwave.Notification) {
+	if !isNodeActivity(notification) {
+		return
+	}
+	nodeHWID := app.MakeNodeHWID(notification.HomeID, notification.NodeID)
+	activity := app.liveness.NodeSeen(nodeHWID, time.Now())
+	app.commStats.RecordReceived(nodeHWID)
+	if activity.Latency > 0 {
+		app.commStats.RecordRTT(nodeHWID, activity.Latency)
+	}
+	if !activity.Publish {
+		return
+	}
+	status := map[types.NodeStatus]string{
+		types.NodeStatusLastSeen: activity.LastSeen.Format(time.RFC3339),
+	}
+	if activity.Latency > 0 {
+		status[types.NodeStatusLatencyMSec] = fmt.Sprint(activity.Latency.Milliseconds())
+	}
+	app.pub.UpdateNodeStatus(nodeHWID, status)
+	if activity.WasLost {
+		logrus.Infof("UpdateNodeLastSeen: Node %s is back", nodeHWID)
+		app.UpdateNodeRunState(notification.HomeID, notification.NodeID, true)
+	}
+}
+
+// CheckNodesAlive pings the listening nodes of ready controllers that have been silent for the ping interval
+// and marks them lost when they are silent longer than the silence timeout.
+// Sleeping battery nodes can't be pinged and are not monitored.
+func (app *OpenZWaveApp) CheckNodesAlive() {
+	now := time.Now()
+	for _, node := range app.pub.GetNodes() {
+		if node.HWID == types.NodeIDGateway {
+			continue
+		}
+		homeID, zwNodeID, err := app.GetNodeAddress(node.HWID)
+		if err != nil || app.CheckControllerReady(homeID) != nil {
+			continue
+		}
+		controller := app.ozwAPI.GetControllerByHomeID(homeID)
+		if controller == nil || zwNodeID == app.ozwAPI.GetControllerState(controller).NodeID ||
+			!goopenzwave.IsNodeListeningDevice(homeID, zwNodeID) {
+			continue
+		}
+		if app.liveness.IsSilent(node.HWID, now) {
+			lastSeen := app.liveness.GetLastSeen(node.HWID)
+			logrus.Warningf("CheckNodesAlive: Node %s not seen since %s. Marked as lost.", node.HWID, lastSeen.Format(time.RFC3339))
+			app.pub.UpdateNodeErrorStatus(node.HWID, types.NodeRunStateLost,
+				"No response since "+lastSeen.Format(time.RFC3339))
+		}
+		if app.liveness.NeedsPing(node.HWID, now) {
+			logrus.Infof("CheckNodesAlive: Pinging node %s", node.HWID)
+			goopenzwave.TestNetworkNode(homeID, zwNodeID, 1)
+			app.commStats.RecordSent(node.HWID)
+		}
+	}
+}
+
+// livenessLoop checks the liveness of the nodes every LivenessCheckInterval seconds until the supervisor stops
+func (app *OpenZWaveApp) livenessLoop() {
+	logrus.Infof("OpenZWaveApp.livenessLoop: Checking nodes every %d seconds", LivenessCheckInterval)
+	ticker := time.NewTicker(LivenessCheckInterval * time.Second)
+	defer ticker.Stop()
+	defer app.supervisorWG.Done()
+
+	for {
+		select {
+		case <-app.stopSupervisor:
+			logrus.Infof("OpenZWaveApp.livenessLoop: Stopped")
+			return
+		case <-ticker.C:
+			app.CheckNodesAlive()
+		}
+	}
+}
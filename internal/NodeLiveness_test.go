@@ -0,0 +1,52 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeLivenessPing(t *testing.T) {
+	start := time.Now()
+	liveness := internal.NewNodeLiveness(time.Minute, 3*time.Minute)
+	// monitoring starts when the node is first checked
+	assert.False(t, liveness.NeedsPing("5", start))
+	assert.False(t, liveness.NeedsPing("5", start.Add(30*time.Second)))
+	assert.True(t, liveness.NeedsPing("5", start.Add(time.Minute)))
+	// no new ping until the ping interval has passed again
+	assert.False(t, liveness.NeedsPing("5", start.Add(90*time.Second)))
+
+	// the response gives the round-trip time
+	activity := liveness.NodeSeen("5", start.Add(time.Minute+250*time.Millisecond))
+	assert.Equal(t, 250*time.Millisecond, activity.Latency)
+	assert.True(t, activity.Publish)
+	assert.False(t, activity.WasLost)
+
+	// activity without a ping has no latency and isn't published again within a minute
+	activity = liveness.NodeSeen("5", start.Add(70*time.Second))
+	assert.Equal(t, time.Duration(0), activity.Latency)
+	assert.False(t, activity.Publish)
+	assert.Equal(t, start.Add(70*time.Second), liveness.GetLastSeen("5"))
+	assert.False(t, liveness.NeedsPing("5", start.Add(2*time.Minute)))
+	assert.True(t, liveness.NeedsPing("5", start.Add(130*time.Second)))
+}
+
+func TestNodeLivenessSilence(t *testing.T) {
+	start := time.Now()
+	liveness := internal.NewNodeLiveness(time.Minute, 3*time.Minute)
+	liveness.NodeSeen("5", start)
+	assert.False(t, liveness.IsSilent("5", start.Add(2*time.Minute)))
+	assert.True(t, liveness.IsSilent("5", start.Add(3*time.Minute)))
+	// reported once
+	assert.False(t, liveness.IsSilent("5", start.Add(4*time.Minute)))
+
+	activity := liveness.NodeSeen("5", start.Add(5*time.Minute))
+	assert.True(t, activity.WasLost)
+	assert.True(t, activity.Publish)
+	assert.False(t, liveness.IsSilent("5", start.Add(6*time.Minute)))
+
+	liveness.Remove("5")
+	assert.True(t, liveness.GetLastSeen("5").IsZero())
+}
@@ -0,0 +1,330 @@
+// Package internal with the replacement of failed nodes
+package internal
+
+import (
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// ReplaceCommandTimeout is the max time in seconds for the controller to replace a failed node
+// This includes the time to press the button on the new device.
+const ReplaceCommandTimeout = 300
+
+// NodeStatusReplaceState is the node status attribute with the progress of its replacement
+const NodeStatusReplaceState types.NodeStatus = "replaceState"
+
+// ReplaceState is the progress of the replacement of a failed node
+type ReplaceState string
+
+// Replacement progress
+const (
+	ReplaceStateWaiting    ReplaceState = "waiting"    // waiting for the button on the new device to be pressed
+	ReplaceStateInProgress ReplaceState = "inProgress" // the controller is adding the new device
+	ReplaceStateReplaced   ReplaceState = "replaced"   // the new device has the node ID, waiting for its queries
+	ReplaceStateRestored   ReplaceState = "restored"   // the name, location and configuration are reapplied
+	ReplaceStateFailed     ReplaceState = "failed"     // the controller didn't replace the node
+)
+
+// NodeSnapshot contains the data of a failed node that is reapplied to its replacement
+type NodeSnapshot struct {
+	NodeHWID     string              // node that is replaced
+	Name         string              // name of the node
+	Location     string              // location of the node
+	Config       *NodeConfigDocument // configuration of the node
+	Associations []NodeAssociation   // associations of the node with other nodes
+}
+
+// NodeAssociation is a target node in an association group of a node
+type NodeAssociation struct {
+	Group        uint8 // index of the association group
+	TargetNodeID uint8 // node ID of the associated node
+	Instance     uint8 // instance of the associated node, 0 for the node itself
+}
+
+// networkCacheAssociations is the part of the openzwave network cache with the associations of the nodes
+type networkCacheAssociations struct {
+	Nodes []struct {
+		ID     uint8 `xml:"id,attr"`
+		Groups []struct {
+			Index   uint8 `xml:"index,attr"`
+			Targets []struct {
+				ID       uint8 `xml:"id,attr"`
+				Instance uint8 `xml:"instance,attr"`
+			} `xml:"Node"`
+		} `xml:"Associations>Group"`
+	} `xml:"Node"`
+}
+
+// ReadNodeAssociations returns the associations of a node from the Associations section of the node in an
+// openzwave network cache. Goopenzwave can't read the associations of a node from the library.
+func ReadNodeAssociations(cacheXML []byte, zwNodeID uint8) ([]NodeAssociation, error) {
+	cache := networkCacheAssociations{}
+	err := xml.Unmarshal(cacheXML, &cache)
+	if err != nil {
+		return nil, lib.MakeErrorf("ReadNodeAssociations: Invalid network cache: %v", err)
+	}
+	associations := make([]NodeAssociation, 0)
+	for _, node := range cache.Nodes {
+		if node.ID != zwNodeID {
+			continue
+		}
+		for _, group := range node.Groups {
+			for _, target := range group.Targets {
+				associations = append(associations, NodeAssociation{
+					Group:        group.Index,
+					TargetNodeID: target.ID,
+					Instance:     target.Instance,
+				})
+			}
+		}
+	}
+	return associations, nil
+}
+
+// nodeReplacement holds the progress of a replacement
+type nodeReplacement struct {
+	homeID   uint32
+	snapshot *NodeSnapshot
+	state    ReplaceState
+	deadline time.Time // end of the wait for the controller to replace the node
+}
+
+// NodeReplacements tracks the replacement of failed nodes
+// The controller reports the progress of the replace command without the node, so at most one replacement
+// per network is in progress. Once replaced, the snapshot is kept until the new device is queried.
+type NodeReplacements struct {
+	timeout             time.Duration
+	activeByHomeID      map[uint32]string // node being replaced by the controller of a network
+	replacementByNodeID map[string]*nodeReplacement
+	updateMutex         sync.Mutex
+}
+
+// Start starts tracking the replacement of a node in a network. This returns an error if the controller
+// of the network is already replacing a node.
+func (replacements *NodeReplacements) Start(homeID uint32, snapshot *NodeSnapshot, now time.Time) error {
+	replacements.updateMutex.Lock()
+	defer replacements.updateMutex.Unlock()
+	activeHWID, found := replacements.activeByHomeID[homeID]
+	if found && now.Before(replacements.replacementByNodeID[activeHWID].deadline) {
+		return lib.MakeErrorf("NodeReplacements.Start: Node %s is already being replaced", activeHWID)
+	} else if found {
+		// the controller never completed the previous replacement
+		delete(replacements.replacementByNodeID, activeHWID)
+	}
+	replacements.activeByHomeID[homeID] = snapshot.NodeHWID
+	replacements.replacementByNodeID[snapshot.NodeHWID] = &nodeReplacement{
+		homeID:   homeID,
+		snapshot: snapshot,
+		state:    ReplaceStateWaiting,
+		deadline: now.Add(replacements.timeout),
+	}
+	return nil
+}
+
+// Cancel stops tracking the replacement of a node, eg when the controller rejects the command
+func (replacements *NodeReplacements) Cancel(nodeHWID string) {
+	replacements.updateMutex.Lock()
+	defer replacements.updateMutex.Unlock()
+	replacement := replacements.replacementByNodeID[nodeHWID]
+	if replacement == nil {
+		return
+	}
+	if replacements.activeByHomeID[replacement.homeID] == nodeHWID {
+		delete(replacements.activeByHomeID, replacement.homeID)
+	}
+	delete(replacements.replacementByNodeID, nodeHWID)
+}
+
+// UpdateCommandState updates the replacement in progress in the network with the state of the controller
+// command, see ControllerCommandState. Only states of the replace failed node command apply. This returns the
+// replaced node and its new state, or "" if no replacement is in progress or the state is unchanged. A failed
+// replacement is no longer tracked.
+func (replacements *NodeReplacements) UpdateCommandState(homeID uint32, commandName string, commandState string,
+	now time.Time) (nodeHWID string, state ReplaceState) {
+
+	if commandName != ButtonInstanceReplaceNode {
+		return "", ""
+	}
+	replacements.updateMutex.Lock()
+	defer replacements.updateMutex.Unlock()
+	nodeHWID, found := replacements.activeByHomeID[homeID]
+	if !found {
+		return "", ""
+	}
+	replacement := replacements.replacementByNodeID[nodeHWID]
+	newState := replacement.state
+	switch commandState {
+	case ControllerCommandWaiting:
+		newState = ReplaceStateWaiting
+	case ControllerCommandInProgress:
+		newState = ReplaceStateInProgress
+	case ControllerCommandCompleted:
+		newState = ReplaceStateReplaced
+	case ControllerCommandNormal, ControllerCommandStarting, ControllerCommandSleeping:
+	default:
+		// cancelled, failed, or the node isn't failed
+		newState = ReplaceStateFailed
+	}
+	if newState != ReplaceStateReplaced && newState != ReplaceStateFailed && now.After(replacement.deadline) {
+		newState = ReplaceStateFailed
+	}
+	if newState == replacement.state {
+		return "", ""
+	}
+	replacement.state = newState
+	if newState == ReplaceStateReplaced || newState == ReplaceStateFailed {
+		delete(replacements.activeByHomeID, homeID)
+	}
+	if newState == ReplaceStateFailed {
+		delete(replacements.replacementByNodeID, nodeHWID)
+	}
+	return nodeHWID, newState
+}
+
+// TakeReplacedSnapshot returns the snapshot of a node that has been replaced and stops tracking it
+// Returns nil if the node isn't replaced.
+func (replacements *NodeReplacements) TakeReplacedSnapshot(nodeHWID string) *NodeSnapshot {
+	replacements.updateMutex.Lock()
+	defer replacements.updateMutex.Unlock()
+	replacement := replacements.replacementByNodeID[nodeHWID]
+	if replacement == nil || replacement.state != ReplaceStateReplaced {
+		return nil
+	}
+	delete(replacements.replacementByNodeID, nodeHWID)
+	return replacement.snapshot
+}
+
+// GetState returns the state of the replacement of a node, or "" if it isn't being replaced
+func (replacements *NodeReplacements) GetState(nodeHWID string) ReplaceState {
+	replacements.updateMutex.Lock()
+	defer replacements.updateMutex.Unlock()
+	replacement := replacements.replacementByNodeID[nodeHWID]
+	if replacement == nil {
+		return ""
+	}
+	return replacement.state
+}
+
+// NewNodeReplacements creates the tracking of node replacements with the given controller command timeout
+func NewNodeReplacements(timeout time.Duration) *NodeReplacements {
+	replacements := &NodeReplacements{
+		timeout:             timeout,
+		activeByHomeID:      make(map[uint32]string),
+		replacementByNodeID: make(map[string]*nodeReplacement),
+	}
+	return replacements
+}
+
+// publishReplaceState publishes the progress of the replacement of a node in its status
+func (app *OpenZWaveApp) publishReplaceState(nodeHWID string, state ReplaceState) {
+	logrus.Infof("OpenZWaveApp.publishReplaceState: Replacement of node %s is %s", nodeHWID, state)
+	app.pub.UpdateNodeStatus(nodeHWID, map[types.NodeStatus]string{
+		NodeStatusReplaceState: string(state),
+	})
+}
+
+// ReplaceFailedNode replaces a failed node with a new device that keeps its node ID
+// The name, location, configuration and associations of the failed node are reapplied when the new device is
+// queried. The associations are read from the openzwave network cache, see ReadNodeAssociations. Associations
+// of other nodes with the node remain valid as the node ID is kept.
+// This requires the node to be failed and the controller to be ready.
+func (app *OpenZWaveApp) ReplaceFailedNode(nodeHWID string) error {
+	logrus.Infof("ReplaceFailedNode: Node %s", nodeHWID)
+	homeID, zwNodeID, err := app.GetNodeAddress(nodeHWID)
+	if err == nil {
+		err = app.CheckControllerReady(homeID)
+	}
+	if err != nil {
+		return err
+	}
+	node := app.pub.GetNodeByHWID(nodeHWID)
+	if node == nil {
+		return lib.MakeErrorf("ReplaceFailedNode: Unknown node '%s'", nodeHWID)
+	}
+	if !goopenzwave.IsNodeFailed(homeID, zwNodeID) {
+		return lib.MakeErrorf("ReplaceFailedNode: Node %s has not failed", nodeHWID)
+	}
+	snapshot := &NodeSnapshot{
+		NodeHWID: nodeHWID,
+		Name:     node.Attr[types.NodeAttrName],
+		Location: node.Attr[types.NodeAttrLocationName],
+	}
+	snapshot.Config, err = app.ExportNodeConfig(nodeHWID)
+	if err != nil {
+		return err
+	}
+	cacheXML, err := app.readNetworkCache(homeID)
+	if err == nil {
+		snapshot.Associations, err = ReadNodeAssociations(cacheXML, zwNodeID)
+	}
+	if err != nil {
+		// the replacement is more important than its associations
+		logrus.Warningf("ReplaceFailedNode: Node %s associations can't be restored: %v", nodeHWID, err)
+	}
+	err = app.replacements.Start(homeID, snapshot, time.Now())
+	if err != nil {
+		return err
+	}
+	app.startControllerCommand(homeID, ButtonInstanceReplaceNode)
+	if !goopenzwave.ReplaceFailedNode(homeID, zwNodeID) {
+		app.replacements.Cancel(nodeHWID)
+		return lib.MakeErrorf("ReplaceFailedNode: The controller rejected the replacement of node %s", nodeHWID)
+	}
+	app.publishReplaceState(nodeHWID, ReplaceStateWaiting)
+	return nil
+}
+
+// updateReplaceProgress updates the replacement in progress in a network with the state of the controller command
+func (app *OpenZWaveApp) updateReplaceProgress(homeID uint32, commandState string) {
+	commandName := app.getControllerCommandName(homeID)
+	nodeHWID, state := app.replacements.UpdateCommandState(homeID, commandName, commandState, time.Now())
+	if nodeHWID == "" {
+		return
+	}
+	app.publishReplaceState(nodeHWID, state)
+	if state == ReplaceStateFailed {
+		app.pub.UpdateNodeStatus(nodeHWID, map[types.NodeStatus]string{
+			types.NodeStatusLastError: "Replacement failed. Controller command " + commandState,
+		})
+	}
+}
+
+// RestoreReplacedNode reapplies the name, location, configuration and associations of a replaced node to the
+// new device once it is queried. Configuration is only applied if the new device is the same model.
+func (app *OpenZWaveApp) RestoreReplacedNode(homeID uint32, zwNodeID uint8) {
+	nodeHWID := app.MakeNodeHWID(homeID, zwNodeID)
+	snapshot := app.replacements.TakeReplacedSnapshot(nodeHWID)
+	if snapshot == nil {
+		return
+	}
+	naming := types.NodeAttrMap{}
+	if snapshot.Name != "" && app.SetZWaveNodeNaming(nodeHWID, types.NodeAttrName, snapshot.Name) == nil {
+		naming[types.NodeAttrName] = snapshot.Name
+	}
+	if snapshot.Location != "" && app.SetZWaveNodeNaming(nodeHWID, types.NodeAttrLocationName, snapshot.Location) == nil {
+		naming[types.NodeAttrLocationName] = snapshot.Location
+	}
+	if len(naming) > 0 {
+		app.pub.UpdateNodeConfigValues(nodeHWID, naming)
+	}
+	report := app.ImportNodeConfig(nodeHWID, snapshot.Config)
+	for _, association := range snapshot.Associations {
+		goopenzwave.AddAssociation(homeID, zwNodeID, association.Group, association.TargetNodeID, association.Instance)
+	}
+	status := map[types.NodeStatus]string{
+		NodeStatusReplaceState:    string(ReplaceStateRestored),
+		types.NodeStatusLastError: report.Error,
+	}
+	if report.Error != "" {
+		logrus.Warningf("RestoreReplacedNode: Node %s configuration not restored: %s", nodeHWID, report.Error)
+	}
+	logrus.Infof("RestoreReplacedNode: Node %s restored. Applied %d configuration values and %d associations.",
+		nodeHWID, len(report.Applied), len(snapshot.Associations))
+	app.pub.UpdateNodeStatus(nodeHWID, status)
+}
@@ -0,0 +1,115 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeReplacements(t *testing.T) {
+	replacements := internal.NewNodeReplacements(time.Minute)
+	now := time.Now()
+	replace := internal.ButtonInstanceReplaceNode
+	snapshot := &internal.NodeSnapshot{NodeHWID: "e1f2a3b4-5", Name: "kitchen"}
+	err := replacements.Start(testHomeID, snapshot, now)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.ReplaceStateWaiting, replacements.GetState("e1f2a3b4-5"))
+
+	// one replacement per network
+	err = replacements.Start(testHomeID, &internal.NodeSnapshot{NodeHWID: "e1f2a3b4-6"}, now)
+	assert.Error(t, err)
+
+	// starting doesn't change the state, in progress does
+	nodeHWID, state := replacements.UpdateCommandState(testHomeID, replace, internal.ControllerCommandStarting, now)
+	assert.Equal(t, "", nodeHWID)
+	nodeHWID, state = replacements.UpdateCommandState(testHomeID, replace, internal.ControllerCommandInProgress, now)
+	assert.Equal(t, "e1f2a3b4-5", nodeHWID)
+	assert.Equal(t, internal.ReplaceStateInProgress, state)
+	// other networks are not affected
+	nodeHWID, _ = replacements.UpdateCommandState(testHomeID+1, replace, internal.ControllerCommandCompleted, now)
+	assert.Equal(t, "", nodeHWID)
+	// states of other controller commands don't apply
+	nodeHWID, _ = replacements.UpdateCommandState(testHomeID, internal.ButtonInstanceAddNode, internal.ControllerCommandCompleted, now)
+	assert.Equal(t, "", nodeHWID)
+	assert.Equal(t, internal.ReplaceStateInProgress, replacements.GetState("e1f2a3b4-5"))
+
+	// the snapshot is only available once replaced
+	assert.Nil(t, replacements.TakeReplacedSnapshot("e1f2a3b4-5"))
+	nodeHWID, state = replacements.UpdateCommandState(testHomeID, replace, internal.ControllerCommandCompleted, now)
+	assert.Equal(t, "e1f2a3b4-5", nodeHWID)
+	assert.Equal(t, internal.ReplaceStateReplaced, state)
+	// the controller is free for another replacement
+	err = replacements.Start(testHomeID, &internal.NodeSnapshot{NodeHWID: "e1f2a3b4-6"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot, replacements.TakeReplacedSnapshot("e1f2a3b4-5"))
+	assert.Nil(t, replacements.TakeReplacedSnapshot("e1f2a3b4-5"))
+	assert.Equal(t, internal.ReplaceState(""), replacements.GetState("e1f2a3b4-5"))
+
+	// a failed replacement is no longer tracked
+	nodeHWID, state = replacements.UpdateCommandState(testHomeID, replace, internal.ControllerCommandNodeOK, now)
+	assert.Equal(t, "e1f2a3b4-6", nodeHWID)
+	assert.Equal(t, internal.ReplaceStateFailed, state)
+	assert.Equal(t, internal.ReplaceState(""), replacements.GetState("e1f2a3b4-6"))
+
+	// an expired replacement fails and can be restarted
+	err = replacements.Start(testHomeID, &internal.NodeSnapshot{NodeHWID: "e1f2a3b4-7"}, now)
+	assert.NoError(t, err)
+	later := now.Add(2 * time.Minute)
+	err = replacements.Start(testHomeID, &internal.NodeSnapshot{NodeHWID: "e1f2a3b4-8"}, later)
+	assert.NoError(t, err)
+	nodeHWID, state = replacements.UpdateCommandState(testHomeID, replace, internal.ControllerCommandWaiting, later.Add(2*time.Minute))
+	assert.Equal(t, "e1f2a3b4-8", nodeHWID)
+	assert.Equal(t, internal.ReplaceStateFailed, state)
+
+	// cancel
+	err = replacements.Start(testHomeID, &internal.NodeSnapshot{NodeHWID: "e1f2a3b4-9"}, now)
+	assert.NoError(t, err)
+	replacements.Cancel("e1f2a3b4-9")
+	assert.Equal(t, internal.ReplaceState(""), replacements.GetState("e1f2a3b4-9"))
+	nodeHWID, _ = replacements.UpdateCommandState(testHomeID, replace, internal.ControllerCommandCompleted, now)
+	assert.Equal(t, "", nodeHWID)
+}
+
+func TestReadNodeAssociations(t *testing.T) {
+	cacheXML := []byte(`<?xml version="1.0" encoding="utf-8" ?>
+<Driver xmlns="http://code.google.com/p/open-zwave/" version="3" home_id="0xe1f2a3b4" node_id="1">
+	<Node id="5" name="sensor">
+		<CommandClasses />
+		<Associations num_groups="2">
+			<Group index="1" max_associations="5" label="Lifeline" auto="true">
+				<Node id="1" />
+			</Group>
+			<Group index="2" max_associations="5" label="Basic set">
+				<Node id="7" />
+				<Node id="8" instance="2" />
+			</Group>
+		</Associations>
+	</Node>
+	<Node id="7" name="switch">
+		<Associations num_groups="1">
+			<Group index="1" max_associations="1" label="Lifeline" auto="true">
+				<Node id="1" />
+			</Group>
+		</Associations>
+	</Node>
+</Driver>
+`)
+	associations, err := internal.ReadNodeAssociations(cacheXML, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []internal.NodeAssociation{
+		{Group: 1, TargetNodeID: 1},
+		{Group: 2, TargetNodeID: 7},
+		{Group: 2, TargetNodeID: 8, Instance: 2},
+	}, associations)
+
+	// a node without associations
+	associations, err = internal.ReadNodeAssociations(cacheXML, 9)
+	require.NoError(t, err)
+	assert.Empty(t, associations)
+
+	_, err = internal.ReadNodeAssociations([]byte("not xml"), 5)
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+// Package internal with the derivation of the run state of zwave nodes
+package internal
+
+import (
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+)
+
+// NodeStatusQueryStage is the node status attribute with the openzwave query stage of the node
+const NodeStatusQueryStage types.NodeStatus = "queryStage"
+
+// QueryStageComplete is the openzwave query stage of a node whose queries have completed
+const QueryStageComplete = "Complete"
+
+// ZWaveNodeState holds the openzwave node information that determines the run state of a node
+type ZWaveNodeState struct {
+	IsFailed    bool   // the controller has marked the node as failed
+	IsAwake     bool   // the node is awake, always true for listening nodes
+	IsListening bool   // the node is always or frequently listening, eg not a sleeping battery node
+	QueryStage  string // openzwave query stage, eg ProtocolInfo, Static, Complete
+}
+
+// GetNodeRunState returns the iotdomain run state of a zwave node
+// A failed node is lost if it was queried before and in error if it failed during its queries. A battery
+// node that is asleep is sleeping, even while its queries are in progress as these continue when it wakes up.
+// Otherwise the node is initializing until its queries are complete, after which it is ready.
+func GetNodeRunState(state ZWaveNodeState) string {
+	if state.IsFailed {
+		if state.QueryStage == QueryStageComplete {
+			return types.NodeRunStateLost
+		}
+		return types.NodeRunStateError
+	}
+	if !state.IsListening && !state.IsAwake {
+		return types.NodeRunStateSleeping
+	}
+	if state.QueryStage != QueryStageComplete {
+		return types.NodeRunStateInitializing
+	}
+	return types.NodeRunStateReady
+}
+
+// GetZWaveNodeState returns the openzwave information that determines the run state of a node
+func GetZWaveNodeState(homeID uint32, zwNodeID uint8) ZWaveNodeState {
+	return ZWaveNodeState{
+		IsFailed: goopenzwave.IsNodeFailed(homeID, zwNodeID),
+		IsAwake:  goopenzwave.IsNodeAwake(homeID, zwNodeID),
+		IsListening: goopenzwave.IsNodeListeningDevice(homeID, zwNodeID) ||
+			goopenzwave.IsNodeFrequentListeningDevice(homeID, zwNodeID),
+		QueryStage: goopenzwave.GetNodeQueryStage(homeID, zwNodeID),
+	}
+}
+
+// UpdateNodeRunState publishes the run state and query stage of a zwave node
+// Use clearError to clear the last error of the node, eg when the node reports it is awake again.
+func (app *OpenZWaveApp) UpdateNodeRunState(homeID uint32, zwNodeID uint8, clearError bool) {
+	nodeHWID := app.MakeNodeHWID(homeID, zwNodeID)
+	state := GetZWaveNodeState(homeID, zwNodeID)
+	status := map[types.NodeStatus]string{
+		types.NodeStatusRunState: GetNodeRunState(state),
+		NodeStatusQueryStage:     state.QueryStage,
+	}
+	if clearError {
+		status[types.NodeStatusLastError] = ""
+	}
+	app.pub.UpdateNodeStatus(nodeHWID, status)
+}
@@ -0,0 +1,34 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNodeRunState(t *testing.T) {
+	complete := internal.QueryStageComplete
+	testCases := []struct {
+		state    internal.ZWaveNodeState
+		runState string
+	}{
+		// listening nodes
+		{internal.ZWaveNodeState{IsAwake: true, IsListening: true, QueryStage: "ProtocolInfo"}, types.NodeRunStateInitializing},
+		{internal.ZWaveNodeState{IsAwake: true, IsListening: true, QueryStage: "CacheLoad"}, types.NodeRunStateInitializing},
+		{internal.ZWaveNodeState{IsAwake: true, IsListening: true, QueryStage: complete}, types.NodeRunStateReady},
+		// battery nodes
+		{internal.ZWaveNodeState{IsAwake: false, QueryStage: complete}, types.NodeRunStateSleeping},
+		{internal.ZWaveNodeState{IsAwake: false, QueryStage: "WakeUp"}, types.NodeRunStateSleeping},
+		{internal.ZWaveNodeState{IsAwake: true, QueryStage: "Static"}, types.NodeRunStateInitializing},
+		{internal.ZWaveNodeState{IsAwake: true, QueryStage: complete}, types.NodeRunStateReady},
+		// failed nodes
+		{internal.ZWaveNodeState{IsFailed: true, IsAwake: true, IsListening: true, QueryStage: complete}, types.NodeRunStateLost},
+		{internal.ZWaveNodeState{IsFailed: true, IsAwake: false, QueryStage: complete}, types.NodeRunStateLost},
+		{internal.ZWaveNodeState{IsFailed: true, IsAwake: true, IsListening: true, QueryStage: "Probe"}, types.NodeRunStateError},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.runState, internal.GetNodeRunState(testCase.state), "state %+v", testCase.state)
+	}
+}
@@ -0,0 +1,285 @@
+// Package internal with the pipeline that delivers openzwave notifications to the publisher
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// Notification pipeline defaults
+const (
+	DefaultNotificationQueueSize = 1000 // max nr of notifications waiting to be processed
+	DefaultNotificationWorkers   = 4    // nr of workers processing node notifications concurrently
+)
+
+// NotificationStats contains the counters of the notification pipeline
+type NotificationStats struct {
+	Received    uint64 // notifications received from openzwave
+	Processed   uint64 // notifications handled
+	Dropped     uint64 // value and event notifications dropped because the queue was full
+	Discarded   uint64 // notifications discarded because the pipeline was stopped
+	QueueLength int    // notifications currently waiting in the queue
+	Backlog     int    // notifications waiting for room in the queue, see Submit
+	QueueSize   int    // capacity of the queue
+}
+
+// NotificationPipeline queues notifications from the openzwave callback and processes them in workers.
+// The openzwave driver thread is never blocked: when the queue is full value and event notifications are
+// dropped and counted. Other notifications, such as driver ready or node removed, are never dropped but wait
+// in an unbounded backlog until the queue has room. Notifications of the same node are processed in order by
+// the same worker while different nodes are processed concurrently. Network-wide notifications, eg driver ready or all nodes queried, are barriers that
+// are processed after all preceding notifications.
+type NotificationPipeline struct {
+	queue    chan *goopenzwave.Notification   // bounded queue fed by the openzwave callback
+	workers  []chan *goopenzwave.Notification // queue per worker
+	handler  func(*goopenzwave.Notification)
+	inFlight sync.WaitGroup // notifications dispatched to workers and not yet handled
+	done     sync.WaitGroup // dispatcher, feeder and workers have ended
+
+	stopMutex sync.RWMutex // guards the queue against closing while it is written
+	isStopped bool
+	stop      chan bool // discard the remaining queued notifications
+
+	backlogMutex sync.Mutex                  // guards the backlog
+	backlog      []*goopenzwave.Notification // notifications that can't be dropped, waiting for room in the queue
+	backlogReady chan bool                   // signals the feeder that the backlog has notifications
+
+	received  uint64 // counters are accessed atomically
+	processed uint64
+	dropped   uint64
+	discarded uint64
+}
+
+// isBarrier returns true for notifications that concern the whole network instead of a single node
+func isBarrier(notification *goopenzwave.Notification) bool {
+	switch notification.Type {
+	case goopenzwave.NotificationTypeDriverReady,
+		goopenzwave.NotificationTypeDriverFailed,
+		goopenzwave.NotificationTypeDriverReset,
+		goopenzwave.NotificationTypeDriverRemoved,
+		goopenzwave.NotificationTypeAwakeNodesQueried,
+		goopenzwave.NotificationTypeAllNodesQueried,
+		goopenzwave.NotificationTypeAllNodesQueriedSomeDead:
+		return true
+	}
+	return false
+}
+
+// isDroppable returns true for value and event notifications that can be dropped when the queue is full
+// The state they report is refreshed by later notifications or by polling.
+func isDroppable(notification *goopenzwave.Notification) bool {
+	switch notification.Type {
+	case goopenzwave.NotificationTypeValueChanged,
+		goopenzwave.NotificationTypeValueRefreshed,
+		goopenzwave.NotificationTypeNodeEvent,
+		goopenzwave.NotificationTypeSceneEvent,
+		goopenzwave.NotificationTypeButtonOn,
+		goopenzwave.NotificationTypeButtonOff,
+		goopenzwave.NotificationTypeNotification:
+		return true
+	}
+	return false
+}
+
+// Submit queues a notification for processing without blocking
+// When the queue is full, value and event notifications are dropped and other notifications are added to the
+// backlog. Notifications that follow a backlogged notification are backlogged or dropped as well to keep the
+// order. Returns false if the notification is dropped or the pipeline is stopped.
+// This is safe to call from the openzwave callback at any time, including after Stop.
+func (pipeline *NotificationPipeline) Submit(notification *goopenzwave.Notification) bool {
+	pipeline.stopMutex.RLock()
+	defer pipeline.stopMutex.RUnlock()
+	if pipeline.isStopped {
+		atomic.AddUint64(&pipeline.discarded, 1)
+		return false
+	}
+	atomic.AddUint64(&pipeline.received, 1)
+	pipeline.backlogMutex.Lock()
+	defer pipeline.backlogMutex.Unlock()
+	if len(pipeline.backlog) == 0 {
+		select {
+		case pipeline.queue <- notification:
+			return true
+		default:
+		}
+	}
+	if !isDroppable(notification) {
+		pipeline.backlog = append(pipeline.backlog, notification)
+		if len(pipeline.backlog) == 1 {
+			logrus.Warningf("NotificationPipeline.Submit: Queue full (%d). Holding %s notifications in the backlog",
+				cap(pipeline.queue), notification.Type)
+		}
+		select {
+		case pipeline.backlogReady <- true:
+		default:
+		}
+		return true
+	}
+	dropped := atomic.AddUint64(&pipeline.dropped, 1)
+	if dropped == 1 || dropped%100 == 0 {
+		logrus.Errorf("NotificationPipeline.Submit: Queue full (%d). Dropped %d notifications so far",
+			cap(pipeline.queue), dropped)
+	}
+	return false
+}
+
+// feedLoop moves the backlog into the queue in order as the queue gets room, until the pipeline is stopped
+func (pipeline *NotificationPipeline) feedLoop() {
+	defer pipeline.done.Done()
+	for {
+		select {
+		case <-pipeline.stop:
+			return
+		case <-pipeline.backlogReady:
+		}
+		for pipeline.feedNext() {
+		}
+	}
+}
+
+// feedNext waits for room in the queue for the first notification of the backlog
+// Returns false when the backlog is empty or the pipeline is stopped.
+func (pipeline *NotificationPipeline) feedNext() bool {
+	// the queue isn't closed while it is written
+	pipeline.stopMutex.RLock()
+	defer pipeline.stopMutex.RUnlock()
+	if pipeline.isStopped {
+		return false
+	}
+	pipeline.backlogMutex.Lock()
+	if len(pipeline.backlog) == 0 {
+		pipeline.backlogMutex.Unlock()
+		return false
+	}
+	notification := pipeline.backlog[0]
+	pipeline.backlogMutex.Unlock()
+
+	// submitters add to the backlog meanwhile, so the order is kept
+	pipeline.queue <- notification
+	pipeline.backlogMutex.Lock()
+	defer pipeline.backlogMutex.Unlock()
+	pipeline.backlog[0] = nil
+	pipeline.backlog = pipeline.backlog[1:]
+	return len(pipeline.backlog) > 0
+}
+
+// Start the dispatcher, feeder and workers
+func (pipeline *NotificationPipeline) Start() {
+	pipeline.done.Add(2 + len(pipeline.workers))
+	for _, workerQueue := range pipeline.workers {
+		go pipeline.workerLoop(workerQueue)
+	}
+	go pipeline.dispatchLoop()
+	go pipeline.feedLoop()
+}
+
+// Stop stops accepting notifications and discards the notifications still waiting to be processed,
+// including the backlog. Notifications that are being handled are completed before this returns.
+// Notifications submitted after Stop are discarded.
+func (pipeline *NotificationPipeline) Stop() {
+	pipeline.stopMutex.Lock()
+	if pipeline.isStopped {
+		pipeline.stopMutex.Unlock()
+		return
+	}
+	pipeline.isStopped = true
+	close(pipeline.stop)
+	close(pipeline.queue)
+	pipeline.stopMutex.Unlock()
+
+	pipeline.done.Wait()
+	pipeline.backlogMutex.Lock()
+	atomic.AddUint64(&pipeline.discarded, uint64(len(pipeline.backlog)))
+	pipeline.backlog = nil
+	pipeline.backlogMutex.Unlock()
+	stats := pipeline.GetStats()
+	logrus.Warningf("NotificationPipeline.Stop: Stopped. Received %d, processed %d, dropped %d, discarded %d notifications",
+		stats.Received, stats.Processed, stats.Dropped, stats.Discarded)
+}
+
+// GetStats returns the pipeline counters
+func (pipeline *NotificationPipeline) GetStats() NotificationStats {
+	pipeline.backlogMutex.Lock()
+	backlog := len(pipeline.backlog)
+	pipeline.backlogMutex.Unlock()
+	return NotificationStats{
+		Received:    atomic.LoadUint64(&pipeline.received),
+		Processed:   atomic.LoadUint64(&pipeline.processed),
+		Dropped:     atomic.LoadUint64(&pipeline.dropped),
+		Discarded:   atomic.LoadUint64(&pipeline.discarded),
+		QueueLength: len(pipeline.queue),
+		QueueSize:   cap(pipeline.queue),
+		Backlog:     backlog,
+	}
+}
+
+// dispatchLoop passes queued notifications to the worker of their node until the queue is closed
+func (pipeline *NotificationPipeline) dispatchLoop() {
+	defer pipeline.done.Done()
+	for notification := range pipeline.queue {
+		select {
+		case <-pipeline.stop:
+			atomic.AddUint64(&pipeline.discarded, 1)
+			continue
+		default:
+		}
+		if isBarrier(notification) {
+			// wait for the notifications before it to complete
+			pipeline.inFlight.Wait()
+			pipeline.handle(notification)
+			continue
+		}
+		workerIndex := (notification.HomeID + uint32(notification.NodeID)) % uint32(len(pipeline.workers))
+		pipeline.inFlight.Add(1)
+		pipeline.workers[workerIndex] <- notification
+	}
+	for _, workerQueue := range pipeline.workers {
+		close(workerQueue)
+	}
+}
+
+// workerLoop processes the notifications of a worker queue until it is closed
+func (pipeline *NotificationPipeline) workerLoop(workerQueue chan *goopenzwave.Notification) {
+	defer pipeline.done.Done()
+	for notification := range workerQueue {
+		select {
+		case <-pipeline.stop:
+			atomic.AddUint64(&pipeline.discarded, 1)
+		default:
+			pipeline.handle(notification)
+		}
+		pipeline.inFlight.Done()
+	}
+}
+
+// handle invokes the handler and counts the notification
+func (pipeline *NotificationPipeline) handle(notification *goopenzwave.Notification) {
+	pipeline.handler(notification)
+	atomic.AddUint64(&pipeline.processed, 1)
+}
+
+// NewNotificationPipeline creates a notification pipeline that invokes the handler for each notification.
+// Use 0 for the queue size and worker count to use the defaults. Use Start to start processing.
+func NewNotificationPipeline(queueSize int, workerCount int, handler func(*goopenzwave.Notification)) *NotificationPipeline {
+	if queueSize <= 0 {
+		queueSize = DefaultNotificationQueueSize
+	}
+	if workerCount <= 0 {
+		workerCount = DefaultNotificationWorkers
+	}
+	pipeline := &NotificationPipeline{
+		queue:        make(chan *goopenzwave.Notification, queueSize),
+		workers:      make([]chan *goopenzwave.Notification, workerCount),
+		handler:      handler,
+		stop:         make(chan bool),
+		backlogReady: make(chan bool, 1),
+	}
+	for index := range pipeline.workers {
+		// a small worker queue keeps the backlog in the bounded main queue
+		pipeline.workers[index] = make(chan *goopenzwave.Notification, 16)
+	}
+	return pipeline
+}
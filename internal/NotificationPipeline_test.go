@@ -0,0 +1,174 @@
+package internal_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeTestNotification returns a value changed notification for a node with the sequence nr as value ID
+func makeTestNotification(nodeID uint8, sequence uint64) *goopenzwave.Notification {
+	return &goopenzwave.Notification{
+		Type:    goopenzwave.NotificationTypeValueChanged,
+		HomeID:  testHomeID,
+		NodeID:  nodeID,
+		ValueID: &goopenzwave.ValueID{HomeID: testHomeID, NodeID: nodeID, ID: sequence},
+	}
+}
+
+func TestNotificationPipelineNodeOrder(t *testing.T) {
+	const nodeCount = 10
+	const perNode = 200
+	mutex := sync.Mutex{}
+	sequenceByNode := make(map[uint8][]uint64)
+	pipeline := internal.NewNotificationPipeline(nodeCount*perNode, 4, func(notification *goopenzwave.Notification) {
+		mutex.Lock()
+		sequenceByNode[notification.NodeID] = append(sequenceByNode[notification.NodeID], notification.ValueID.ID)
+		mutex.Unlock()
+	})
+	pipeline.Start()
+	for sequence := uint64(0); sequence < perNode; sequence++ {
+		for nodeID := uint8(1); nodeID <= nodeCount; nodeID++ {
+			assert.True(t, pipeline.Submit(makeTestNotification(nodeID, sequence)))
+		}
+	}
+	assert.True(t, waitFor(func() bool {
+		return pipeline.GetStats().Processed == nodeCount*perNode
+	}, 5*time.Second))
+	pipeline.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for nodeID := uint8(1); nodeID <= nodeCount; nodeID++ {
+		sequence := sequenceByNode[nodeID]
+		assert.Len(t, sequence, perNode)
+		for index, valueID := range sequence {
+			assert.Equal(t, uint64(index), valueID, "node %d notifications out of order", nodeID)
+		}
+	}
+	stats := pipeline.GetStats()
+	assert.Equal(t, uint64(nodeCount*perNode), stats.Received)
+	assert.Equal(t, uint64(0), stats.Dropped)
+}
+
+func TestNotificationPipelineBarrier(t *testing.T) {
+	mutex := sync.Mutex{}
+	handledBeforeBarrier := 0
+	handledCount := 0
+	pipeline := internal.NewNotificationPipeline(100, 4, func(notification *goopenzwave.Notification) {
+		if notification.Type == goopenzwave.NotificationTypeAllNodesQueried {
+			mutex.Lock()
+			handledBeforeBarrier = handledCount
+			mutex.Unlock()
+			return
+		}
+		// slow node handling
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		handledCount++
+		mutex.Unlock()
+	})
+	pipeline.Start()
+	for nodeID := uint8(1); nodeID <= 20; nodeID++ {
+		pipeline.Submit(makeTestNotification(nodeID, 1))
+	}
+	pipeline.Submit(&goopenzwave.Notification{Type: goopenzwave.NotificationTypeAllNodesQueried, HomeID: testHomeID, NodeID: 1})
+	assert.True(t, waitFor(func() bool { return pipeline.GetStats().Processed == 21 }, 5*time.Second))
+	pipeline.Stop()
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, 20, handledBeforeBarrier, "all nodes must be handled before the barrier")
+}
+
+func TestNotificationPipelineOverflowAndStop(t *testing.T) {
+	release := make(chan bool)
+	handling := make(chan bool, 1)
+	pipeline := internal.NewNotificationPipeline(5, 1, func(notification *goopenzwave.Notification) {
+		handling <- true
+		<-release
+	})
+	pipeline.Start()
+	// the worker blocks, so the queue fills up without blocking the submitter
+	assert.True(t, pipeline.Submit(makeTestNotification(1, 0)))
+	<-handling
+	accepted := 1
+	start := time.Now()
+	for sequence := uint64(1); sequence < 100; sequence++ {
+		if pipeline.Submit(makeTestNotification(1, sequence)) {
+			accepted++
+		}
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	stats := pipeline.GetStats()
+	assert.Equal(t, uint64(100), stats.Received)
+	assert.Equal(t, uint64(100-accepted), stats.Dropped)
+	assert.True(t, stats.Dropped > 0)
+
+	// stopping completes the notification being handled and discards the rest
+	stopped := make(chan bool)
+	go func() {
+		pipeline.Stop()
+		close(stopped)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	<-stopped
+	stats = pipeline.GetStats()
+	assert.Equal(t, uint64(1), stats.Processed)
+	assert.Equal(t, uint64(accepted-1), stats.Discarded)
+
+	// submitting after stop must not panic
+	assert.False(t, pipeline.Submit(makeTestNotification(1, 1000)))
+	assert.Equal(t, uint64(accepted), pipeline.GetStats().Discarded)
+	pipeline.Stop()
+}
+
+func TestNotificationPipelineBacklog(t *testing.T) {
+	release := make(chan bool)
+	handling := make(chan bool, 1)
+	mutex := sync.Mutex{}
+	handledTypes := make([]goopenzwave.NotificationType, 0)
+	pipeline := internal.NewNotificationPipeline(2, 1, func(notification *goopenzwave.Notification) {
+		select {
+		case handling <- true:
+		default:
+		}
+		<-release
+		mutex.Lock()
+		handledTypes = append(handledTypes, notification.Type)
+		mutex.Unlock()
+	})
+	pipeline.Start()
+	assert.True(t, pipeline.Submit(makeTestNotification(1, 0)))
+	<-handling
+	for sequence := uint64(1); sequence < 20; sequence++ {
+		pipeline.Submit(makeTestNotification(1, sequence))
+	}
+	// lifecycle notifications are never dropped, while value notifications after them are
+	removed := &goopenzwave.Notification{Type: goopenzwave.NotificationTypeNodeRemoved, HomeID: testHomeID, NodeID: 5}
+	ready := &goopenzwave.Notification{Type: goopenzwave.NotificationTypeDriverReady, HomeID: testHomeID, NodeID: 1}
+	assert.True(t, pipeline.Submit(removed))
+	assert.False(t, pipeline.Submit(makeTestNotification(1, 20)))
+	assert.True(t, pipeline.Submit(ready))
+	stats := pipeline.GetStats()
+	assert.Equal(t, 2, stats.Backlog)
+	assert.True(t, stats.Dropped > 0)
+
+	close(release)
+	assert.True(t, waitFor(func() bool {
+		stats := pipeline.GetStats()
+		return stats.Backlog == 0 && stats.QueueLength == 0 && stats.Processed+stats.Dropped == stats.Received
+	}, 5*time.Second))
+	pipeline.Stop()
+	mutex.Lock()
+	defer mutex.Unlock()
+	count := len(handledTypes)
+	if assert.True(t, count >= 2) {
+		assert.Equal(t, goopenzwave.NotificationTypeNodeRemoved, handledTypes[count-2])
+		assert.Equal(t, goopenzwave.NotificationTypeDriverReady, handledTypes[count-1])
+	}
+}
@@ -3,23 +3,44 @@
 package internal
 
 import (
-	"os"
-	"syscall"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/iotdomain/iotdomain-go/lib"
 	"github.com/iotdomain/iotdomain-go/publisher"
 	"github.com/iotdomain/iotdomain-go/types"
-	"github.com/jimjibone/goopenzwave"
 	"github.com/sirupsen/logrus"
 )
 
 // OpenZwaveAppConfig contains the openzwave publisher configuration
 type OpenZwaveAppConfig struct {
-	Gateway         string          `yaml:"gateway"`       // Gateway device
-	IncludeZwInfo   bool            `yaml:"includeZWInfo"` // Include ZWave attributes in device and sensor info
-	IgnoreList      map[string]bool // Noisy OpenZWave outputs to ignore
-	OzwLogLevel     string          `yaml:"ozwLogLevel"` // default is warn
-	OzwConfigFolder string          `yaml:"ozwConfigFolder"`
-	OzwEnableSIS    bool            `yaml:"ozwEnableSIS"` // Controller is Static ID Server
+	Gateway               string          `yaml:"gateway"`       // Gateway device or tcp://host:port of a serial server
+	Gateways              []string        `yaml:"gateways"`      // Gateway devices when using multiple controllers
+	GatewaySerial         string          `yaml:"gatewaySerial"` // Serial number of the USB controller to use
+	IncludeZwInfo         bool            `yaml:"includeZWInfo"` // Include ZWave attributes in device and sensor info
+	IgnoreList            map[string]bool // Noisy OpenZWave outputs to ignore
+	OzwLogLevel           string          `yaml:"ozwLogLevel"` // default is warn
+	OzwConfigFolder       string          `yaml:"ozwConfigFolder"`
+	OzwUserFolder         string          `yaml:"ozwUserFolder"`         // Folder of the openzwave network cache, "" for the working directory
+	OzwEnableSIS          bool            `yaml:"ozwEnableSIS"`          // Controller is Static ID Server
+	NetworkKey            string          `yaml:"networkKey"`            // Openzwave network key for secure inclusion, eg "0x01, 0x02, ..."
+	BackupNetworkKey      bool            `yaml:"backupNetworkKey"`      // Include the network key in network backups
+	Profiles              []ConfigProfile `yaml:"profiles"`              // Configuration profiles to apply to nodes by model
+	CacheFolder           string          `yaml:"cacheFolder"`           // Folder for exports, shared with the publisher cache
+	PollInterval          int             `yaml:"pollInterval"`          // Interval in seconds to poll values with polling enabled
+	IntervalBetweenPolls  bool            `yaml:"intervalBetweenPolls"`  // Poll interval is the time between polls of individual values
+	PollIntensity         uint8           `yaml:"pollIntensity"`         // Poll intensity of outputs that aren't configured, 0 to not poll
+	NotificationQueueSize int             `yaml:"notificationQueueSize"` // Max nr of notifications waiting to be handled
+	NotificationWorkers   int             `yaml:"notificationWorkers"`   // Nr of nodes whose notifications are handled concurrently
+	StartupPhase          string          `yaml:"startupPhase"`          // Controller phase Start waits for, "" to not wait
+	StartupTimeout        int             `yaml:"startupTimeout"`        // Max wait in seconds for the startup phase
+	PingInterval          int             `yaml:"pingInterval"`          // Seconds of silence before a listening node is pinged, -1 to disable
+	SilenceTimeout        int             `yaml:"silenceTimeout"`        // Seconds of silence before a listening node is lost
+	StatisticsInterval    int             `yaml:"statisticsInterval"`    // Seconds between publishing statistics, -1 to disable
+	MetricsAddress        string          `yaml:"metricsAddress"`        // Listen address of the Prometheus metrics endpoint, "" to disable
+	APIAddress            string          `yaml:"apiAddress"`            // Listen address of the HTTP API, eg localhost:9292. "" to disable
+	APIToken              string          `yaml:"apiToken"`              // Token that API requests must include, "" for no token
 }
 
 // OpenZWaveApp main class
@@ -29,12 +50,24 @@ type OpenZWaveApp struct {
 	gwHWID string // the gateway node HWID to use
 
 	ozwAPI            *OzwAPI
-	ozwHomeID         uint32                          // OZW Node ID
-	attrNameByValueID map[uint64]types.NodeAttr       // identify attr and config from OZW value IDs
-	inputIDByValueID  map[uint64]string               // input ID by zw value ID. For actuator update from OZW
-	outputIDByValueID map[uint64]string               // output ID by zw valueID
-	valueIDByInputID  map[string]uint64               // zw value ID by input ID. For switches updates from mqtt bus
-	zwValueByAttrID   map[string]*goopenzwave.ValueID // determine ZWValue for config command
+	values            *ValueRegistry            // inputs, outputs and configuration of zwave values
+	removals          *PendingRemovals          // node removals requested through the controller
+	resets            *ResetConfirmations       // hard reset requests waiting for confirmation
+	replacements      *NodeReplacements         // replacements of failed nodes
+	provisioning      *ProvisioningList         // devices provisioned for inclusion
+	liveness          *NodeLiveness             // last seen of nodes
+	commStats         *CommStatistics           // messages sent to and received from nodes
+	metrics           *Metrics                  // notification and command metrics
+	metricsServer     *http.Server              // metrics endpoint, nil if disabled
+	apiServer         *http.Server              // HTTP API, nil if disabled
+	profileByNodeHWID map[string]*ConfigProfile // configuration profile applied to a node
+
+	pollIntensityByOutputID map[string]uint8  // saved poll intensity of outputs
+	commandNameByHomeID     map[uint32]string // last controller command started in a network
+	updateMutex             sync.Mutex        // notifications of different nodes are handled concurrently
+
+	stopSupervisor chan bool      // stop the controller supervisor
+	supervisorWG   sync.WaitGroup // controller supervisors have stopped
 }
 
 // Application constants
@@ -43,7 +76,8 @@ const (
 	DefaultNetworkPassword   = "My name is groot"                             // Default password used to generate network key
 	DefaultOzwConfigFolder   = "/usr/local/etc/openzwave"                     // Default path to installed openzwave configuration
 	DefaultIgnoreNoisyValues = "Exporting, Color, Previous Reading, Interval" // Zwave reported values to ignore
-	CheckAliveInterval       = 10
+	CheckAliveInterval       = 10                                             // Controller liveness check interval in seconds
+	DefaultStartupTimeout    = 300                                            // Default max wait in seconds for the startup phase
 )
 
 // configuration attributes
@@ -53,7 +87,7 @@ const (
 	OzwAttrNameIncludeZWInfo   = "includezwinfo"
 )
 
-// GateWayAddresses list of USB controller addresses to check
+// GateWayAddresses list of USB controller addresses to check on systems without /dev/serial/by-id
 var GateWayAddresses = []string{
 	"/dev/ttyACM0",
 	"/dev/ttyACM1",
@@ -61,30 +95,6 @@ var GateWayAddresses = []string{
 	"/dev/ttyUSB1",
 }
 
-// CheckAlive checks if openzwave controller can still be reached
-func (app *OpenZWaveApp) CheckAlive() {
-	isAlive := app.ozwAPI.IsAlive()
-	if !isAlive {
-		logrus.Error("OpenZWaveAdapter.CheckAlive. ZWave Controller Connection Lost. Stopping...")
-		// Controller connection dropped. Restart needed. (when used with daemon)
-		syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-	}
-}
-
-// GetUsbStickAddress determines the most likely gateway (USB) address
-func (app *OpenZWaveApp) GetUsbStickAddress() string {
-	for index := 0; index < len(GateWayAddresses); index++ {
-		addr := GateWayAddresses[index]
-		if _, err := os.Stat(addr); err == nil {
-			logrus.Infof("OpenZWaveAdapter.GetUsbStickAddress. Scanning for possible USB port %s. Found!", addr)
-			return addr
-		}
-		logrus.Infof("OpenZWaveAdapter.GetUsbStickAddress. Scanning for possible USB port %s. Not found", addr)
-	}
-	logrus.Fatal("OpenZWaveAdapter.GetUsbStickAddress. No USB port found. Unable to proceed.")
-	return ""
-}
-
 // LoadConfiguration and update logging and mqtt base URL from configuration
 // Set config defaults
 // func (app *OpenZWaveApp) LoadConfiguration(configFolder string) error {
@@ -141,39 +151,95 @@ func (app *OpenZWaveApp) GetUsbStickAddress() string {
 // 	return nil
 // }
 
+// getOzwConfigFolder returns the openzwave configuration folder with the device database
+func (app *OpenZWaveApp) getOzwConfigFolder() string {
+	if app.config.OzwConfigFolder != "" {
+		return app.config.OzwConfigFolder
+	}
+	return DefaultOzwConfigFolder
+}
+
+// getOzwUserFolder returns the openzwave user folder. Openzwave keeps its network cache here.
+// The default "" is the working directory.
+func (app *OpenZWaveApp) getOzwUserFolder() string {
+	return app.config.OzwUserFolder
+}
+
 // Start the adapter
 // This loads the configuration and connect to the zwave controller
+// If a startup phase is configured this waits until all controllers have reached it. See WaitForPhase.
 func (app *OpenZWaveApp) Start() error {
 	logrus.Warningf("OpenZWaveApp.Start: Starting adapter openzwave")
+	var startupPhase ControllerPhase
+	if app.config.StartupPhase != "" {
+		phase, err := ParseControllerPhase(app.config.StartupPhase)
+		if err != nil {
+			logrus.Errorf("OpenZWaveApp.Start: %v", err)
+			return err
+		}
+		startupPhase = phase
+	}
 
-	// configuration allows to select a USB device /dev/ttyACM0 or other. Default is search.
-	gateWayAddress := app.config.Gateway
-	if gateWayAddress == "" {
-		gateWayAddress = app.GetUsbStickAddress()
+	// configuration allows to select a USB device /dev/ttyACM0, a serial server or other. Default is search.
+	for _, controller := range app.ozwAPI.controllers {
+		if IsTCPGateway(controller.gateway) {
+			controller.tcpBridge = NewTCPSerialBridge(controller.gateway)
+			_, err := controller.tcpBridge.Start()
+			if err != nil {
+				logrus.Errorf("OpenZWaveApp.Start: %v", err)
+				app.pub.SetPublisherStatus(types.PublisherRunStateFailed)
+				return err
+			}
+		}
+	}
+	for _, controller := range app.ozwAPI.controllers {
+		// the driver of a bridged controller is added once the bridge is connected to the serial server
+		if controller.tcpBridge != nil && !controller.tcpBridge.WaitForConnection(TCPBridgeDialTimeout*time.Second) {
+			logrus.Warningf("OpenZWaveApp.Start: Bridge to '%s' isn't connected", controller.gateway)
+		}
+		address := app.FindGatewayAddress(controller)
+		app.ozwAPI.SetControllerAddress(controller, address)
+		if address == "" {
+			// the supervisor waits for the controller to appear
+			logrus.Warningf("OpenZWaveApp.Start: Controller '%s' not found. Waiting for controller.", controller.gateway)
+		}
 	}
 	ozwLogLevel := app.config.OzwLogLevel
 	if ozwLogLevel == "" {
 		ozwLogLevel = "warning"
 	}
-	ozwConfigFolder := app.config.OzwConfigFolder
-	if ozwConfigFolder == "" {
-		ozwConfigFolder = DefaultOzwConfigFolder
-	}
+	ozwConfigFolder := app.getOzwConfigFolder()
 	ozwEnableSIS := app.config.OzwEnableSIS
-	logrus.Infof("OpenZWaveApp> Configuring openzwave. Address=%s, loglevel=%s, configfolder=%s, enableSIS=%v",
-		gateWayAddress, ozwLogLevel, ozwConfigFolder, ozwEnableSIS)
+	logrus.Infof("OpenZWaveApp> Configuring openzwave. Gateways=%v, loglevel=%s, configfolder=%s, enableSIS=%v, pollInterval=%d",
+		app.GetGatewayAddresses(), ozwLogLevel, ozwConfigFolder, ozwEnableSIS, app.config.PollInterval)
+	err := app.LoadPollingConfig()
+	if err != nil {
+		// outputs use the default poll intensity
+		logrus.Errorf("OpenZWaveApp.Start: %v", err)
+	}
+	app.LoadProvisioningList()
+	app.publishProvisioningList()
 
 	// Start publishing and listening
 	app.pub.Start()
+	if app.config.MetricsAddress != "" {
+		app.StartMetricsServer(app.config.MetricsAddress)
+	}
+	if app.config.APIAddress != "" {
+		app.StartAPIServer(app.config.APIAddress)
+	}
 
+	app.publishControllerPhase(0)
 	// app.pub.UpdateNodeStatus(gwID, types.PublisherStateInitializing)
 	app.pub.SetPublisherStatus(types.PublisherRunStateInitializing)
 	//
-	err := app.ozwAPI.Connect(
-		gateWayAddress,
+	err = app.ozwAPI.Connect(
 		ozwLogLevel,
 		ozwConfigFolder,
+		app.getOzwUserFolder(),
 		ozwEnableSIS,
+		app.config.PollInterval,
+		app.config.IntervalBetweenPolls,
 		app.ZWaveNotification)
 
 	if err != nil {
@@ -182,7 +248,20 @@ func (app *OpenZWaveApp) Start() error {
 		//adapter.UpdateLastSeen(adapter.GatewayNode)
 		//adapter.publisher.PublishDeviceStatus(myzone.PublisherNode)
 	} else {
-		app.pub.SetPublisherStatus(types.PublisherRunStateConnected)
+		// the status changes to connected when the drivers are ready
+		app.updatePublisherRunState()
+		app.StartSupervisor()
+		if startupPhase != "" {
+			timeout := app.config.StartupTimeout
+			if timeout <= 0 {
+				timeout = DefaultStartupTimeout
+			}
+			logrus.Infof("OpenZWaveApp.Start: Waiting up to %d seconds for phase %s", timeout, startupPhase)
+			err = app.WaitForPhase(startupPhase, time.Duration(timeout)*time.Second)
+			if err != nil {
+				logrus.Errorf("OpenZWaveApp.Start: Controllers did not reach phase %s: %v", startupPhase, err)
+			}
+		}
 	}
 	return err
 }
@@ -191,7 +270,17 @@ func (app *OpenZWaveApp) Start() error {
 func (app *OpenZWaveApp) Stop() {
 	logrus.Warningf("OpenZWaveApp.Stop: Stopping openzwave")
 
+	app.StopSupervisor()
+	app.StopMetricsServer()
+	app.StopAPIServer()
 	app.ozwAPI.Disconnect()
+	for _, controller := range app.ozwAPI.controllers {
+		if controller.tcpBridge != nil {
+			controller.tcpBridge.Stop()
+		}
+	}
+	// the nodes still exist but can't be reached while stopped
+	app.MarkNodesLost("Publisher stopped")
 	app.pub.SetPublisherStatus(types.PublisherRunStateDisconnected)
 	app.pub.Stop()
 }
@@ -208,38 +297,119 @@ func (app *OpenZWaveApp) SetupGatewayNode() *types.NodeDiscoveryMessage {
 
 	// Create new or use existing instance
 	gatewayNode := pub.CreateNode(gwID, types.NodeTypeGateway)
+	app.createProvisioningInputs(gwID)
 	return gatewayNode
 }
 
 // NewOpenZwaveApp returns a new uninitialized instance of the publisher
 func NewOpenZwaveApp(config *OpenZwaveAppConfig, pub *publisher.Publisher) *OpenZWaveApp {
 	ozwAPI := NewOzwAPI()
+	pingInterval := config.PingInterval
+	if pingInterval == 0 {
+		pingInterval = DefaultPingInterval
+	}
+	silenceTimeout := config.SilenceTimeout
+	if silenceTimeout <= 0 {
+		silenceTimeout = 3 * pingInterval
+	}
 	app := &OpenZWaveApp{
 		config: config,
 		// ignoreList: make(map[string]bool),
 		pub:               pub,
 		ozwAPI:            ozwAPI,
-		attrNameByValueID: map[uint64]types.NodeAttr{},       // identify attr and config from OZW value IDs
-		inputIDByValueID:  map[uint64]string{},               // input ID by zw value ID. For actuator update from OZW
-		outputIDByValueID: map[uint64]string{},               // output ID by zw valueID
-		valueIDByInputID:  map[string]uint64{},               // zw value ID by input ID. For switches updates from mqtt bus
-		zwValueByAttrID:   map[string]*goopenzwave.ValueID{}, // determine ZWValue for config command
+		values:            NewValueRegistry(),
+		removals:          NewPendingRemovals(RemovalConfirmTimeout * time.Second),
+		resets:            NewResetConfirmations(ResetConfirmTimeout * time.Second),
+		replacements:      NewNodeReplacements(ReplaceCommandTimeout * time.Second),
+		provisioning:      NewProvisioningList(ProvisionedInclusionTimeout * time.Second),
+		commStats:         NewCommStatistics(),
+		metrics:           NewMetrics(),
+		liveness:          NewNodeLiveness(time.Duration(pingInterval)*time.Second, time.Duration(silenceTimeout)*time.Second),
+		profileByNodeHWID: map[string]*ConfigProfile{}, // configuration profile applied to a node
+
+		pollIntensityByOutputID: map[string]uint8{},
+		commandNameByHomeID:     map[uint32]string{},
 	}
 
+	for _, gateway := range app.GetGatewayAddresses() {
+		ozwAPI.AddController(gateway)
+	}
+	ozwAPI.networkKey = config.NetworkKey
+	ozwAPI.notificationQueue = config.NotificationQueueSize
+	ozwAPI.notificationWorkers = config.NotificationWorkers
 	pub.SetNodeConfigHandler(app.HandleConfigCommand)
 
 	app.SetupGatewayNode()
 	return app
 }
 
-// Run the publisher until the SIGTERM  or SIGINT signal is received
-func Run() {
+// RunOptions contains the command line options for running the publisher
+type RunOptions struct {
+	ConfigFolder string        // folder with openzwave.yaml and messenger.yaml, "" for default
+	Gateway      string        // gateway device, overrides the configuration
+	LogLevel     string        // publisher logging level, overrides the configuration
+	Once         bool          // exit after the initial node discovery has completed
+	Phase        string        // controller phase that completes the node discovery in once mode, "" for ready
+	Timeout      time.Duration // max wait for the initial node discovery in once mode
+}
+
+// Exit codes returned by Run
+const (
+	ExitCodeOK           = 0 // Normal exit
+	ExitCodeConfigError  = 1 // Configuration could not be loaded
+	ExitCodeDriverFailed = 2 // Openzwave or the controller driver failed
+	ExitCodeTimeout      = 3 // Initial node discovery did not complete in time
+)
+
+// getExitCode returns the exit code for an error of starting the driver or waiting for a controller phase
+func getExitCode(err error) int {
+	if err == nil {
+		return ExitCodeOK
+	} else if err == ErrStartupTimeout {
+		return ExitCodeTimeout
+	}
+	return ExitCodeDriverFailed
+}
+
+// Run the publisher and the zwave driver until the SIGTERM or SIGINT signal is received, or in once mode
+// until the initial node discovery has completed. Returns the exit code.
+func Run(options RunOptions) int {
 	appConfig := &OpenZwaveAppConfig{}
-	// Load the appConfig from <AppID>.yaml from the default config folder (~/.config/iotdomain)
-	pub, _ := publisher.NewAppPublisher(AppID, "", appConfig, "", true)
-	NewOpenZwaveApp(appConfig, pub)
+	// Load the appConfig from <AppID>.yaml from the config folder (default ~/.config/iotdomain)
+	pub, err := publisher.NewAppPublisher(AppID, options.ConfigFolder, appConfig, "", true)
+	if err != nil {
+		logrus.Errorf("Run: Failed loading configuration: %v", err)
+		return ExitCodeConfigError
+	}
+	if options.LogLevel != "" {
+		lib.SetLogging(options.LogLevel, "")
+	}
+	if options.Gateway != "" {
+		appConfig.Gateway = options.Gateway
+		appConfig.Gateways = nil
+	}
+	phase := ControllerPhaseReady
+	if options.Once && options.Phase != "" {
+		phase, err = ParseControllerPhase(options.Phase)
+		if err != nil {
+			logrus.Errorf("Run: %v", err)
+			return ExitCodeConfigError
+		}
+	}
+	app := NewOpenZwaveApp(appConfig, pub)
 
-	pub.Start()
-	pub.WaitForSignal()
-	pub.Stop()
+	err = app.Start()
+	if err != nil {
+		app.Stop()
+		return getExitCode(err)
+	}
+	exitCode := ExitCodeOK
+	if options.Once {
+		err = app.WaitForPhase(phase, options.Timeout)
+		exitCode = getExitCode(err)
+	} else {
+		pub.WaitForSignal()
+	}
+	app.Stop()
+	return exitCode
 }
@@ -2,6 +2,9 @@ package internal_test
 
 import (
 	// "myzone/adapters/openzwave"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -9,6 +12,7 @@ import (
 	"github.com/iotdomain/iotdomain-go/publisher"
 	"github.com/iotdomain/openzwave/internal"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const TestConfigFolder = "../test"
@@ -16,6 +20,24 @@ const TestConfigFolder = "../test"
 var messengerConfig = &messaging.MessengerConfig{Domain: "test"}
 var appConfig = &internal.OpenZwaveAppConfig{}
 
+// newTestPublisher creates a publisher with the configuration of the test folder in a temporary folder
+// The publisher identity, discovered nodes and files of the app are saved in the temporary folder instead
+// of the test folder. The caller removes the returned folder.
+func newTestPublisher(t *testing.T) (*internal.OpenZwaveAppConfig, *publisher.Publisher, string) {
+	testFolder, err := ioutil.TempDir("", "openzwave-test")
+	require.NoError(t, err)
+	for _, name := range []string{"messenger.yaml", internal.AppID + ".yaml"} {
+		content, err := ioutil.ReadFile(path.Join(TestConfigFolder, name))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(testFolder, name), content, 0644))
+	}
+	config := &internal.OpenZwaveAppConfig{}
+	pub, err := publisher.NewAppPublisher(internal.AppID, testFolder, config, testFolder, false)
+	require.NoError(t, err)
+	config.CacheFolder = testFolder
+	return config, pub, testFolder
+}
+
 func TestLoadConfig1(t *testing.T) {
 	pub, err := publisher.NewAppPublisher(internal.AppID, TestConfigFolder, appConfig, TestConfigFolder, true)
 	app := internal.NewOpenZwaveApp(appConfig, pub)
@@ -38,3 +60,31 @@ func TestStartStop(t *testing.T) {
 	t.Log("Stopping openzwave")
 	app.Stop()
 }
+
+func TestRunConfigError(t *testing.T) {
+	testFolder, err := ioutil.TempDir("", "openzwave-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(testFolder)
+
+	// the configuration folder has no messenger configuration
+	options := internal.RunOptions{ConfigFolder: testFolder, Once: true, Timeout: time.Second}
+	assert.Equal(t, internal.ExitCodeConfigError, internal.Run(options))
+}
+
+func TestWaitForStartup(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	app := internal.NewOpenZwaveApp(config, pub)
+
+	// without a controller the initial node discovery doesn't complete
+	err := app.WaitForStartup(10 * time.Millisecond)
+	assert.Equal(t, internal.ErrStartupTimeout, err)
+}
+func TestRunInvalidPhase(t *testing.T) {
+	_, _, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+
+	// the phase is validated before the driver is started
+	options := internal.RunOptions{ConfigFolder: testFolder, Once: true, Phase: "bogus", Timeout: time.Second}
+	assert.Equal(t, internal.ExitCodeConfigError, internal.Run(options))
+}
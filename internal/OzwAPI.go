@@ -2,8 +2,10 @@
 package internal
 
 import (
-	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jimjibone/goopenzwave"
 	"github.com/sirupsen/logrus"
@@ -11,36 +13,115 @@ import (
 
 // OzwAPI with openzwave API properties and methods
 type OzwAPI struct {
-	address string // OZW device address, eg /dev/ttyUSB0 or /dev/ttyACM0
+	controllers []*ZWaveController // controllers with a driver each
 	//sentinitialQueryComplete bool           // flag, the initial query has completed
-	isRunning           bool //
+	isRunning           int32 // 1 while running, accessed atomically
 	notificationHandler func(*OzwAPI, *goopenzwave.Notification)
 	networkKey          string // zwave network key
 
 	//initialQueryComplete chan bool                      // channel to publish init query has completed
-	notificationChan chan *goopenzwave.Notification // notification handling channel
-	homeID           uint32                         // controller home id set during discovery
-	nodeID           uint8                          // controller node id set during discovery
+	notifications       *NotificationPipeline // notification handling pipeline
+	notificationQueue   int                   // size of the notification queue, 0 for default
+	notificationWorkers int                   // nr of notification workers, 0 for default
+
+	stateMutex   sync.Mutex // guards the state of the controllers, see GetControllerState
+	phaseChanged chan bool  // closed and replaced when a controller phase changes
+}
+
+// AddController adds a controller for the given gateway address before connecting
+// The address is set when the controller is found, see AddDriver.
+func (ozwAPI *OzwAPI) AddController(gateway string) *ZWaveController {
+	controller := &ZWaveController{gateway: gateway, phase: ControllerPhaseStarting}
+	ozwAPI.controllers = append(ozwAPI.controllers, controller)
+	return controller
+}
+
+// GetControllerState returns a snapshot of the state of a controller
+// The state is updated by the notification workers, the supervisors and the management commands.
+func (ozwAPI *OzwAPI) GetControllerState(controller *ZWaveController) ZWaveControllerState {
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	return ZWaveControllerState{
+		Address:      controller.address,
+		HomeID:       controller.homeID,
+		NodeID:       controller.nodeID,
+		DriverFailed: controller.driverFailed,
+		IsLost:       controller.isLost,
+		Phase:        controller.phase,
+	}
+}
+
+// SetControllerAddress sets the device address of a controller before connecting, "" if it isn't found
+// See also AddDriver.
+func (ozwAPI *OzwAPI) SetControllerAddress(controller *ZWaveController, address string) {
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	controller.address = address
+}
+
+// SetControllerLost marks the controller as lost while it is reconnecting. See ReconnectController.
+func (ozwAPI *OzwAPI) SetControllerLost(controller *ZWaveController, isLost bool) {
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	controller.isLost = isLost
+}
+
+// GetClaimedAddresses returns the device addresses in use by controllers other than the given controller
+func (ozwAPI *OzwAPI) GetClaimedAddresses(controller *ZWaveController) []string {
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	claimedAddresses := make([]string, 0)
+	for _, other := range ozwAPI.controllers {
+		if other != controller && other.address != "" {
+			claimedAddresses = append(claimedAddresses, other.address)
+		}
+	}
+	return claimedAddresses
+}
+
+// GetControllerByAddress returns the controller whose driver uses the given device address, or nil if not found
+func (ozwAPI *OzwAPI) GetControllerByAddress(address string) *ZWaveController {
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	for _, controller := range ozwAPI.controllers {
+		if controller.address != "" && controller.address == address {
+			return controller
+		}
+	}
+	return nil
+}
+
+// GetControllerByHomeID returns the controller of the network with the given home ID, or nil if not found
+func (ozwAPI *OzwAPI) GetControllerByHomeID(homeID uint32) *ZWaveController {
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	for _, controller := range ozwAPI.controllers {
+		if controller.homeID != 0 && controller.homeID == homeID {
+			return controller
+		}
+	}
+	return nil
 }
 
-// Connect the API to the device
-//
+// Connect the API to the controllers
+// This starts the openzwave library and adds a driver for each controller with an address.
 func (ozwAPI *OzwAPI) Connect(
-	address string,
 	logLevel string,
 	ozwConfigFolder string,
+	ozwUserFolder string,
 	enableSIS bool,
+	pollInterval int,
+	intervalBetweenPolls bool,
 	notificationHandler func(*OzwAPI, *goopenzwave.Notification)) error {
 
-	logrus.Warningf("OzwAPI.Connect: Connect to the OpenZwave library at %s and listen for notifications", address)
-	ozwAPI.address = address
+	logrus.Warningf("OzwAPI.Connect: Connect to the OpenZwave library with %d controller(s) and listen for notifications",
+		len(ozwAPI.controllers))
 	ozwAPI.notificationHandler = notificationHandler
 
 	// Setup the OpenZWave library.
 	// Todo, figure out the path after bundling
 	//configPath := "../../vendor/github.com/jimjibone/goopenzwave/.lib/etc/openzwave"
 	configPath := ozwConfigFolder
-	controllerPath := ozwAPI.address
 
 	ozwLogLevel := goopenzwave.LogLevelError
 	switch strings.ToLower(logLevel) {
@@ -56,11 +137,15 @@ func (ozwAPI *OzwAPI) Connect(
 		ozwLogLevel = goopenzwave.LogLevelNone
 	}
 
-	options := goopenzwave.CreateOptions(configPath, "", "")
+	// openzwave writes its network cache in the user folder
+	options := goopenzwave.CreateOptions(configPath, ozwUserFolder, "")
 	//options.AddOptionBool("Associate", true)  // auto associate controller with new nodes
 	//options.AddOptionInt("DumpTrigger", 4)
-	//options.AddOptionInt("PollInterval", 600)
-	//options.AddOptionBool("IntervalBetweenPolls", true)
+	if pollInterval > 0 {
+		// poll interval option is in msec
+		options.AddOptionInt("PollInterval", int32(pollInterval*1000))
+	}
+	options.AddOptionBool("IntervalBetweenPolls", intervalBetweenPolls)
 	//options.AddOptionBool("SaveConfiguration", true)
 	options.AddOptionBool("SuppressValueRefresh", false) // tell us the device is alive
 
@@ -72,30 +157,44 @@ func (ozwAPI *OzwAPI) Connect(
 	options.AddOptionString("NetworkKey", ozwAPI.networkKey, false)
 	options.Lock()
 
+	// Separate process to handle notifications
+	ozwAPI.notifications = NewNotificationPipeline(ozwAPI.notificationQueue, ozwAPI.notificationWorkers,
+		ozwAPI.handleNotification)
+	ozwAPI.notifications.Start()
+	atomic.StoreInt32(&ozwAPI.isRunning, 1)
+
 	// Start the library and listen for notifications.
 	err := goopenzwave.Start(
 		// NOTE: Stopping on breakpoints in this callback hangs the app. Pipe notifications through a channel, breakpoints
-		// in the channel handler work fine.
+		// in the channel handler work fine. The callback must not block the openzwave driver thread.
 		func(notification *goopenzwave.Notification) {
-			ozwAPI.notificationChan <- notification
+			ozwAPI.notifications.Submit(notification)
 		})
 
 	if err != nil {
 		logrus.Errorf("OzwAPI.Connect: ERROR: failed to start goopenzwave library: %v", err)
+		atomic.StoreInt32(&ozwAPI.isRunning, 0)
+		ozwAPI.notifications.Stop()
 		return err
 	}
 
-	// Add a driver using the supplied controller path.
-	err = goopenzwave.AddDriver(controllerPath)
-	if err != nil {
-		logrus.Errorf("OzwAPI.Connect: ERROR: failed to add goopenzwave driver: %v", err)
-		return err
+	// Add a driver for each controller using its controller path.
+	// Without controller the driver is added when the controller appears. See AddDriver.
+	for _, controller := range ozwAPI.controllers {
+		address := ozwAPI.GetControllerState(controller).Address
+		if address == "" {
+			ozwAPI.stateMutex.Lock()
+			controller.driverFailed = true
+			ozwAPI.stateMutex.Unlock()
+			continue
+		}
+		err = goopenzwave.AddDriver(address)
+		if err != nil {
+			logrus.Errorf("OzwAPI.Connect: ERROR: failed to add goopenzwave driver for %s: %v", address, err)
+			return err
+		}
 	}
 
-	// Separate process to handle notifications
-	ozwAPI.isRunning = true
-	go ozwAPI.handleNotificationLoop()
-
 	//// Wait here until the initial node query has completed. This can take a long time.
 	//<-ozwAPI.initialQueryComplete
 	//close(ozwAPI.initialQueryComplete)
@@ -111,93 +210,229 @@ func (ozwAPI *OzwAPI) Connect(
 }
 
 // Disconnect from the OpenZwave controller
+// Pending notifications are discarded, including those openzwave sends while stopping.
 func (ozwAPI *OzwAPI) Disconnect() {
-	ozwAPI.isRunning = false
+	atomic.StoreInt32(&ozwAPI.isRunning, 0)
+	if ozwAPI.notifications != nil {
+		ozwAPI.notifications.Stop()
+	}
 	err := goopenzwave.Stop()
 	if err != nil {
 		logrus.Errorf("OzwAPI.Disconnect Stopping goopenzwave error: %v", err)
 	}
 	goopenzwave.DestroyOptions()
-	close(ozwAPI.notificationChan)
 	logrus.Warningf("OzwAPI.Disconnect Stopping goopenzwave completed")
 }
 
-// listen for notifications from the channel
-func (ozwAPI *OzwAPI) handleNotificationLoop() {
-	logrus.Warnf("OzwAPI.handleNotificationLoop: starting listening for notifications")
+// IsRunning returns true while the openzwave library is running
+func (ozwAPI *OzwAPI) IsRunning() bool {
+	return atomic.LoadInt32(&ozwAPI.isRunning) == 1
+}
 
-	for ozwAPI.isRunning {
-		notification := <-ozwAPI.notificationChan
-		if notification == nil {
-			break
+// GetNotificationStats returns the counters of the notification pipeline
+func (ozwAPI *OzwAPI) GetNotificationStats() NotificationStats {
+	if ozwAPI.notifications == nil {
+		return NotificationStats{}
+	}
+	return ozwAPI.notifications.GetStats()
+}
+
+// handleNotification updates the controller state and passes the notification to the notification handler
+// This is invoked by the notification pipeline. Driver notifications are handled after the notifications
+// before them, so the controller state is consistent with the notifications that are handled.
+func (ozwAPI *OzwAPI) handleNotification(notification *goopenzwave.Notification) {
+	if notification.Type == goopenzwave.NotificationTypeDriverReady {
+		// the notification identifies the controller by its home ID only
+		address := goopenzwave.GetControllerPath(notification.HomeID)
+		controller := ozwAPI.GetControllerByAddress(address)
+		if controller == nil && len(ozwAPI.controllers) == 1 {
+			controller = ozwAPI.controllers[0]
 		}
-		if notification.Type == goopenzwave.NotificationTypeDriverReady {
-			ozwAPI.homeID = notification.HomeID
-			ozwAPI.nodeID = notification.NodeID
+		if controller != nil {
+			ozwAPI.stateMutex.Lock()
+			controller.homeID = notification.HomeID
+			controller.nodeID = notification.NodeID
+			ozwAPI.changeControllerPhase(controller, ControllerPhaseDriverReady)
+			ozwAPI.stateMutex.Unlock()
+		} else {
+			logrus.Errorf("OzwAPI.handleNotification: Driver ready for unknown controller %s", address)
 		}
-		//if !ozwAPI.sentinitialQueryComplete {
-		if notification.Type == goopenzwave.NotificationTypeAwakeNodesQueried ||
-			notification.Type == goopenzwave.NotificationTypeAllNodesQueried ||
-			notification.Type == goopenzwave.NotificationTypeAllNodesQueriedSomeDead {
-			// Finish the connect phase as the initial node query has completed or failed.
-			//ozwAPI.sentinitialQueryComplete = true
-			//ozwAPI.initialQueryComplete <- true
-		} else if notification.Type == goopenzwave.NotificationTypeDriverFailed {
-			logrus.Errorf("OzwAPI.handleNotificationLoop.OpenZwave Driver failed (missing device?)")
-			//ozwAPI.sentinitialQueryComplete = true
-			//ozwAPI.initialQueryComplete <- true
-			ozwAPI.isRunning = false
+	}
+	if notification.Type == goopenzwave.NotificationTypeAwakeNodesQueried {
+		ozwAPI.setControllerPhase(ozwAPI.GetControllerByHomeID(notification.HomeID), ControllerPhaseAwakeNodesQueried)
+	} else if notification.Type == goopenzwave.NotificationTypeAllNodesQueried {
+		ozwAPI.setControllerPhase(ozwAPI.GetControllerByHomeID(notification.HomeID), ControllerPhaseAllNodesQueried)
+	} else if notification.Type == goopenzwave.NotificationTypeAllNodesQueriedSomeDead {
+		ozwAPI.setControllerPhase(ozwAPI.GetControllerByHomeID(notification.HomeID), ControllerPhaseSomeDead)
+	} else if notification.Type == goopenzwave.NotificationTypeDriverReset {
+		// the controller is reset, its driver is restarted with the home ID of the new network
+		ozwAPI.setControllerPhase(ozwAPI.GetControllerByHomeID(notification.HomeID), ControllerPhaseStarting)
+	} else if notification.Type == goopenzwave.NotificationTypeDriverFailed {
+		logrus.Errorf("OzwAPI.handleNotification: OpenZwave Driver failed (missing device?)")
+		// keep listening, the driver can be added again when the device is back
+		ozwAPI.setDriverFailed(notification.HomeID)
+	}
+	// always handle the notification if there is one
+	ozwAPI.notificationHandler(ozwAPI, notification)
+}
+
+// setDriverFailed marks the controller of the failed driver
+// A driver that fails before it is ready has no home ID, so all controllers that are not ready are marked.
+func (ozwAPI *OzwAPI) setDriverFailed(homeID uint32) {
+	failedController := ozwAPI.GetControllerByHomeID(homeID)
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	for _, controller := range ozwAPI.controllers {
+		if controller == failedController || (failedController == nil && controller.homeID == 0) {
+			controller.driverFailed = true
+			ozwAPI.changeControllerPhase(controller, ControllerPhaseFailed)
 		}
-		//}
-		// always handle the notification if there is one
-		ozwAPI.notificationHandler(ozwAPI, notification)
 	}
-	logrus.Warnf("OzwAPI.handleNotificationLoop: Exiting notification listener")
+}
+
+// GetControllerPhase returns the current driver phase of a controller
+func (ozwAPI *OzwAPI) GetControllerPhase(controller *ZWaveController) ControllerPhase {
+	return ozwAPI.GetControllerState(controller).Phase
+}
+
+// setControllerPhase updates the driver phase of a controller and wakes up WaitForPhase
+// A nil controller is ignored. This happens for notifications of an unknown network.
+func (ozwAPI *OzwAPI) setControllerPhase(controller *ZWaveController, phase ControllerPhase) {
+	if controller == nil {
+		return
+	}
+	ozwAPI.stateMutex.Lock()
+	defer ozwAPI.stateMutex.Unlock()
+	ozwAPI.changeControllerPhase(controller, phase)
+}
+
+// changeControllerPhase updates the driver phase of a controller. The caller must hold the state mutex.
+func (ozwAPI *OzwAPI) changeControllerPhase(controller *ZWaveController, phase ControllerPhase) {
+	if controller.phase == phase {
+		return
+	}
+	logrus.Infof("OzwAPI.setControllerPhase: Controller '%s' phase %s -> %s", controller.gateway, controller.phase, phase)
+	controller.phase = phase
+	close(ozwAPI.phaseChanged)
+	ozwAPI.phaseChanged = make(chan bool)
+}
+
+// WaitForPhase waits until all controllers have reached the given phase
+// Returns nil when reached, ErrStartupTimeout when it took longer than timeout, or ErrDriverFailed when
+// a controller driver failed.
+func (ozwAPI *OzwAPI) WaitForPhase(phase ControllerPhase, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		ozwAPI.stateMutex.Lock()
+		phases := make([]ControllerPhase, 0, len(ozwAPI.controllers))
+		for _, controller := range ozwAPI.controllers {
+			phases = append(phases, controller.phase)
+		}
+		phaseChanged := ozwAPI.phaseChanged
+		ozwAPI.stateMutex.Unlock()
+
+		reached, err := IsPhaseReached(phases, phase)
+		if reached || err != nil {
+			return err
+		}
+		select {
+		case <-phaseChanged:
+		case <-timer.C:
+			return ErrStartupTimeout
+		}
+	}
+}
+
+// AddDriver adds the driver for the controller at the given address after it was removed.
+// Openzwave sends a DriverReady notification when the controller is ready. The address is cleared if the
+// driver can't be added.
+func (ozwAPI *OzwAPI) AddDriver(controller *ZWaveController, address string) error {
+	logrus.Warningf("OzwAPI.AddDriver: Adding driver for controller at %s", address)
+	ozwAPI.stateMutex.Lock()
+	controller.address = address
+	controller.driverFailed = false
+	ozwAPI.changeControllerPhase(controller, ControllerPhaseStarting)
+	ozwAPI.stateMutex.Unlock()
+	err := goopenzwave.AddDriver(address)
+	if err != nil {
+		logrus.Errorf("OzwAPI.AddDriver: ERROR: failed to add goopenzwave driver: %v", err)
+		ozwAPI.SetControllerAddress(controller, "")
+	}
+	return err
+}
+
+// RemoveDriver removes the driver of the controller and closes the connection to the controller.
+// The openzwave library keeps running so the driver can be added again.
+// The controller is back in the starting phase before the driver is removed, so the removal of its nodes and
+// values, including notifications that are still queued, doesn't delete the inputs and outputs.
+func (ozwAPI *OzwAPI) RemoveDriver(controller *ZWaveController) {
+	ozwAPI.stateMutex.Lock()
+	address := controller.address
+	if address != "" {
+		ozwAPI.changeControllerPhase(controller, ControllerPhaseStarting)
+	}
+	ozwAPI.stateMutex.Unlock()
+	if address == "" {
+		return
+	}
+	logrus.Warningf("OzwAPI.RemoveDriver: Removing driver for controller at %s", address)
+	err := goopenzwave.RemoveDriver(address)
+	if err != nil {
+		logrus.Warningf("OzwAPI.RemoveDriver: %v", err)
+	}
+	ozwAPI.stateMutex.Lock()
+	controller.address = ""
+	controller.homeID = 0
+	controller.nodeID = 0
+	ozwAPI.stateMutex.Unlock()
 }
 
 // GetSendQueueCount returns the nr of messages queued for sending
-func (ozwAPI *OzwAPI) GetSendQueueCount() int32 {
-	count := goopenzwave.GetSendQueueCount(ozwAPI.homeID)
-	logrus.Infof("OzwAPI.Send queue holds %d messages", count)
+func (ozwAPI *OzwAPI) GetSendQueueCount(homeID uint32) int32 {
+	count := goopenzwave.GetSendQueueCount(homeID)
+	logrus.Debugf("OzwAPI.GetSendQueueCount: Send queue holds %d messages", count)
 	return count
 }
 
 // AddControllerToOtherNetwork receives network configuration from primary controller
 // This is the same as 'set learn mode' and adds this controller to another network. The other network must have
 // add node activated for this controller to be included in its network.
-func (ozwAPI *OzwAPI) AddControllerToOtherNetwork() bool {
-	success := goopenzwave.ReceiveConfiguration(ozwAPI.homeID)
+func (ozwAPI *OzwAPI) AddControllerToOtherNetwork(homeID uint32) bool {
+	success := goopenzwave.ReceiveConfiguration(homeID)
 	logrus.Infof("OzwAPI.Start AddControllerToOtherNetwork (set learn mode): %v", success)
 	return success
 }
 
 // GetSucNodeID returns the SUC node ID
 // The SUC manages the list of nodes in the network and can reassign the primary controller device
-func (ozwAPI *OzwAPI) GetSucNodeID() uint8 {
-	sucNodeID := goopenzwave.GetSUCNodeID(ozwAPI.homeID)
-	logrus.Infof("OzwAPI.GetSicMpdeOd: SUC node ID: %d ", sucNodeID)
+func (ozwAPI *OzwAPI) GetSucNodeID(homeID uint32) uint8 {
+	sucNodeID := goopenzwave.GetSUCNodeID(homeID)
+	logrus.Infof("OzwAPI.GetSucNodeID: SUC node ID: %d ", sucNodeID)
 	return sucNodeID
 }
 
 // IsAlive check if openzwave connection is still alive
 // Return true if initializing or running. False if stopped or controller is no longer communicating
-// (this might not be fool proof)
-func (ozwAPI *OzwAPI) IsAlive() bool {
-	if ozwAPI.homeID == 0 {
+// (this might not be fool proof). Whether the controller device is still available is checked by the app
+// as it depends on how the controller is attached.
+func (ozwAPI *OzwAPI) IsAlive(controller *ZWaveController) bool {
+	state := ozwAPI.GetControllerState(controller)
+	if state.DriverFailed {
+		return false
+	}
+	if state.HomeID == 0 {
 		// initializing
 		return true
 	}
-	// check if the device still exists
-	_, err := os.Stat(ozwAPI.address)
 	//qstage := goopenzwave.GetNodeQueryStage(ozwAPI.homeId, ozwAPI.nodeId)
-	isFailed := goopenzwave.IsNodeFailed(ozwAPI.homeID, ozwAPI.nodeID)
-	return !isFailed && err == nil
+	isFailed := goopenzwave.IsNodeFailed(state.HomeID, state.NodeID)
+	return !isFailed
 }
 
 // NewOzwAPI creates a new instance of the OpenZwave interface
 func NewOzwAPI() *OzwAPI {
 	ozwAPI := new(OzwAPI)
-	//ozwAPI.initialQueryComplete = make(chan bool)
-	ozwAPI.notificationChan = make(chan *goopenzwave.Notification) // notification handling channel
+	ozwAPI.phaseChanged = make(chan bool)
 	return ozwAPI
 }
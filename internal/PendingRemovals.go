@@ -0,0 +1,71 @@
+// Package internal with tracking of requested node removals
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// RemovalConfirmTimeout is the time in seconds a node removal is expected after it is requested
+const RemovalConfirmTimeout = 120
+
+// PendingRemovals tracks node removals that were requested through the controller.
+// Openzwave also reports nodes as removed when a driver is removed, eg when reconnecting to the controller.
+// Only removals during an exclusion or after a remove failed node request are confirmed removals.
+type PendingRemovals struct {
+	timeout           time.Duration
+	exclusionByHomeID map[uint32]time.Time // end of the exclusion of a network
+	removalByNodeHWID map[string]time.Time // end of the wait for the removal of a failed node
+	updateMutex       sync.Mutex
+}
+
+// StartExclusion starts the window in which nodes removed from the network are confirmed removals
+func (removals *PendingRemovals) StartExclusion(homeID uint32) {
+	removals.updateMutex.Lock()
+	defer removals.updateMutex.Unlock()
+	removals.exclusionByHomeID[homeID] = time.Now().Add(removals.timeout)
+}
+
+// EndExclusion ends the exclusion of the network, eg when it is cancelled
+func (removals *PendingRemovals) EndExclusion(homeID uint32) {
+	removals.updateMutex.Lock()
+	defer removals.updateMutex.Unlock()
+	delete(removals.exclusionByHomeID, homeID)
+}
+
+// AddNodeRemoval adds a node whose removal was requested, eg with remove failed node
+func (removals *PendingRemovals) AddNodeRemoval(nodeHWID string) {
+	removals.updateMutex.Lock()
+	defer removals.updateMutex.Unlock()
+	removals.removalByNodeHWID[nodeHWID] = time.Now().Add(removals.timeout)
+}
+
+// ConfirmRemoval returns true if the removal of the node was requested, either during an exclusion of its
+// network or for the node itself. A confirmed node removal is no longer pending.
+func (removals *PendingRemovals) ConfirmRemoval(homeID uint32, nodeHWID string) bool {
+	removals.updateMutex.Lock()
+	defer removals.updateMutex.Unlock()
+	now := time.Now()
+	endTime, found := removals.removalByNodeHWID[nodeHWID]
+	if found {
+		delete(removals.removalByNodeHWID, nodeHWID)
+		if now.Before(endTime) {
+			return true
+		}
+	}
+	endTime, found = removals.exclusionByHomeID[homeID]
+	if found && now.Before(endTime) {
+		return true
+	}
+	return false
+}
+
+// NewPendingRemovals creates the tracking of node removals that are confirmed until the timeout expires
+func NewPendingRemovals(timeout time.Duration) *PendingRemovals {
+	removals := &PendingRemovals{
+		timeout:           timeout,
+		exclusionByHomeID: make(map[uint32]time.Time),
+		removalByNodeHWID: make(map[string]time.Time),
+	}
+	return removals
+}
@@ -0,0 +1,43 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingRemovalsExclusion(t *testing.T) {
+	removals := internal.NewPendingRemovals(time.Minute)
+	// nodes removed by the driver are not confirmed
+	assert.False(t, removals.ConfirmRemoval(testHomeID, "5"))
+
+	removals.StartExclusion(testHomeID)
+	assert.True(t, removals.ConfirmRemoval(testHomeID, "5"))
+	// multiple nodes can be excluded
+	assert.True(t, removals.ConfirmRemoval(testHomeID, "6"))
+	// only in the network being excluded
+	assert.False(t, removals.ConfirmRemoval(testHomeID+1, "e1f2a3b5-6"))
+
+	removals.EndExclusion(testHomeID)
+	assert.False(t, removals.ConfirmRemoval(testHomeID, "7"))
+}
+
+func TestPendingRemovalsFailedNode(t *testing.T) {
+	removals := internal.NewPendingRemovals(time.Minute)
+	removals.AddNodeRemoval("5")
+	assert.False(t, removals.ConfirmRemoval(testHomeID, "6"))
+	assert.True(t, removals.ConfirmRemoval(testHomeID, "5"))
+	// the removal is confirmed once
+	assert.False(t, removals.ConfirmRemoval(testHomeID, "5"))
+}
+
+func TestPendingRemovalsTimeout(t *testing.T) {
+	removals := internal.NewPendingRemovals(10 * time.Millisecond)
+	removals.StartExclusion(testHomeID)
+	removals.AddNodeRemoval("5")
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, removals.ConfirmRemoval(testHomeID, "5"))
+	assert.False(t, removals.ConfirmRemoval(testHomeID, "6"))
+}
@@ -0,0 +1,422 @@
+// Package internal with provisioned inclusion of devices with a name, location and profile to apply
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// ProvisioningFileSuffix to append to the name of the file containing the saved provisioning list
+const ProvisioningFileSuffix = "-provisioning.json"
+
+// ProvisionedInclusionTimeout is the max time in seconds for a provisioned device to join after its inclusion
+// is started. This includes the time to press the button on the device.
+const ProvisionedInclusionTimeout = 300
+
+// OutputTypeProvisioning is the gateway output that publishes the provisioning list
+const OutputTypeProvisioning types.OutputType = "provisioning"
+
+// OutputInstanceProvisioningList is the instance of the provisioning output with the list of entries
+const OutputInstanceProvisioningList = "list"
+
+// ProvisioningState is the state of a device in the provisioning list
+type ProvisioningState string
+
+// Provisioning states
+const (
+	ProvisioningStatePending  ProvisioningState = "pending"  // the device hasn't joined yet
+	ProvisioningStateIncluded ProvisioningState = "included" // the device joined, waiting for its queries
+	ProvisioningStateApplied  ProvisioningState = "applied"  // the name, location and profile are applied
+)
+
+// ProvisioningEntry is a device in the provisioning list with the name, location and configuration profile
+// to apply when it joins the network
+// The DSK identifies the entry. It is the key printed on the device label but it isn't verified with the device.
+type ProvisioningEntry struct {
+	DSK      string            `json:"dsk"`                // device specific key, 8 groups of 5 digits
+	Name     string            `json:"name,omitempty"`     // name to give the node
+	Location string            `json:"location,omitempty"` // location to give the node
+	Profile  string            `json:"profile,omitempty"`  // name of the configuration profile to apply
+	State    ProvisioningState `json:"state"`              // pending, included or applied
+	NodeHWID string            `json:"nodeHWID,omitempty"` // node of the device once included
+}
+
+// provisionedInclusion is an inclusion started for a provisioning entry
+type provisionedInclusion struct {
+	dsk      string
+	deadline time.Time // end of the wait for the device to join
+}
+
+// ProvisioningList holds the devices that are provisioned for inclusion
+// This is provisioned inclusion, not S2 or SmartStart provisioning. Goopenzwave can't pass a DSK to the
+// controller, so a device is matched to its entry by starting the inclusion for the entry. The next device that
+// joins the network during that inclusion is bound to the entry.
+type ProvisioningList struct {
+	timeout           time.Duration
+	entryByDSK        map[string]*ProvisioningEntry
+	inclusionByHomeID map[uint32]provisionedInclusion // inclusion in progress in a network
+	updateMutex       sync.Mutex
+}
+
+// ParseDSK returns the DSK in its canonical notation of 8 dash separated groups of 5 digits
+// The groups are accepted without dashes, eg as printed on the device label, and must each be at most 65535.
+func ParseDSK(dsk string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, dsk)
+	if len(digits) != 40 {
+		return "", lib.MakeErrorf("ParseDSK: DSK '%s' must have 40 digits", dsk)
+	}
+	groups := make([]string, 0, 8)
+	for index := 0; index < 40; index += 5 {
+		group := digits[index : index+5]
+		_, err := strconv.ParseUint(group, 10, 16)
+		if err != nil {
+			return "", lib.MakeErrorf("ParseDSK: DSK '%s' has invalid group '%s'", dsk, group)
+		}
+		groups = append(groups, group)
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// Add adds a device to the list or updates the name, location and profile of a pending device
+func (provisioning *ProvisioningList) Add(entry ProvisioningEntry) (*ProvisioningEntry, error) {
+	dsk, err := ParseDSK(entry.DSK)
+	if err != nil {
+		return nil, err
+	}
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	existing := provisioning.entryByDSK[dsk]
+	if existing != nil && existing.State != ProvisioningStatePending {
+		return nil, lib.MakeErrorf("ProvisioningList.Add: Device %s is already included as node %s", dsk, existing.NodeHWID)
+	}
+	newEntry := &ProvisioningEntry{
+		DSK:      dsk,
+		Name:     entry.Name,
+		Location: entry.Location,
+		Profile:  entry.Profile,
+		State:    ProvisioningStatePending,
+	}
+	provisioning.entryByDSK[dsk] = newEntry
+	entryCopy := *newEntry
+	return &entryCopy, nil
+}
+
+// Remove removes a device from the list. Returns false if the device isn't in the list.
+// An inclusion in progress for the device is forgotten.
+func (provisioning *ProvisioningList) Remove(dsk string) bool {
+	dsk, err := ParseDSK(dsk)
+	if err != nil {
+		return false
+	}
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	_, found := provisioning.entryByDSK[dsk]
+	delete(provisioning.entryByDSK, dsk)
+	for homeID, inclusion := range provisioning.inclusionByHomeID {
+		if inclusion.dsk == dsk {
+			delete(provisioning.inclusionByHomeID, homeID)
+		}
+	}
+	return found
+}
+
+// GetEntries returns a copy of the entries ordered by DSK
+func (provisioning *ProvisioningList) GetEntries() []ProvisioningEntry {
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	entries := make([]ProvisioningEntry, 0, len(provisioning.entryByDSK))
+	for _, entry := range provisioning.entryByDSK {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DSK < entries[j].DSK })
+	return entries
+}
+
+// SetEntries replaces the entries of the list, eg when loading the saved list
+// Entries with an invalid DSK are ignored.
+func (provisioning *ProvisioningList) SetEntries(entries []ProvisioningEntry) {
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	provisioning.entryByDSK = make(map[string]*ProvisioningEntry)
+	for _, entry := range entries {
+		dsk, err := ParseDSK(entry.DSK)
+		if err != nil {
+			logrus.Warningf("ProvisioningList.SetEntries: %v. Ignored.", err)
+			continue
+		}
+		newEntry := entry
+		newEntry.DSK = dsk
+		if newEntry.State == "" {
+			newEntry.State = ProvisioningStatePending
+		}
+		provisioning.entryByDSK[dsk] = &newEntry
+	}
+}
+
+// StartInclusion starts tracking the inclusion of a pending device in a network. This returns an error if the
+// device isn't pending or if an inclusion for another device is in progress in the network.
+func (provisioning *ProvisioningList) StartInclusion(homeID uint32, dsk string, now time.Time) error {
+	dsk, err := ParseDSK(dsk)
+	if err != nil {
+		return err
+	}
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	entry := provisioning.entryByDSK[dsk]
+	if entry == nil {
+		return lib.MakeErrorf("ProvisioningList.StartInclusion: Device %s is not in the provisioning list", dsk)
+	} else if entry.State != ProvisioningStatePending {
+		return lib.MakeErrorf("ProvisioningList.StartInclusion: Device %s is already included as node %s", dsk, entry.NodeHWID)
+	}
+	inclusion, found := provisioning.inclusionByHomeID[homeID]
+	if found && inclusion.dsk != dsk && now.Before(inclusion.deadline) {
+		return lib.MakeErrorf("ProvisioningList.StartInclusion: Device %s is already being included", inclusion.dsk)
+	}
+	provisioning.inclusionByHomeID[homeID] = provisionedInclusion{dsk: dsk, deadline: now.Add(provisioning.timeout)}
+	return nil
+}
+
+// EndInclusion stops tracking the inclusion in progress in a network, eg when it is cancelled or has failed
+func (provisioning *ProvisioningList) EndInclusion(homeID uint32) {
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	delete(provisioning.inclusionByHomeID, homeID)
+}
+
+// BindNewNode binds a node that joined a network to the device whose inclusion is in progress in the network.
+// This returns the included entry, or nil if no inclusion is in progress or it has expired.
+func (provisioning *ProvisioningList) BindNewNode(homeID uint32, nodeHWID string, now time.Time) *ProvisioningEntry {
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	inclusion, found := provisioning.inclusionByHomeID[homeID]
+	if !found {
+		return nil
+	}
+	delete(provisioning.inclusionByHomeID, homeID)
+	entry := provisioning.entryByDSK[inclusion.dsk]
+	if entry == nil || entry.State != ProvisioningStatePending || now.After(inclusion.deadline) {
+		return nil
+	}
+	entry.State = ProvisioningStateIncluded
+	entry.NodeHWID = nodeHWID
+	entryCopy := *entry
+	return &entryCopy
+}
+
+// GetIncludedEntry returns a copy of the entry of a node that is included and not yet applied
+// Returns nil if the node wasn't included from the provisioning list or the entry is already applied.
+func (provisioning *ProvisioningList) GetIncludedEntry(nodeHWID string) *ProvisioningEntry {
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	for _, entry := range provisioning.entryByDSK {
+		if entry.NodeHWID == nodeHWID && entry.State == ProvisioningStateIncluded {
+			entryCopy := *entry
+			return &entryCopy
+		}
+	}
+	return nil
+}
+
+// TakeIncludedEntry returns the entry of a node that is included and not yet applied, and marks it as applied.
+// Returns nil if the node wasn't included from the provisioning list.
+func (provisioning *ProvisioningList) TakeIncludedEntry(nodeHWID string) *ProvisioningEntry {
+	provisioning.updateMutex.Lock()
+	defer provisioning.updateMutex.Unlock()
+	for _, entry := range provisioning.entryByDSK {
+		if entry.NodeHWID == nodeHWID && entry.State == ProvisioningStateIncluded {
+			entry.State = ProvisioningStateApplied
+			entryCopy := *entry
+			return &entryCopy
+		}
+	}
+	return nil
+}
+
+// NewProvisioningList creates an empty provisioning list. Inclusions of provisioned devices expire after the
+// timeout.
+func NewProvisioningList(timeout time.Duration) *ProvisioningList {
+	provisioning := &ProvisioningList{
+		timeout:           timeout,
+		entryByDSK:        make(map[string]*ProvisioningEntry),
+		inclusionByHomeID: make(map[uint32]provisionedInclusion),
+	}
+	return provisioning
+}
+
+// LoadProvisioningList loads the saved provisioning list from the cache folder
+func (app *OpenZWaveApp) LoadProvisioningList() error {
+	filename := path.Join(app.GetCacheFolder(), AppID+ProvisioningFileSuffix)
+	listJSON, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return lib.MakeErrorf("LoadProvisioningList: Unable to read %s: %v", filename, err)
+	}
+	entries := make([]ProvisioningEntry, 0)
+	err = json.Unmarshal(listJSON, &entries)
+	if err != nil {
+		return lib.MakeErrorf("LoadProvisioningList: Invalid provisioning list in %s: %v", filename, err)
+	}
+	app.provisioning.SetEntries(entries)
+	logrus.Infof("LoadProvisioningList: Loaded %d provisioned devices", len(entries))
+	return nil
+}
+
+// SaveProvisioningList saves the provisioning list to the cache folder and publishes it on the gateway node
+func (app *OpenZWaveApp) SaveProvisioningList() error {
+	filename := path.Join(app.GetCacheFolder(), AppID+ProvisioningFileSuffix)
+	listJSON, _ := json.MarshalIndent(app.provisioning.GetEntries(), "", "  ")
+	app.publishProvisioningList()
+	err := ioutil.WriteFile(filename, listJSON, 0644)
+	if err != nil {
+		return lib.MakeErrorf("SaveProvisioningList: Unable to save %s: %v", filename, err)
+	}
+	return nil
+}
+
+// createProvisioningInputs creates the inputs and output of the gateway node to manage the provisioning list
+func (app *OpenZWaveApp) createProvisioningInputs(nodeHWID string) {
+	pub := app.pub
+	if pub.GetInputByNodeHWID(nodeHWID, types.InputTypePushButton, ButtonInstanceAddProvisioning) != nil {
+		return
+	}
+	input := pub.CreateInput(nodeHWID, types.InputTypePushButton, ButtonInstanceAddProvisioning, app.HandleInputCommand)
+	input.Attr[types.NodeAttrDescription] = "Add a device to the provisioning list. Payload is {\"dsk\": \"...\", \"name\": \"...\", \"location\": \"...\", \"profile\": \"...\"}"
+	input = pub.CreateInput(nodeHWID, types.InputTypePushButton, ButtonInstanceRemoveProvisioning, app.HandleInputCommand)
+	input.Attr[types.NodeAttrDescription] = "Remove the device with the DSK in the payload from the provisioning list"
+	pub.CreateOutput(nodeHWID, OutputTypeProvisioning, OutputInstanceProvisioningList)
+}
+
+// publishProvisioningList publishes the provisioning list on the gateway node
+func (app *OpenZWaveApp) publishProvisioningList() {
+	listJSON, _ := json.Marshal(app.provisioning.GetEntries())
+	app.pub.UpdateOutputValue(types.NodeIDGateway, OutputTypeProvisioning, OutputInstanceProvisioningList, string(listJSON))
+}
+
+// AddProvisioningEntry adds a device to the provisioning list, or updates a pending device
+// The profile, if any, must be one of the configured configuration profiles.
+func (app *OpenZWaveApp) AddProvisioningEntry(entry ProvisioningEntry) (*ProvisioningEntry, error) {
+	if entry.Profile != "" && findConfigProfileByName(app.config.Profiles, entry.Profile) == nil {
+		return nil, lib.MakeErrorf("AddProvisioningEntry: Unknown configuration profile '%s'", entry.Profile)
+	}
+	newEntry, err := app.provisioning.Add(entry)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("AddProvisioningEntry: Device %s provisioned as '%s' in '%s'", newEntry.DSK, newEntry.Name, newEntry.Location)
+	return newEntry, app.SaveProvisioningList()
+}
+
+// RemoveProvisioningEntry removes a device from the provisioning list. The node of an included device remains.
+func (app *OpenZWaveApp) RemoveProvisioningEntry(dsk string) error {
+	if !app.provisioning.Remove(dsk) {
+		return lib.MakeErrorf("RemoveProvisioningEntry: Device '%s' is not in the provisioning list", dsk)
+	}
+	logrus.Infof("RemoveProvisioningEntry: Device %s removed", dsk)
+	return app.SaveProvisioningList()
+}
+
+// IncludeProvisionedNode starts the inclusion of a device from the provisioning list in a network
+// Goopenzwave can't pass the DSK to the controller, so the inclusion is a regular secure inclusion. The next
+// device that joins during the inclusion is bound to the entry and gets its name, location and profile once it
+// is queried. This requires the controller to be ready.
+func (app *OpenZWaveApp) IncludeProvisionedNode(homeID uint32, dsk string) error {
+	logrus.Infof("IncludeProvisionedNode: network %x, device %s", homeID, dsk)
+	err := app.CheckControllerReady(homeID)
+	if err == nil {
+		err = app.provisioning.StartInclusion(homeID, dsk, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+	app.startControllerCommand(homeID, ButtonInstanceIncludeProvisioned)
+	if !goopenzwave.AddNode(homeID, true) {
+		app.provisioning.EndInclusion(homeID)
+		return lib.MakeErrorf("IncludeProvisionedNode: The controller rejected the inclusion of device %s", dsk)
+	}
+	return nil
+}
+
+// updateProvisionedInclusion ends the inclusion of a provisioned device when the controller command has failed
+// or was cancelled. A completed inclusion is kept until the device is bound as the new node can be reported
+// after the command completes.
+func (app *OpenZWaveApp) updateProvisionedInclusion(homeID uint32, commandState string) {
+	if IsControllerCommandDone(commandState) && commandState != ControllerCommandCompleted {
+		app.provisioning.EndInclusion(homeID)
+	}
+}
+
+// BindProvisionedNode binds a node that joined the network to the provisioned device being included, if any
+// The binding is published in the provisioning list. The DSK isn't published with the node as the node
+// isn't verified to have this DSK.
+func (app *OpenZWaveApp) BindProvisionedNode(homeID uint32, zwNodeID uint8) {
+	nodeHWID := app.MakeNodeHWID(homeID, zwNodeID)
+	entry := app.provisioning.BindNewNode(homeID, nodeHWID, time.Now())
+	if entry == nil {
+		return
+	}
+	logrus.Infof("BindProvisionedNode: Device %s joined as node %s", entry.DSK, nodeHWID)
+	app.SaveProvisioningList()
+}
+
+// HasProvisionedProfile returns true if the node is included with a provisioning entry that has a profile
+// The provisioned profile is applied instead of the profile of the node model, see ApplyConfigProfile.
+func (app *OpenZWaveApp) HasProvisionedProfile(nodeHWID string) bool {
+	entry := app.provisioning.GetIncludedEntry(nodeHWID)
+	return entry != nil && entry.Profile != ""
+}
+
+// ApplyProvisionedNode applies the name, location and configuration profile of the provisioning entry of a node
+// once it is queried. Only the name and location that are set in the entry are applied. The profile is only
+// applied if it matches the model of the node.
+func (app *OpenZWaveApp) ApplyProvisionedNode(homeID uint32, zwNodeID uint8) {
+	nodeHWID := app.MakeNodeHWID(homeID, zwNodeID)
+	entry := app.provisioning.TakeIncludedEntry(nodeHWID)
+	if entry == nil {
+		return
+	}
+	naming := types.NodeAttrMap{}
+	if entry.Name != "" && app.SetZWaveNodeNaming(nodeHWID, types.NodeAttrName, entry.Name) == nil {
+		naming[types.NodeAttrName] = entry.Name
+	}
+	if entry.Location != "" && app.SetZWaveNodeNaming(nodeHWID, types.NodeAttrLocationName, entry.Location) == nil {
+		naming[types.NodeAttrLocationName] = entry.Location
+	}
+	if len(naming) > 0 {
+		app.pub.UpdateNodeConfigValues(nodeHWID, naming)
+	}
+	if entry.Profile != "" {
+		profile := findConfigProfileByName(app.config.Profiles, entry.Profile)
+		manufacturerID := goopenzwave.GetNodeManufacturerID(homeID, zwNodeID)
+		productType := goopenzwave.GetNodeProductType(homeID, zwNodeID)
+		productID := goopenzwave.GetNodeProductID(homeID, zwNodeID)
+		if profile == nil || !profile.Matches(manufacturerID, productType, productID) {
+			logrus.Warningf("ApplyProvisionedNode: Node %s: Profile '%s' doesn't apply to this model. Ignored.",
+				nodeHWID, entry.Profile)
+			app.pub.UpdateNodeStatus(nodeHWID, map[types.NodeStatus]string{
+				types.NodeStatusLastError: "Provisioned profile '" + entry.Profile + "' doesn't apply to this model",
+			})
+		} else {
+			app.applyConfigProfile(nodeHWID, profile)
+		}
+	}
+	logrus.Infof("ApplyProvisionedNode: Node %s provisioned as '%s' in '%s'", nodeHWID, entry.Name, entry.Location)
+	app.SaveProvisioningList()
+}
@@ -0,0 +1,98 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDSK = "34028-23669-20938-46346-33746-07431-56821-14553"
+
+func TestParseDSK(t *testing.T) {
+	dsk, err := internal.ParseDSK(testDSK)
+	assert.NoError(t, err)
+	assert.Equal(t, testDSK, dsk)
+	dsk, err = internal.ParseDSK("3402823669209384634633746074315682114553")
+	assert.NoError(t, err)
+	assert.Equal(t, testDSK, dsk)
+
+	for _, invalid := range []string{"", "34028-23669", "34028-23669-20938-46346-33746-07431-56821-1455x",
+		"34028-23669-20938-46346-33746-07431-56821-65536"} {
+		_, err = internal.ParseDSK(invalid)
+		assert.Error(t, err, "DSK '%s'", invalid)
+	}
+}
+
+func TestProvisioningList(t *testing.T) {
+	now := time.Now()
+	provisioning := internal.NewProvisioningList(time.Minute)
+	_, err := provisioning.Add(internal.ProvisioningEntry{DSK: "12345"})
+	assert.Error(t, err)
+	entry, err := provisioning.Add(internal.ProvisioningEntry{DSK: "3402823669209384634633746074315682114553", Name: "sensor"})
+	require.NoError(t, err)
+	assert.Equal(t, testDSK, entry.DSK)
+	assert.Equal(t, internal.ProvisioningStatePending, entry.State)
+	// a pending device can be updated
+	entry, err = provisioning.Add(internal.ProvisioningEntry{DSK: testDSK, Name: "sensor", Location: "kitchen"})
+	require.NoError(t, err)
+	assert.Equal(t, "kitchen", entry.Location)
+	assert.Len(t, provisioning.GetEntries(), 1)
+
+	// no inclusion in progress
+	assert.Nil(t, provisioning.BindNewNode(testHomeID, "5", now))
+	err = provisioning.StartInclusion(testHomeID, "00000-00000-00000-00000-00000-00000-00000-00000", now)
+	assert.Error(t, err)
+
+	// the first node that joins during the inclusion is bound to the device
+	err = provisioning.StartInclusion(testHomeID, testDSK, now)
+	require.NoError(t, err)
+	assert.Nil(t, provisioning.TakeIncludedEntry("5"))
+	assert.Nil(t, provisioning.GetIncludedEntry("5"))
+	entry = provisioning.BindNewNode(testHomeID, "5", now.Add(time.Second))
+	require.NotNil(t, entry)
+	assert.Equal(t, internal.ProvisioningStateIncluded, entry.State)
+	assert.Equal(t, "5", entry.NodeHWID)
+	assert.Nil(t, provisioning.BindNewNode(testHomeID, "6", now.Add(time.Second)))
+	// included devices can't be included or updated again
+	assert.Error(t, provisioning.StartInclusion(testHomeID, testDSK, now))
+	_, err = provisioning.Add(internal.ProvisioningEntry{DSK: testDSK})
+	assert.Error(t, err)
+
+	entry = provisioning.GetIncludedEntry("5")
+	require.NotNil(t, entry)
+	assert.Equal(t, internal.ProvisioningStateIncluded, entry.State)
+	entry = provisioning.TakeIncludedEntry("5")
+	require.NotNil(t, entry)
+	assert.Equal(t, "kitchen", entry.Location)
+	assert.Nil(t, provisioning.TakeIncludedEntry("5"))
+	assert.Nil(t, provisioning.GetIncludedEntry("5"))
+	assert.Equal(t, internal.ProvisioningStateApplied, provisioning.GetEntries()[0].State)
+
+	assert.True(t, provisioning.Remove(testDSK))
+	assert.False(t, provisioning.Remove(testDSK))
+	assert.Empty(t, provisioning.GetEntries())
+}
+
+func TestProvisioningInclusionExpires(t *testing.T) {
+	now := time.Now()
+	provisioning := internal.NewProvisioningList(time.Minute)
+	otherDSK := "00001-00002-00003-00004-00005-00006-00007-00008"
+	provisioning.SetEntries([]internal.ProvisioningEntry{{DSK: testDSK}, {DSK: otherDSK}, {DSK: "invalid"}})
+	assert.Len(t, provisioning.GetEntries(), 2)
+
+	err := provisioning.StartInclusion(testHomeID, testDSK, now)
+	require.NoError(t, err)
+	// one inclusion per network at a time
+	assert.Error(t, provisioning.StartInclusion(testHomeID, otherDSK, now))
+	assert.Nil(t, provisioning.BindNewNode(testHomeID, "5", now.Add(2*time.Minute)))
+	assert.Equal(t, internal.ProvisioningStatePending, provisioning.GetEntries()[1].State)
+
+	// a cancelled inclusion doesn't bind the next node
+	err = provisioning.StartInclusion(testHomeID, otherDSK, now)
+	require.NoError(t, err)
+	provisioning.EndInclusion(testHomeID)
+	assert.Nil(t, provisioning.BindNewNode(testHomeID, "5", now))
+}
@@ -0,0 +1,67 @@
+// Package internal with pseudo-terminals for bridging controllers on linux
+package internal
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// OpenPseudoTerminal opens a new pseudo-terminal pair in raw mode
+// Returns the master and slave side and the path of the slave side, eg /dev/pts/3
+func OpenPseudoTerminal() (master *os.File, slave *os.File, slavePath string, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var unlock int32
+	err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if err == nil {
+		var ptyNr uint32
+		err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNr)))
+		slavePath = fmt.Sprintf("/dev/pts/%d", ptyNr)
+	}
+	if err == nil {
+		slave, err = os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err == nil {
+		err = makeRaw(slave.Fd())
+		if err != nil {
+			slave.Close()
+		}
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, "", err
+	}
+	return master, slave, slavePath, nil
+}
+
+// makeRaw disables echo and line processing of a terminal, like cfmakeraw
+// Openzwave configures the port itself when it opens it, this prevents mangling before it does.
+func makeRaw(fd uintptr) error {
+	var termios syscall.Termios
+	err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+	return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&termios)))
+}
+
+// ioctl invokes the ioctl system call
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
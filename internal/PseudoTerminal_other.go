@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+// Package internal with pseudo-terminals for bridging controllers on other platforms
+package internal
+
+import (
+	"errors"
+	"os"
+)
+
+// OpenPseudoTerminal is only supported on linux
+func OpenPseudoTerminal() (master *os.File, slave *os.File, slavePath string, err error) {
+	return nil, nil, "", errors.New("pseudo-terminals are not supported on this platform")
+}
@@ -0,0 +1,217 @@
+// Package internal with bridging of network-attached controllers to a local pseudo-terminal
+package internal
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/sirupsen/logrus"
+)
+
+// TCPGatewayPrefix is the gateway address prefix of controllers that are reached through a TCP serial
+// server such as ser2net, eg tcp://192.168.1.20:3333
+const TCPGatewayPrefix = "tcp://"
+
+// TCPBridgeDialTimeout is the timeout in seconds for connecting to the serial server
+const TCPBridgeDialTimeout = 10
+
+// IsTCPGateway returns true if the gateway address is a TCP serial server address
+func IsTCPGateway(address string) bool {
+	return strings.HasPrefix(strings.ToLower(address), TCPGatewayPrefix)
+}
+
+// TCPSerialBridge relays the data between a local pseudo-terminal and a TCP serial server.
+// Openzwave opens the pseudo-terminal as if the controller is attached locally. The bridge reconnects to
+// the serial server when the connection is lost. Data written by openzwave while disconnected is dropped.
+type TCPSerialBridge struct {
+	remoteAddress string    // host:port of the serial server
+	ptyMaster     *os.File  // master side of the pseudo-terminal
+	ptySlave      *os.File  // slave side kept open so the master stays readable when openzwave closes it
+	ptyPath       string    // path of the slave side, eg /dev/pts/3
+	conn          net.Conn  // current connection to the serial server or nil when disconnected
+	connChanged   chan bool // closed when the connection changes, see WaitForConnection
+	updateMutex   sync.Mutex
+	stop          chan bool // stop the bridge
+	stopOnce      sync.Once
+}
+
+// Start opens the pseudo-terminal and starts connecting to the serial server in the background
+// Returns the path of the pseudo-terminal to pass to openzwave.
+func (bridge *TCPSerialBridge) Start() (ptyPath string, err error) {
+	bridge.ptyMaster, bridge.ptySlave, bridge.ptyPath, err = OpenPseudoTerminal()
+	if err != nil {
+		return "", lib.MakeErrorf("TCPSerialBridge.Start: Unable to open pseudo-terminal for %s: %v", bridge.remoteAddress, err)
+	}
+	logrus.Warningf("TCPSerialBridge.Start: Bridging %s to %s", bridge.remoteAddress, bridge.ptyPath)
+	go bridge.ptyReadLoop()
+	go bridge.connectLoop()
+	return bridge.ptyPath, nil
+}
+
+// Stop closes the connection to the serial server and the pseudo-terminal
+func (bridge *TCPSerialBridge) Stop() {
+	bridge.stopOnce.Do(func() {
+		logrus.Warningf("TCPSerialBridge.Stop: Stopping bridge to %s", bridge.remoteAddress)
+		close(bridge.stop)
+		bridge.updateMutex.Lock()
+		if bridge.conn != nil {
+			bridge.conn.Close()
+		}
+		bridge.updateMutex.Unlock()
+		if bridge.ptyMaster != nil {
+			bridge.ptyMaster.Close()
+			bridge.ptySlave.Close()
+		}
+	})
+}
+
+// IsConnected returns true when the bridge is connected to the serial server
+func (bridge *TCPSerialBridge) IsConnected() bool {
+	bridge.updateMutex.Lock()
+	defer bridge.updateMutex.Unlock()
+	return bridge.conn != nil
+}
+
+// WaitForConnection waits until the bridge is connected to the serial server
+// Returns false if not connected within the timeout or when the bridge is stopped.
+func (bridge *TCPSerialBridge) WaitForConnection(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		bridge.updateMutex.Lock()
+		isConnected := bridge.conn != nil
+		connChanged := bridge.connChanged
+		bridge.updateMutex.Unlock()
+		if isConnected {
+			return true
+		}
+		select {
+		case <-connChanged:
+		case <-bridge.stop:
+			return false
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// setConnection sets the current connection to the serial server, nil when disconnected
+// Returns false if the bridge is stopped, eg while dialing, in which case the connection isn't used.
+func (bridge *TCPSerialBridge) setConnection(conn net.Conn) bool {
+	bridge.updateMutex.Lock()
+	defer bridge.updateMutex.Unlock()
+	select {
+	case <-bridge.stop:
+		if conn != nil {
+			return false
+		}
+	default:
+	}
+	bridge.conn = conn
+	close(bridge.connChanged)
+	bridge.connChanged = make(chan bool)
+	return true
+}
+
+// PtyPath returns the path of the pseudo-terminal or "" when not started
+func (bridge *TCPSerialBridge) PtyPath() string {
+	return bridge.ptyPath
+}
+
+// connectLoop connects to the serial server and relays received data to the pseudo-terminal
+// Reconnects with a backoff delay when the connection fails or is lost, until stopped.
+func (bridge *TCPSerialBridge) connectLoop() {
+	delay := ReconnectMinDelay
+	for {
+		conn, err := net.DialTimeout("tcp", bridge.remoteAddress, TCPBridgeDialTimeout*time.Second)
+		if err == nil {
+			logrus.Warningf("TCPSerialBridge.connectLoop: Connected to %s", bridge.remoteAddress)
+			delay = ReconnectMinDelay
+			// Stop doesn't close a connection that is set after it ran
+			if !bridge.setConnection(conn) {
+				conn.Close()
+				return
+			}
+			bridge.relay(conn)
+			bridge.setConnection(nil)
+			conn.Close()
+		}
+		select {
+		case <-bridge.stop:
+			return
+		default:
+		}
+		logrus.Warningf("TCPSerialBridge.connectLoop: Not connected to %s (%v). Retry in %d seconds",
+			bridge.remoteAddress, err, delay)
+		select {
+		case <-bridge.stop:
+			return
+		case <-time.After(time.Duration(delay) * time.Second):
+		}
+		delay = delay * 2
+		if delay > ReconnectMaxDelay {
+			delay = ReconnectMaxDelay
+		}
+	}
+}
+
+// relay copies data received from the serial server to the pseudo-terminal until the connection ends or the
+// pseudo-terminal can't be written
+func (bridge *TCPSerialBridge) relay(conn net.Conn) {
+	buffer := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			_, err2 := bridge.ptyMaster.Write(buffer[:n])
+			if err2 != nil {
+				// the pseudo-terminal is closed, eg by Stop
+				logrus.Errorf("TCPSerialBridge.relay: Failed writing to %s: %v", bridge.ptyPath, err2)
+				return
+			}
+		}
+		if err != nil {
+			logrus.Warningf("TCPSerialBridge.relay: Connection to %s ended: %v", bridge.remoteAddress, err)
+			return
+		}
+	}
+}
+
+// ptyReadLoop copies data written by openzwave to the serial server until stopped
+// Data is dropped while disconnected as it is reading that keeps the pseudo-terminal from blocking openzwave.
+func (bridge *TCPSerialBridge) ptyReadLoop() {
+	buffer := make([]byte, 1024)
+	for {
+		n, err := bridge.ptyMaster.Read(buffer)
+		if err != nil {
+			logrus.Warningf("TCPSerialBridge.ptyReadLoop: Pseudo-terminal %s closed: %v", bridge.ptyPath, err)
+			return
+		}
+		bridge.updateMutex.Lock()
+		conn := bridge.conn
+		bridge.updateMutex.Unlock()
+		if conn == nil {
+			logrus.Infof("TCPSerialBridge.ptyReadLoop: Not connected. Dropped %d bytes for %s", n, bridge.remoteAddress)
+			continue
+		}
+		_, err = conn.Write(buffer[:n])
+		if err != nil {
+			// the connect loop notices the lost connection on its next read
+			logrus.Warningf("TCPSerialBridge.ptyReadLoop: Failed writing to %s: %v", bridge.remoteAddress, err)
+			conn.Close()
+		}
+	}
+}
+
+// NewTCPSerialBridge creates a bridge for the given gateway address, eg tcp://host:port
+func NewTCPSerialBridge(gatewayAddress string) *TCPSerialBridge {
+	bridge := &TCPSerialBridge{
+		remoteAddress: gatewayAddress[len(TCPGatewayPrefix):],
+		connChanged:   make(chan bool),
+		stop:          make(chan bool),
+	}
+	return bridge
+}
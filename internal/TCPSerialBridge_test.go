@@ -0,0 +1,95 @@
+package internal_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitFor polls the condition until it is true or the timeout expires
+func waitFor(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestTCPSerialBridge(t *testing.T) {
+	assert.True(t, internal.IsTCPGateway("tcp://localhost:3333"))
+	assert.False(t, internal.IsTCPGateway("/dev/ttyACM0"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	bridge := internal.NewTCPSerialBridge("tcp://" + listener.Addr().String())
+	assert.False(t, bridge.WaitForConnection(10*time.Millisecond))
+	ptyPath, err := bridge.Start()
+	if err != nil {
+		t.Skipf("No pseudo-terminal support: %v", err)
+	}
+	defer bridge.Stop()
+	server, err := listener.Accept()
+	require.NoError(t, err)
+	assert.True(t, bridge.WaitForConnection(time.Second))
+	assert.True(t, bridge.IsConnected())
+
+	// openzwave side of the bridge
+	pty, err := os.OpenFile(ptyPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer pty.Close()
+
+	// binary data must pass unchanged in both directions
+	request := []byte{0x01, 0x03, 0x00, 0x15, 0xe9, '\r', '\n'}
+	_, err = pty.Write(request)
+	require.NoError(t, err)
+	received := make([]byte, len(request))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = server.Read(received)
+	require.NoError(t, err)
+	assert.Equal(t, request, received)
+
+	response := []byte{0x06, 0x01, 0x10, '\r'}
+	_, err = server.Write(response)
+	require.NoError(t, err)
+	received = make([]byte, len(response))
+	_, err = pty.Read(received)
+	require.NoError(t, err)
+	assert.Equal(t, response, received)
+
+	// losing the connection is detected
+	server.Close()
+	assert.True(t, waitFor(func() bool { return !bridge.IsConnected() }, time.Second))
+}
+
+func TestStopTCPSerialBridge(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// stopping while connecting closes the connection
+	bridge := internal.NewTCPSerialBridge("tcp://" + listener.Addr().String())
+	_, err = bridge.Start()
+	if err != nil {
+		t.Skipf("No pseudo-terminal support: %v", err)
+	}
+	bridge.Stop()
+	server, err := listener.Accept()
+	require.NoError(t, err)
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, bridge.IsConnected())
+	assert.False(t, bridge.WaitForConnection(10*time.Millisecond))
+}
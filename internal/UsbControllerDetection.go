@@ -0,0 +1,178 @@
+// Package internal with detection of USB zwave controllers
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UsbControllerID identifies a zwave USB controller model by its USB vendor and product ID
+type UsbControllerID struct {
+	VendorID  string // USB vendor ID in hex, eg 0658
+	ProductID string // USB product ID in hex, eg 0200
+	Name      string // Description of the controller(s) using this ID
+	// Products in the /dev/serial/by-id name of zwave controllers with a generic USB serial bridge ID, which is
+	// also used by devices that aren't zwave controllers. Empty if the ID identifies zwave controllers.
+	ProductNames []string
+}
+
+// KnownUsbControllers lists the USB IDs of known zwave controllers
+var KnownUsbControllers = []UsbControllerID{
+	{VendorID: "0658", ProductID: "0200", Name: "Sigma Designs, eg Aeotec Z-Stick Gen5, UZB"},
+	{VendorID: "10c4", ProductID: "ea60", Name: "Silicon Labs CP210x, eg Zooz ZST10", ProductNames: []string{"ZST10"}},
+	{VendorID: "10c4", ProductID: "8a2a", Name: "Silicon Labs, eg Nortek HUSBZB-1"},
+}
+
+// SerialByIDFolder contains the stable symlinks of USB serial devices by their ID
+const SerialByIDFolder = "/dev/serial/by-id"
+
+// SysClassTTYFolder contains the sysfs information of tty devices
+const SysClassTTYFolder = "/sys/class/tty"
+
+// FindUsbControllerAddress returns the stable /dev/serial/by-id address of the first known zwave USB controller,
+// or "" if no controller is found. If a serial number is given then only the controller with that serial number
+// is accepted. The USB vendor and product ID are read from the sysfs folder of the tty device.
+// Devices with a generic USB serial bridge ID are only accepted with a serial number or when their by-id name
+// contains the product name of a zwave controller. See UsbControllerID.
+//   serialByIDFolder is the folder with the serial device symlinks, eg SerialByIDFolder
+//   sysClassTTYFolder is the sysfs folder of tty devices, eg SysClassTTYFolder
+//   serialNumber is the optional controller serial number to match
+//   claimedAddresses are the addresses in use by other controllers, these devices are skipped
+func FindUsbControllerAddress(serialByIDFolder string, sysClassTTYFolder string, serialNumber string, claimedAddresses []string) string {
+	entries, err := ioutil.ReadDir(serialByIDFolder)
+	if err != nil {
+		logrus.Infof("FindUsbControllerAddress: No serial devices in %s: %v", serialByIDFolder, err)
+		return ""
+	}
+	for _, entry := range entries {
+		address := path.Join(serialByIDFolder, entry.Name())
+		devicePath, err := filepath.EvalSymlinks(address)
+		if err != nil {
+			continue
+		}
+		if isClaimedAddress(devicePath, claimedAddresses) {
+			logrus.Infof("FindUsbControllerAddress: %s is in use by another controller", address)
+			continue
+		}
+		ttyName := path.Base(devicePath)
+		vendorID, productID, serial := readUsbTTYInfo(sysClassTTYFolder, ttyName)
+		controller := findKnownUsbController(vendorID, productID)
+		if controller == nil {
+			logrus.Infof("FindUsbControllerAddress: %s (%s:%s) is not a known zwave controller", address, vendorID, productID)
+			continue
+		}
+		if serialNumber != "" && !strings.EqualFold(serial, serialNumber) {
+			logrus.Infof("FindUsbControllerAddress: %s (%s) serial number %s doesn't match %s",
+				address, controller.Name, serial, serialNumber)
+			continue
+		}
+		if serialNumber == "" && !controller.matchesProductName(entry.Name()) {
+			logrus.Infof("FindUsbControllerAddress: %s (%s:%s) is a generic USB serial device. Configure gatewaySerial to use it",
+				address, vendorID, productID)
+			continue
+		}
+		logrus.Infof("FindUsbControllerAddress: Found controller %s (%s) serial %s at %s",
+			address, controller.Name, serial, devicePath)
+		return address
+	}
+	return ""
+}
+
+// isClaimedAddress returns true if the device is one of the claimed addresses
+// Addresses are compared by their device path, so a claimed /dev/ttyACM0 also claims its /dev/serial/by-id link.
+func isClaimedAddress(devicePath string, claimedAddresses []string) bool {
+	for _, claimed := range claimedAddresses {
+		claimedPath, err := filepath.EvalSymlinks(claimed)
+		if err != nil {
+			claimedPath = claimed
+		}
+		if claimedPath == devicePath {
+			return true
+		}
+	}
+	return false
+}
+
+// findKnownUsbController returns the known controller with the given USB IDs or nil if not known
+func findKnownUsbController(vendorID string, productID string) *UsbControllerID {
+	for index := range KnownUsbControllers {
+		controller := &KnownUsbControllers[index]
+		if strings.EqualFold(controller.VendorID, vendorID) && strings.EqualFold(controller.ProductID, productID) {
+			return controller
+		}
+	}
+	return nil
+}
+
+// matchesProductName returns true if the by-id name of a device contains one of the product names of the
+// controller, or if the controller has a USB ID that isn't shared with other devices
+func (controller *UsbControllerID) matchesProductName(byIDName string) bool {
+	if len(controller.ProductNames) == 0 {
+		return true
+	}
+	for _, productName := range controller.ProductNames {
+		if strings.Contains(strings.ToLower(byIDName), strings.ToLower(productName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readUsbTTYInfo returns the USB vendor ID, product ID and serial number of a tty device
+// The USB device folder is a parent of the tty device folder in sysfs, eg for ttyACM devices the device is the
+// USB interface and its parent the USB device, while ttyUSB devices are one level deeper.
+func readUsbTTYInfo(sysClassTTYFolder string, ttyName string) (vendorID string, productID string, serial string) {
+	deviceFolder, err := filepath.EvalSymlinks(path.Join(sysClassTTYFolder, ttyName, "device"))
+	if err != nil {
+		return "", "", ""
+	}
+	for level := 0; level < 4 && deviceFolder != "/"; level++ {
+		vendorID = readSysfsAttr(deviceFolder, "idVendor")
+		if vendorID != "" {
+			productID = readSysfsAttr(deviceFolder, "idProduct")
+			serial = readSysfsAttr(deviceFolder, "serial")
+			return vendorID, productID, serial
+		}
+		deviceFolder = path.Dir(deviceFolder)
+	}
+	return "", "", ""
+}
+
+// readSysfsAttr reads a sysfs attribute file and returns its trimmed content, or "" if it doesn't exist
+func readSysfsAttr(folder string, attrName string) string {
+	content, err := ioutil.ReadFile(path.Join(folder, attrName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// FindUsbStickAddress returns the address of the zwave USB controller or "" if none is found
+// Controllers are identified by their USB ID and optionally the configured serial number. Systems
+// without /dev/serial/by-id fall back to the first existing address of GateWayAddresses, unless a
+// serial number is configured. Controllers in use by another gateway of the publisher are skipped.
+func (app *OpenZWaveApp) FindUsbStickAddress(controller *ZWaveController) string {
+	claimedAddresses := app.ozwAPI.GetClaimedAddresses(controller)
+	if _, err := os.Stat(SerialByIDFolder); err == nil || app.config.GatewaySerial != "" {
+		return FindUsbControllerAddress(SerialByIDFolder, SysClassTTYFolder, app.config.GatewaySerial, claimedAddresses)
+	}
+	for index := 0; index < len(GateWayAddresses); index++ {
+		addr := GateWayAddresses[index]
+		devicePath, err := filepath.EvalSymlinks(addr)
+		if err == nil && isClaimedAddress(devicePath, claimedAddresses) {
+			logrus.Infof("OpenZWaveAdapter.FindUsbStickAddress. USB port %s is in use by another controller", addr)
+			continue
+		}
+		if _, err := os.Stat(addr); err == nil {
+			logrus.Infof("OpenZWaveAdapter.FindUsbStickAddress. Scanning for possible USB port %s. Found!", addr)
+			return addr
+		}
+		logrus.Infof("OpenZWaveAdapter.FindUsbStickAddress. Scanning for possible USB port %s. Not found", addr)
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package internal_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addTestSerialDevice creates a fake tty device with its by-id symlink and sysfs USB device information
+func addTestSerialDevice(t *testing.T, root string, byIDName string, ttyName string, vendorID string, productID string, serial string) {
+	usbDevice := path.Join(root, "devices", ttyName)
+	usbInterface := path.Join(usbDevice, "1-1:1.0")
+	require.NoError(t, os.MkdirAll(usbInterface, 0755))
+	ioutil.WriteFile(path.Join(usbDevice, "idVendor"), []byte(vendorID+"\n"), 0644)
+	ioutil.WriteFile(path.Join(usbDevice, "idProduct"), []byte(productID+"\n"), 0644)
+	ioutil.WriteFile(path.Join(usbDevice, "serial"), []byte(serial+"\n"), 0644)
+
+	ttyFolder := path.Join(root, "class", "tty", ttyName)
+	require.NoError(t, os.MkdirAll(ttyFolder, 0755))
+	require.NoError(t, os.Symlink(usbInterface, path.Join(ttyFolder, "device")))
+
+	devFile := path.Join(root, "dev", ttyName)
+	require.NoError(t, os.MkdirAll(path.Dir(devFile), 0755))
+	ioutil.WriteFile(devFile, []byte{}, 0644)
+	byIDFolder := path.Join(root, "by-id")
+	require.NoError(t, os.MkdirAll(byIDFolder, 0755))
+	require.NoError(t, os.Symlink(devFile, path.Join(byIDFolder, byIDName)))
+}
+
+func TestFindUsbControllerAddress(t *testing.T) {
+	root, err := ioutil.TempDir("", "openzwave-usb")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	byIDFolder := path.Join(root, "by-id")
+	ttyFolder := path.Join(root, "class", "tty")
+
+	// no devices
+	addr := internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "", nil)
+	assert.Empty(t, addr)
+
+	// a USB serial device that is not a zwave controller is ignored
+	addTestSerialDevice(t, root, "usb-FTDI_FT232R_A1-if00-port0", "ttyACM0", "0403", "6001", "A1")
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "", nil)
+	assert.Empty(t, addr)
+
+	// a generic CP210x USB serial bridge is only used when selected by serial number
+	cp210x := path.Join(byIDFolder, "usb-Silicon_Labs_CP2102N_USB_to_UART_Bridge_Controller_0001-if00-port0")
+	addTestSerialDevice(t, root, path.Base(cp210x), "ttyUSB1", "10c4", "ea60", "0001")
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "", nil)
+	assert.Empty(t, addr)
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "0001", nil)
+	assert.Equal(t, cp210x, addr)
+
+	addTestSerialDevice(t, root, "usb-0658_0200-if00", "ttyACM1", "0658", "0200", "")
+	addTestSerialDevice(t, root, "usb-Silicon_Labs_Zooz_ZST10_B2-if00-port0", "ttyUSB0", "10c4", "ea60", "B2")
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "", nil)
+	assert.Equal(t, path.Join(byIDFolder, "usb-0658_0200-if00"), addr)
+
+	// select the controller by serial number
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "b2", nil)
+	assert.Equal(t, path.Join(byIDFolder, "usb-Silicon_Labs_Zooz_ZST10_B2-if00-port0"), addr)
+
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "C3", nil)
+	assert.Empty(t, addr)
+
+	// a controller in use by another gateway is skipped, also when claimed by its device path.
+	// The CP210x bridge with the Zooz ZST10 product name is a zwave controller.
+	claimed := []string{path.Join(root, "dev", "ttyACM1")}
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "", claimed)
+	assert.Equal(t, path.Join(byIDFolder, "usb-Silicon_Labs_Zooz_ZST10_B2-if00-port0"), addr)
+
+	claimed = append(claimed, path.Join(byIDFolder, "usb-Silicon_Labs_Zooz_ZST10_B2-if00-port0"))
+	addr = internal.FindUsbControllerAddress(byIDFolder, ttyFolder, "", claimed)
+	assert.Empty(t, addr)
+}
@@ -0,0 +1,285 @@
+// Package internal with the registry of zwave values and their inputs, outputs and configuration
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+)
+
+// valueKey identifies a zwave value. Value IDs are only unique within a zwave network.
+type valueKey struct {
+	homeID  uint32
+	valueID uint64
+}
+
+// registeredValue holds the inputs, outputs and configuration a zwave value is registered for
+type registeredValue struct {
+	zwValue    *goopenzwave.ValueID
+	inputID    string         // input that controls the value, "" if not an input
+	outputID   string         // output that publishes the value, "" if not an output
+	attrName   types.NodeAttr // node configuration attribute of the value, "" if not a configuration
+	attrID     string         // node HWID/attrName of the configuration
+	pollAttrID string         // node HWID/attrName of the poll configuration of the output
+}
+
+// ValueRegistry tracks which inputs, outputs and configuration attributes zwave values are used for.
+// Values are registered from the openzwave notification handler and looked up from both the notification
+// handler and the publisher command handlers, so all access is guarded.
+type ValueRegistry struct {
+	values          map[valueKey]*registeredValue
+	keyByInputID    map[string]valueKey
+	keyByOutputID   map[string]valueKey
+	keyByAttrID     map[string]valueKey
+	keyByPollAttrID map[string]valueKey
+	updateMutex     sync.RWMutex
+}
+
+// MakeAttrID returns the ID of a node configuration attribute, eg 5/name
+func MakeAttrID(nodeHWID string, attrName types.NodeAttr) string {
+	return fmt.Sprintf("%s/%s", nodeHWID, attrName)
+}
+
+// getEntry returns the registration of a value, creating it if needed. Must be called with the lock held.
+func (registry *ValueRegistry) getEntry(zwValue *goopenzwave.ValueID) *registeredValue {
+	key := valueKey{homeID: zwValue.HomeID, valueID: zwValue.ID}
+	entry := registry.values[key]
+	if entry == nil {
+		entry = &registeredValue{}
+		registry.values[key] = entry
+	}
+	// keep the latest value description
+	entry.zwValue = zwValue
+	return entry
+}
+
+// getValue returns the registered value for a key in one of the index maps, or nil if not registered
+func (registry *ValueRegistry) getValue(index map[string]valueKey, id string) *goopenzwave.ValueID {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	key, found := index[id]
+	if !found {
+		return nil
+	}
+	return registry.values[key].zwValue
+}
+
+// findEntry returns the registration of a value, or nil if not registered
+func (registry *ValueRegistry) findEntry(zwValue *goopenzwave.ValueID) *registeredValue {
+	return registry.values[valueKey{homeID: zwValue.HomeID, valueID: zwValue.ID}]
+}
+
+// SetInput registers the input that controls a zwave value
+func (registry *ValueRegistry) SetInput(zwValue *goopenzwave.ValueID, inputID string) {
+	registry.updateMutex.Lock()
+	defer registry.updateMutex.Unlock()
+	entry := registry.getEntry(zwValue)
+	entry.inputID = inputID
+	registry.keyByInputID[inputID] = valueKey{homeID: zwValue.HomeID, valueID: zwValue.ID}
+}
+
+// SetOutput registers the output that publishes a zwave value
+func (registry *ValueRegistry) SetOutput(zwValue *goopenzwave.ValueID, outputID string) {
+	registry.updateMutex.Lock()
+	defer registry.updateMutex.Unlock()
+	entry := registry.getEntry(zwValue)
+	entry.outputID = outputID
+	registry.keyByOutputID[outputID] = valueKey{homeID: zwValue.HomeID, valueID: zwValue.ID}
+}
+
+// SetConfigAttr registers the node configuration attribute of a zwave value
+func (registry *ValueRegistry) SetConfigAttr(zwValue *goopenzwave.ValueID, nodeHWID string, attrName types.NodeAttr) {
+	registry.updateMutex.Lock()
+	defer registry.updateMutex.Unlock()
+	entry := registry.getEntry(zwValue)
+	entry.attrName = attrName
+	entry.attrID = MakeAttrID(nodeHWID, attrName)
+	registry.keyByAttrID[entry.attrID] = valueKey{homeID: zwValue.HomeID, valueID: zwValue.ID}
+}
+
+// SetPollAttr registers the node configuration attribute for polling of an output value
+func (registry *ValueRegistry) SetPollAttr(zwValue *goopenzwave.ValueID, nodeHWID string, attrName types.NodeAttr) {
+	registry.updateMutex.Lock()
+	defer registry.updateMutex.Unlock()
+	entry := registry.getEntry(zwValue)
+	entry.pollAttrID = MakeAttrID(nodeHWID, attrName)
+	registry.keyByPollAttrID[entry.pollAttrID] = valueKey{homeID: zwValue.HomeID, valueID: zwValue.ID}
+}
+
+// GetInputID returns the ID of the input that controls the zwave value, or "" if it isn't an input
+func (registry *ValueRegistry) GetInputID(zwValue *goopenzwave.ValueID) string {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	entry := registry.findEntry(zwValue)
+	if entry == nil {
+		return ""
+	}
+	return entry.inputID
+}
+
+// GetOutputID returns the ID of the output that publishes the zwave value, or "" if it isn't an output
+func (registry *ValueRegistry) GetOutputID(zwValue *goopenzwave.ValueID) string {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	entry := registry.findEntry(zwValue)
+	if entry == nil {
+		return ""
+	}
+	return entry.outputID
+}
+
+// GetConfigAttrName returns the configuration attribute name of the zwave value, or "" if it isn't a configuration
+func (registry *ValueRegistry) GetConfigAttrName(zwValue *goopenzwave.ValueID) types.NodeAttr {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	entry := registry.findEntry(zwValue)
+	if entry == nil {
+		return ""
+	}
+	return entry.attrName
+}
+
+// GetValueByInputID returns the zwave value controlled by an input, or nil if the input has no value
+func (registry *ValueRegistry) GetValueByInputID(inputID string) *goopenzwave.ValueID {
+	return registry.getValue(registry.keyByInputID, inputID)
+}
+
+// GetValueByOutputID returns the zwave value published by an output, or nil if the output has no value
+func (registry *ValueRegistry) GetValueByOutputID(outputID string) *goopenzwave.ValueID {
+	return registry.getValue(registry.keyByOutputID, outputID)
+}
+
+// GetValueByAttrID returns the zwave value of a node configuration attribute, or nil if not a configuration value
+// The attribute ID is the node HWID/attribute name, see MakeAttrID.
+func (registry *ValueRegistry) GetValueByAttrID(attrID string) *goopenzwave.ValueID {
+	return registry.getValue(registry.keyByAttrID, attrID)
+}
+
+// GetValueByPollAttrID returns the zwave value of an output poll configuration, or nil if not a poll configuration
+func (registry *ValueRegistry) GetValueByPollAttrID(attrID string) *goopenzwave.ValueID {
+	return registry.getValue(registry.keyByPollAttrID, attrID)
+}
+
+// GetNodeConfigValues returns the zwave values of the configuration attributes of a node by attribute name
+func (registry *ValueRegistry) GetNodeConfigValues(nodeHWID string) map[types.NodeAttr]*goopenzwave.ValueID {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	prefix := nodeHWID + "/"
+	configValues := make(map[types.NodeAttr]*goopenzwave.ValueID)
+	for attrID, key := range registry.keyByAttrID {
+		if strings.HasPrefix(attrID, prefix) {
+			entry := registry.values[key]
+			configValues[entry.attrName] = entry.zwValue
+		}
+	}
+	return configValues
+}
+
+// GetNodeValues returns the registered zwave values of a node, ordered by value ID
+func (registry *ValueRegistry) GetNodeValues(homeID uint32, zwNodeID uint8) []*goopenzwave.ValueID {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	nodeValues := make([]*goopenzwave.ValueID, 0)
+	for key, entry := range registry.values {
+		if key.homeID == homeID && entry.zwValue.NodeID == zwNodeID {
+			nodeValues = append(nodeValues, entry.zwValue)
+		}
+	}
+	sort.Slice(nodeValues, func(i, j int) bool {
+		return nodeValues[i].ID < nodeValues[j].ID
+	})
+	return nodeValues
+}
+
+// GetNodeValue returns the registered zwave value of a node with the given value ID, or nil if not registered
+func (registry *ValueRegistry) GetNodeValue(homeID uint32, zwNodeID uint8, valueID uint64) *goopenzwave.ValueID {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	entry := registry.values[valueKey{homeID: homeID, valueID: valueID}]
+	if entry == nil || entry.zwValue.NodeID != zwNodeID {
+		return nil
+	}
+	return entry.zwValue
+}
+
+// removeEntry removes a value and its lookups. Must be called with the lock held.
+func (registry *ValueRegistry) removeEntry(key valueKey, entry *registeredValue) {
+	if entry.inputID != "" {
+		delete(registry.keyByInputID, entry.inputID)
+	}
+	if entry.outputID != "" {
+		delete(registry.keyByOutputID, entry.outputID)
+	}
+	if entry.attrID != "" {
+		delete(registry.keyByAttrID, entry.attrID)
+	}
+	if entry.pollAttrID != "" {
+		delete(registry.keyByPollAttrID, entry.pollAttrID)
+	}
+	delete(registry.values, key)
+}
+
+// Remove removes a zwave value and all its lookups. This returns the removed registration's
+// input and output IDs, which are "" if the value wasn't an input or output.
+func (registry *ValueRegistry) Remove(zwValue *goopenzwave.ValueID) (inputID string, outputID string) {
+	registry.updateMutex.Lock()
+	defer registry.updateMutex.Unlock()
+	key := valueKey{homeID: zwValue.HomeID, valueID: zwValue.ID}
+	entry := registry.values[key]
+	if entry == nil {
+		return "", ""
+	}
+	registry.removeEntry(key, entry)
+	return entry.inputID, entry.outputID
+}
+
+// RemoveNode removes all values of a zwave node. Returns the number of removed values.
+func (registry *ValueRegistry) RemoveNode(homeID uint32, zwNodeID uint8) int {
+	registry.updateMutex.Lock()
+	defer registry.updateMutex.Unlock()
+	count := 0
+	for key, entry := range registry.values {
+		if key.homeID == homeID && entry.zwValue.NodeID == zwNodeID {
+			registry.removeEntry(key, entry)
+			count++
+		}
+	}
+	return count
+}
+
+// RemoveNetwork removes all values of the zwave nodes of a network. Returns the number of removed values.
+func (registry *ValueRegistry) RemoveNetwork(homeID uint32) int {
+	registry.updateMutex.Lock()
+	defer registry.updateMutex.Unlock()
+	count := 0
+	for key, entry := range registry.values {
+		if key.homeID == homeID {
+			registry.removeEntry(key, entry)
+			count++
+		}
+	}
+	return count
+}
+
+// Count returns the number of registered values
+func (registry *ValueRegistry) Count() int {
+	registry.updateMutex.RLock()
+	defer registry.updateMutex.RUnlock()
+	return len(registry.values)
+}
+
+// NewValueRegistry creates an empty value registry
+func NewValueRegistry() *ValueRegistry {
+	registry := &ValueRegistry{
+		values:          make(map[valueKey]*registeredValue),
+		keyByInputID:    make(map[string]valueKey),
+		keyByOutputID:   make(map[string]valueKey),
+		keyByAttrID:     make(map[string]valueKey),
+		keyByPollAttrID: make(map[string]valueKey),
+	}
+	return registry
+}
@@ -0,0 +1,140 @@
+package internal_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHomeID = 0xe1f2a3b4
+
+func TestValueRegistryLookups(t *testing.T) {
+	registry := internal.NewValueRegistry()
+	switchValue := &goopenzwave.ValueID{HomeID: testHomeID, NodeID: 5, ID: 1001}
+	configValue := &goopenzwave.ValueID{HomeID: testHomeID, NodeID: 5, ID: 1002}
+
+	registry.SetOutput(switchValue, "5/switch/1")
+	registry.SetInput(switchValue, "5/switch/1/input")
+	registry.SetPollAttr(switchValue, "5", "switch/1/pollIntensity")
+	registry.SetConfigAttr(configValue, "5", "3")
+	assert.Equal(t, 2, registry.Count())
+
+	assert.Equal(t, "5/switch/1", registry.GetOutputID(switchValue))
+	assert.Equal(t, "5/switch/1/input", registry.GetInputID(switchValue))
+	assert.Equal(t, switchValue, registry.GetValueByInputID("5/switch/1/input"))
+	assert.Equal(t, switchValue, registry.GetValueByOutputID("5/switch/1"))
+	assert.Equal(t, switchValue, registry.GetValueByPollAttrID(internal.MakeAttrID("5", "switch/1/pollIntensity")))
+	assert.Equal(t, types.NodeAttr("3"), registry.GetConfigAttrName(configValue))
+	assert.Equal(t, configValue, registry.GetValueByAttrID("5/3"))
+	assert.Empty(t, registry.GetOutputID(configValue))
+	assert.Nil(t, registry.GetValueByAttrID("6/3"))
+
+	nodeConfig := registry.GetNodeConfigValues("5")
+	assert.Len(t, nodeConfig, 1)
+	assert.Equal(t, configValue, nodeConfig["3"])
+	assert.Empty(t, registry.GetNodeConfigValues("50"))
+
+	// the same value ID in another network is a different value
+	otherNetworkValue := &goopenzwave.ValueID{HomeID: testHomeID + 1, NodeID: 5, ID: 1001}
+	assert.Empty(t, registry.GetOutputID(otherNetworkValue))
+
+	inputID, outputID := registry.Remove(switchValue)
+	assert.Equal(t, "5/switch/1/input", inputID)
+	assert.Equal(t, "5/switch/1", outputID)
+	assert.Nil(t, registry.GetValueByInputID("5/switch/1/input"))
+	assert.Nil(t, registry.GetValueByOutputID("5/switch/1"))
+	assert.Nil(t, registry.GetValueByPollAttrID("5/switch/1/pollIntensity"))
+	assert.Equal(t, 1, registry.Count())
+	inputID, outputID = registry.Remove(switchValue)
+	assert.Empty(t, inputID)
+	assert.Empty(t, outputID)
+}
+
+func TestValueRegistryRemoveNode(t *testing.T) {
+	registry := internal.NewValueRegistry()
+	for index := uint64(0); index < 5; index++ {
+		registry.SetOutput(&goopenzwave.ValueID{HomeID: testHomeID, NodeID: 5, ID: index}, fmt.Sprintf("5/out/%d", index))
+		registry.SetOutput(&goopenzwave.ValueID{HomeID: testHomeID, NodeID: 6, ID: 100 + index}, fmt.Sprintf("6/out/%d", index))
+	}
+	count := registry.RemoveNode(testHomeID, 5)
+	assert.Equal(t, 5, count)
+	assert.Equal(t, 5, registry.Count())
+	assert.Nil(t, registry.GetValueByOutputID("5/out/1"))
+	assert.NotNil(t, registry.GetValueByOutputID("6/out/1"))
+	assert.Equal(t, 0, registry.RemoveNode(testHomeID+1, 6))
+}
+
+func TestValueRegistryRemoveNetwork(t *testing.T) {
+	registry := internal.NewValueRegistry()
+	registry.SetOutput(&goopenzwave.ValueID{HomeID: testHomeID, NodeID: 5, ID: 1}, "5/out/1")
+	registry.SetInput(&goopenzwave.ValueID{HomeID: testHomeID, NodeID: 6, ID: 2}, "6/in/2")
+	registry.SetOutput(&goopenzwave.ValueID{HomeID: testHomeID + 1, NodeID: 5, ID: 3}, "5/out/3")
+	assert.Equal(t, 2, registry.RemoveNetwork(testHomeID))
+	assert.Nil(t, registry.GetValueByOutputID("5/out/1"))
+	assert.Nil(t, registry.GetValueByInputID("6/in/2"))
+	assert.NotNil(t, registry.GetValueByOutputID("5/out/3"))
+	assert.Equal(t, 0, registry.RemoveNetwork(testHomeID))
+}
+
+func TestValueRegistryNodeValues(t *testing.T) {
+	registry := internal.NewValueRegistry()
+	for _, valueID := range []uint64{30, 10, 20} {
+		registry.SetOutput(&goopenzwave.ValueID{HomeID: testHomeID, NodeID: 5, ID: valueID}, fmt.Sprintf("5/out/%d", valueID))
+	}
+	registry.SetOutput(&goopenzwave.ValueID{HomeID: testHomeID, NodeID: 6, ID: 40}, "6/out/40")
+	registry.SetOutput(&goopenzwave.ValueID{HomeID: testHomeID + 1, NodeID: 5, ID: 50}, "5/out/50")
+
+	nodeValues := registry.GetNodeValues(testHomeID, 5)
+	if assert.Len(t, nodeValues, 3) {
+		assert.Equal(t, uint64(10), nodeValues[0].ID)
+		assert.Equal(t, uint64(30), nodeValues[2].ID)
+	}
+	assert.Empty(t, registry.GetNodeValues(testHomeID, 7))
+
+	assert.NotNil(t, registry.GetNodeValue(testHomeID, 5, 20))
+	// values of other nodes and networks are not found
+	assert.Nil(t, registry.GetNodeValue(testHomeID, 5, 40))
+	assert.Nil(t, registry.GetNodeValue(testHomeID, 5, 50))
+}
+
+// Registration from the notification handler runs concurrently with lookups from command handlers.
+// Run with -race to detect unguarded access.
+func TestValueRegistryConcurrency(t *testing.T) {
+	registry := internal.NewValueRegistry()
+	waitGroup := sync.WaitGroup{}
+	for worker := 0; worker < 4; worker++ {
+		waitGroup.Add(2)
+		go func(worker int) {
+			defer waitGroup.Done()
+			for index := 0; index < 200; index++ {
+				zwValue := &goopenzwave.ValueID{HomeID: testHomeID, NodeID: uint8(worker + 1), ID: uint64(worker*1000 + index)}
+				nodeHWID := fmt.Sprint(worker + 1)
+				registry.SetOutput(zwValue, fmt.Sprintf("%s/out/%d", nodeHWID, index))
+				registry.SetInput(zwValue, fmt.Sprintf("%s/in/%d", nodeHWID, index))
+				registry.SetConfigAttr(zwValue, nodeHWID, types.NodeAttr(fmt.Sprint(index)))
+				if index%10 == 0 {
+					registry.Remove(zwValue)
+				}
+			}
+		}(worker)
+		go func(worker int) {
+			defer waitGroup.Done()
+			nodeHWID := fmt.Sprint(worker + 1)
+			for index := 0; index < 200; index++ {
+				registry.GetValueByInputID(fmt.Sprintf("%s/in/%d", nodeHWID, index))
+				registry.GetNodeConfigValues(nodeHWID)
+				registry.Count()
+			}
+		}(worker)
+	}
+	waitGroup.Wait()
+	// 20 of each 200 values were removed
+	assert.Equal(t, 4*180, registry.Count())
+	assert.Equal(t, 4*180, registry.RemoveNode(testHomeID, 1)+registry.RemoveNode(testHomeID, 2)+
+		registry.RemoveNode(testHomeID, 3)+registry.RemoveNode(testHomeID, 4))
+}
@@ -0,0 +1,163 @@
+// Package internal with management of the zwave controllers used by the publisher
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/types"
+)
+
+// ZWaveController holds the state of a zwave controller (gateway) attached to the publisher
+// Each controller has its own openzwave driver and network with its own home ID. The address, home ID, node ID,
+// driver failure and phase change while running and are guarded by the OzwAPI state mutex. Read them with
+// OzwAPI.GetControllerState.
+type ZWaveController struct {
+	gateway      string           // configured gateway address, "" for automatic detection of a USB controller
+	address      string           // device address used by the openzwave driver, "" when no driver is added
+	homeID       uint32           // controller home id set when the driver is ready
+	nodeID       uint8            // controller node id set when the driver is ready
+	driverFailed bool             // the driver failed, eg the device is missing
+	isLost       bool             // the connection to the controller was lost, see ReconnectController
+	phase        ControllerPhase  // driver startup phase
+	tcpBridge    *TCPSerialBridge // bridge to a network-attached controller, nil if attached locally
+}
+
+// ZWaveControllerState is a snapshot of the changing state of a controller
+type ZWaveControllerState struct {
+	Address      string          // device address used by the openzwave driver, "" when no driver is added
+	HomeID       uint32          // home ID of the network, 0 until the driver is ready
+	NodeID       uint8           // node ID of the controller, 0 until the driver is ready
+	DriverFailed bool            // the driver failed, eg the device is missing
+	IsLost       bool            // the connection was lost and the controller is reconnecting
+	Phase        ControllerPhase // driver startup phase
+}
+
+// MakeNodeHWID returns the node HWID of a zwave node
+// With a single controller this is the zwave node ID. With multiple controllers the node ID is prefixed
+// with the hex home ID of its network, eg "e1f2a3b4-5", so nodes of different networks don't collide.
+func MakeNodeHWID(homeID uint32, zwNodeID uint8, withHomeID bool) string {
+	if withHomeID {
+		return fmt.Sprintf("%08x-%d", homeID, zwNodeID)
+	}
+	return fmt.Sprint(zwNodeID)
+}
+
+// SplitNodeHWID returns the home ID and zwave node ID of a node HWID
+// The home ID is 0 if the HWID doesn't include a home ID.
+func SplitNodeHWID(nodeHWID string) (homeID uint32, zwNodeID uint8, err error) {
+	nodeIDStr := nodeHWID
+	parts := strings.SplitN(nodeHWID, "-", 2)
+	if len(parts) == 2 {
+		homeID64, err := strconv.ParseUint(parts[0], 16, 32)
+		if err != nil {
+			return 0, 0, lib.MakeErrorf("SplitNodeHWID: Invalid home ID in node '%s'", nodeHWID)
+		}
+		homeID = uint32(homeID64)
+		nodeIDStr = parts[1]
+	}
+	nodeID64, err := strconv.ParseUint(nodeIDStr, 10, 8)
+	if err != nil || nodeID64 == 0 {
+		return 0, 0, lib.MakeErrorf("SplitNodeHWID: Invalid zwave node ID in node '%s'", nodeHWID)
+	}
+	return homeID, uint8(nodeID64), nil
+}
+
+// GetGatewayAddresses returns the configured gateway addresses
+// The gateways list takes precedence over the single gateway. A single "" gateway means automatic detection.
+func (app *OpenZWaveApp) GetGatewayAddresses() []string {
+	if len(app.config.Gateways) > 0 {
+		return app.config.Gateways
+	}
+	return []string{app.config.Gateway}
+}
+
+// MakeNodeHWID returns the HWID of a zwave node in the network with the given home ID
+// Node HWIDs include the home ID when the publisher uses multiple controllers.
+func (app *OpenZWaveApp) MakeNodeHWID(homeID uint32, zwNodeID uint8) string {
+	return MakeNodeHWID(homeID, zwNodeID, len(app.ozwAPI.controllers) > 1)
+}
+
+// GetNodeAddress returns the home ID and zwave node ID of a node HWID
+// HWIDs without home ID belong to the network of the first controller.
+func (app *OpenZWaveApp) GetNodeAddress(nodeHWID string) (homeID uint32, zwNodeID uint8, err error) {
+	homeID, zwNodeID, err = SplitNodeHWID(nodeHWID)
+	if err == nil && homeID == 0 && len(app.ozwAPI.controllers) > 0 {
+		homeID = app.ozwAPI.GetControllerState(app.ozwAPI.controllers[0]).HomeID
+	}
+	return homeID, zwNodeID, err
+}
+
+// GetCommandNodeAddress returns the home ID and zwave node ID of the node in a controller command payload
+// The payload is a node ID in the network of the controller, or a node HWID.
+func (app *OpenZWaveApp) GetCommandNodeAddress(controllerHWID string, payload string) (homeID uint32, zwNodeID uint8, err error) {
+	payload = strings.TrimSpace(payload)
+	if strings.Contains(payload, "-") {
+		return app.GetNodeAddress(payload)
+	}
+	homeID, _, err = app.GetNodeAddress(controllerHWID)
+	if err == nil {
+		_, zwNodeID, err = SplitNodeHWID(payload)
+	}
+	return homeID, zwNodeID, err
+}
+
+// IsNodeOfController returns true if the node belongs to the network with the given home ID
+// With a single controller all nodes belong to its network.
+func (app *OpenZWaveApp) IsNodeOfController(nodeHWID string, homeID uint32) bool {
+	if len(app.ozwAPI.controllers) <= 1 {
+		return true
+	}
+	nodeHomeID, _, err := app.GetNodeAddress(nodeHWID)
+	return err == nil && nodeHomeID == homeID
+}
+
+// publisherRunStateRanks orders the publisher run states from working to not working
+var publisherRunStateRanks = map[types.PublisherRunState]int{
+	types.PublisherRunStateConnected:    0,
+	types.PublisherRunStateInitializing: 1,
+	types.PublisherRunStateDisconnected: 2,
+	types.PublisherRunStateFailed:       3,
+	types.PublisherRunStateLost:         4,
+}
+
+// GetControllerRunState returns the run state of a controller
+// A controller is lost while reconnecting until its device is back, failed when its driver failed,
+// disconnected when its device isn't found, initializing until its driver is ready and connected after.
+func GetControllerRunState(state ZWaveControllerState) types.PublisherRunState {
+	if state.Address == "" && state.IsLost {
+		return types.PublisherRunStateLost
+	} else if state.DriverFailed {
+		return types.PublisherRunStateFailed
+	} else if state.Address == "" {
+		return types.PublisherRunStateDisconnected
+	} else if state.Phase == ControllerPhaseStarting {
+		return types.PublisherRunStateInitializing
+	}
+	return types.PublisherRunStateConnected
+}
+
+// GetPublisherRunState returns the run state of the publisher from the states of its controllers
+// The publisher is connected when all controllers are connected, otherwise it has the state of the controller
+// that is least working, so one controller doesn't hide the state of another.
+func GetPublisherRunState(states []ZWaveControllerState) types.PublisherRunState {
+	runState := types.PublisherRunStateConnected
+	for _, state := range states {
+		controllerState := GetControllerRunState(state)
+		if publisherRunStateRanks[controllerState] > publisherRunStateRanks[runState] {
+			runState = controllerState
+		}
+	}
+	return runState
+}
+
+// updatePublisherRunState publishes the run state of the publisher derived from the state of all controllers
+func (app *OpenZWaveApp) updatePublisherRunState() {
+	states := make([]ZWaveControllerState, 0, len(app.ozwAPI.controllers))
+	for _, controller := range app.ozwAPI.controllers {
+		states = append(states, app.ozwAPI.GetControllerState(controller))
+	}
+	app.pub.SetPublisherStatus(GetPublisherRunState(states))
+}
@@ -0,0 +1,70 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeNodeHWID(t *testing.T) {
+	assert.Equal(t, "5", internal.MakeNodeHWID(0xe1f2a3b4, 5, false))
+	assert.Equal(t, "e1f2a3b4-5", internal.MakeNodeHWID(0xe1f2a3b4, 5, true))
+	assert.Equal(t, "0000a3b4-232", internal.MakeNodeHWID(0xa3b4, 232, true))
+}
+
+func TestSplitNodeHWID(t *testing.T) {
+	homeID, nodeID, err := internal.SplitNodeHWID("5")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), homeID)
+	assert.Equal(t, uint8(5), nodeID)
+
+	homeID, nodeID, err = internal.SplitNodeHWID("e1f2a3b4-12")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0xe1f2a3b4), homeID)
+	assert.Equal(t, uint8(12), nodeID)
+
+	// round trip
+	homeID, nodeID, err = internal.SplitNodeHWID(internal.MakeNodeHWID(0xa3b4, 232, true))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0xa3b4), homeID)
+	assert.Equal(t, uint8(232), nodeID)
+
+	// invalid node IDs
+	for _, hwid := range []string{"", "gateway", "0", "256", "xyz-5", "e1f2a3b4-", "e1f2a3b4-300"} {
+		_, _, err = internal.SplitNodeHWID(hwid)
+		assert.Error(t, err, "HWID '%s' should be invalid", hwid)
+	}
+}
+
+func TestGetPublisherRunState(t *testing.T) {
+	connected := internal.ZWaveControllerState{Address: "/dev/ttyACM0", HomeID: testHomeID, NodeID: 1,
+		Phase: internal.ControllerPhaseAwakeNodesQueried}
+	initializing := internal.ZWaveControllerState{Address: "/dev/ttyACM1", Phase: internal.ControllerPhaseStarting}
+	missing := internal.ZWaveControllerState{Phase: internal.ControllerPhaseStarting}
+	failed := internal.ZWaveControllerState{Address: "/dev/ttyACM1", DriverFailed: true,
+		Phase: internal.ControllerPhaseFailed}
+	lost := internal.ZWaveControllerState{DriverFailed: true, IsLost: true, Phase: internal.ControllerPhaseFailed}
+
+	assert.Equal(t, types.PublisherRunStateConnected, internal.GetControllerRunState(connected))
+	assert.Equal(t, types.PublisherRunStateInitializing, internal.GetControllerRunState(initializing))
+	assert.Equal(t, types.PublisherRunStateDisconnected, internal.GetControllerRunState(missing))
+	assert.Equal(t, types.PublisherRunStateFailed, internal.GetControllerRunState(failed))
+	assert.Equal(t, types.PublisherRunStateLost, internal.GetControllerRunState(lost))
+
+	// a controller that is ready doesn't hide the state of the others
+	testCases := []struct {
+		states   []internal.ZWaveControllerState
+		runState types.PublisherRunState
+	}{
+		{[]internal.ZWaveControllerState{connected, connected}, types.PublisherRunStateConnected},
+		{[]internal.ZWaveControllerState{connected, initializing}, types.PublisherRunStateInitializing},
+		{[]internal.ZWaveControllerState{initializing, connected, missing}, types.PublisherRunStateDisconnected},
+		{[]internal.ZWaveControllerState{failed, connected}, types.PublisherRunStateFailed},
+		{[]internal.ZWaveControllerState{connected, lost, failed}, types.PublisherRunStateLost},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.runState, internal.GetPublisherRunState(testCase.states))
+	}
+}
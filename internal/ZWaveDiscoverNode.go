@@ -26,7 +26,7 @@ func (app *OpenZWaveApp) ZWaveDiscoverController(notification *goopenzwave.Notif
 	pub := app.pub
 	zwNodeID := notification.NodeID
 	homeID := notification.HomeID
-	nodeHWID := fmt.Sprint(zwNodeID)
+	nodeHWID := app.MakeNodeHWID(homeID, zwNodeID)
 
 	logrus.Infof("ZWaveDiscoverController: HWAddress=%s", nodeHWID)
 
@@ -40,7 +40,6 @@ func (app *OpenZWaveApp) ZWaveDiscoverController(notification *goopenzwave.Notif
 	zwSUC := goopenzwave.IsStaticUpdateController(homeID)
 	zwSucNodeID := goopenzwave.GetSUCNodeID(homeID)
 	zwVersion := goopenzwave.GetVersionAsString()
-	app.ozwHomeID = notification.HomeID // for some reason ozwHomeID is not available in the command callback. Store it in ozwAPI
 
 	//version := goopenzwave.GetLibraryVersion(notification.HomeID)
 	//gw.SetAddress(adapter.Ozw.Address)
@@ -82,5 +81,19 @@ func (app *OpenZWaveApp) ZWaveDiscoverController(notification *goopenzwave.Notif
 		input = pub.CreateInput(nodeHWID, types.InputTypePushButton, ButtonInstanceUpdateNeighbors, app.HandleInputCommand)
 		input.Attr[types.NodeAttrDescription] = "Request the node to update its neighbors. Use after network changes."
 	}
+	// node commands added later
+	app.createNodeCommandInputs(nodeHWID)
+	app.createControllerCommandInputs(nodeHWID)
+	app.publishControllerRoles(homeID)
+	// Export and import of node configuration
+	input = pub.GetInputByNodeHWID(nodeHWID, types.InputTypePushButton, ButtonInstanceExportNodeConfig)
+	if input == nil {
+		input = pub.CreateInput(nodeHWID, types.InputTypePushButton, ButtonInstanceExportNodeConfig, app.HandleInputCommand)
+		input.Attr[types.NodeAttrDescription] = "Export the configuration of the node with the given node ID"
+		input = pub.CreateInput(nodeHWID, types.InputTypePushButton, ButtonInstanceImportNodeConfig, app.HandleInputCommand)
+		input.Attr[types.NodeAttrDescription] = "Import a node configuration export into a node of the same model"
+		pub.CreateOutput(nodeHWID, OutputTypeNodeConfig, NodeConfigInstanceExport)
+		pub.CreateOutput(nodeHWID, OutputTypeNodeConfig, NodeConfigInstanceImport)
+	}
 	pub.UpdateNodeErrorStatus(nodeHWID, types.NodeRunStateReady, "")
 }
@@ -20,7 +20,7 @@ func (app *OpenZWaveApp) ZWaveDiscoverNodeConfigAttr(zwValue *goopenzwave.ValueI
 	// Yet, not for user attributes that are not sensors.
 	zwValueLabel := zwValue.GetLabel()
 	zwValueString := zwValue.GetAsString()
-	nodeHWID := fmt.Sprint(zwValue.NodeID)
+	nodeHWID := app.MakeNodeHWID(zwValue.HomeID, zwValue.NodeID)
 
 	attrName := types.NodeAttr(fmt.Sprint(zwValue.Index)) // This seems not to be true in spite of documentation
 	if zwValue.Genre != goopenzwave.ValueIDGenreConfig {
@@ -38,8 +38,7 @@ func (app *OpenZWaveApp) ZWaveDiscoverNodeConfigAttr(zwValue *goopenzwave.ValueI
 	if zwIsWritable {
 		// writable values are configurable
 		// save the zwValue for the command to update the configuration
-		configAttrID := fmt.Sprintf("%s/%s", nodeHWID, attrName)
-		app.zwValueByAttrID[configAttrID] = zwValue
+		app.values.SetConfigAttr(zwValue, nodeHWID, attrName)
 
 		configAttr := nodes.NewNodeConfig(dataType, description, "")
 		app.pub.UpdateNodeConfig(nodeHWID, attrName, configAttr)
@@ -52,7 +51,6 @@ func (app *OpenZWaveApp) ZWaveDiscoverNodeConfigAttr(zwValue *goopenzwave.ValueI
 		// for fast lookup of configuration by ZW value ID and by attribute instance
 		// configID := deviceHwAddr + "." + attrName
 		// configAttr.x := zwValue.ID
-		app.attrNameByValueID[zwValue.ID] = attrName
 		// app.valueIDByConfigID[configAttr.ID] = zwValue.ID
 		logrus.Infof("ZWaveDiscoverNodeConfigAttr: Node %s; Added configuration %s (%s), value = %v",
 			nodeHWID, attrName, zwValueLabel, zwValueString)
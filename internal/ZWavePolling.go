@@ -0,0 +1,140 @@
+// Package internal with polling of zwave values that are not reported by the device
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/iotdomain/iotdomain-go/lib"
+	"github.com/iotdomain/iotdomain-go/nodes"
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/jimjibone/goopenzwave"
+	"github.com/sirupsen/logrus"
+)
+
+// OzwAttrNamePollIntensity is the suffix of the node configuration for polling an output value, see MakePollAttrName
+// 0 disables polling, 1 polls every poll interval, 2 every other interval, etc
+const OzwAttrNamePollIntensity types.NodeAttr = "pollIntensity"
+
+// PollingFileSuffix to append to the name of the file containing the saved poll intensity of outputs
+const PollingFileSuffix = "-polling.json"
+
+// pollIntensityDescription describes the poll configuration of outputs
+const pollIntensityDescription = "Poll the value every N poll intervals. 0 disables polling"
+
+// MakePollAttrName returns the node configuration attribute name for polling of an output
+// eg: temperature/1/pollIntensity
+func MakePollAttrName(outputType types.OutputType, instance string) types.NodeAttr {
+	return types.NodeAttr(fmt.Sprintf("%s/%s/%s", outputType, instance, OzwAttrNamePollIntensity))
+}
+
+// LoadPollingConfig loads the saved poll intensity of outputs from the cache folder
+// On error the saved poll intensities are discarded and outputs use the default poll intensity.
+func (app *OpenZWaveApp) LoadPollingConfig() error {
+	filename := path.Join(app.GetCacheFolder(), AppID+PollingFileSuffix)
+	pollJSON, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return lib.MakeErrorf("LoadPollingConfig: Unable to read %s: %v", filename, err)
+	}
+	app.updateMutex.Lock()
+	defer app.updateMutex.Unlock()
+	pollIntensityByOutputID := map[string]uint8{}
+	err = json.Unmarshal(pollJSON, &pollIntensityByOutputID)
+	if err != nil {
+		app.pollIntensityByOutputID = map[string]uint8{}
+		return lib.MakeErrorf("LoadPollingConfig: Invalid polling configuration in %s: %v", filename, err)
+	}
+	app.pollIntensityByOutputID = pollIntensityByOutputID
+	logrus.Infof("LoadPollingConfig: Loaded poll configuration of %d outputs", len(pollIntensityByOutputID))
+	return nil
+}
+
+// GetOutputPollIntensity returns the saved poll intensity of an output, or the configured
+// default poll intensity if the output has none.
+func (app *OpenZWaveApp) GetOutputPollIntensity(outputID string) uint8 {
+	app.updateMutex.Lock()
+	defer app.updateMutex.Unlock()
+	intensity, found := app.pollIntensityByOutputID[outputID]
+	if !found {
+		intensity = app.config.PollIntensity
+	}
+	return intensity
+}
+
+// SavePollingConfig saves the poll intensity of outputs to the cache folder
+func (app *OpenZWaveApp) SavePollingConfig() error {
+	filename := path.Join(app.GetCacheFolder(), AppID+PollingFileSuffix)
+	app.updateMutex.Lock()
+	pollJSON, _ := json.MarshalIndent(app.pollIntensityByOutputID, "", "  ")
+	app.updateMutex.Unlock()
+	err := ioutil.WriteFile(filename, pollJSON, 0644)
+	if err != nil {
+		return lib.MakeErrorf("SavePollingConfig: Unable to save %s: %v", filename, err)
+	}
+	return nil
+}
+
+// ZWaveDiscoverOutputPolling adds the poll configuration of a discovered output to its node and
+// restores the saved poll intensity of the output.
+func (app *OpenZWaveApp) ZWaveDiscoverOutputPolling(output *types.OutputDiscoveryMessage, zwValue *goopenzwave.ValueID) {
+	nodeHWID := output.NodeHWID
+	attrName := MakePollAttrName(output.OutputType, output.Instance)
+	app.values.SetPollAttr(zwValue, nodeHWID, attrName)
+
+	defaultIntensity := fmt.Sprint(app.config.PollIntensity)
+	// outputs are configured through the configuration of their node, which also holds the current intensity
+	node := app.pub.GetNodeByHWID(nodeHWID)
+	if node != nil {
+		if _, hasConfig := node.Config[attrName]; !hasConfig {
+			configAttr := nodes.NewNodeConfig(types.DataTypeNumber,
+				fmt.Sprintf("%s %s: %s", output.OutputType, output.Instance, pollIntensityDescription), defaultIntensity)
+			app.pub.UpdateNodeConfig(nodeHWID, attrName, configAttr)
+		}
+	}
+	intensity := app.GetOutputPollIntensity(output.OutputID)
+	if intensity > 0 {
+		app.applyPollIntensity(zwValue, intensity)
+	}
+	app.pub.UpdateNodeConfigValues(nodeHWID, types.NodeAttrMap{attrName: fmt.Sprint(intensity)})
+}
+
+// SetOutputPollIntensity changes the poll intensity of the output with the given poll attribute and saves it.
+// Returns an error if the intensity is not a number between 0 and 255
+func (app *OpenZWaveApp) SetOutputPollIntensity(nodeHWID string, attrName types.NodeAttr, newValue string) error {
+	zwValue := app.values.GetValueByPollAttrID(MakeAttrID(nodeHWID, attrName))
+	if zwValue == nil {
+		return lib.MakeErrorf("SetOutputPollIntensity: Node %s has no poll configuration '%s'", nodeHWID, attrName)
+	}
+	intensity, err := strconv.ParseUint(newValue, 10, 8)
+	if err != nil {
+		return lib.MakeErrorf("SetOutputPollIntensity: Node %s: Invalid poll intensity '%s' for '%s'", nodeHWID, newValue, attrName)
+	}
+	outputID := app.values.GetOutputID(zwValue)
+	app.updateMutex.Lock()
+	app.pollIntensityByOutputID[outputID] = uint8(intensity)
+	app.updateMutex.Unlock()
+	app.applyPollIntensity(zwValue, uint8(intensity))
+	return app.SavePollingConfig()
+}
+
+// applyPollIntensity enables, disables or updates the polling of a zwave value
+func (app *OpenZWaveApp) applyPollIntensity(zwValue *goopenzwave.ValueID, intensity uint8) {
+	isPolled := goopenzwave.IsValuePolled(zwValue.HomeID, zwValue.ID)
+	if intensity == 0 {
+		if isPolled {
+			goopenzwave.DisablePoll(zwValue.HomeID, zwValue.ID)
+		}
+	} else if !isPolled {
+		goopenzwave.EnablePoll(zwValue.HomeID, zwValue.ID, intensity)
+	} else {
+		goopenzwave.SetPollIntensity(zwValue.HomeID, zwValue.ID, intensity)
+	}
+	logrus.Infof("applyPollIntensity: Node %d value %s (%d): poll intensity %d",
+		zwValue.NodeID, zwValue.GetLabel(), zwValue.ID, intensity)
+}
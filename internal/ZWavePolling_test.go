@@ -0,0 +1,60 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/iotdomain/iotdomain-go/types"
+	"github.com/iotdomain/openzwave/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakePollAttrName(t *testing.T) {
+	attrName := internal.MakePollAttrName(types.OutputTypeTemperature, "1")
+	assert.Equal(t, types.NodeAttr("temperature/1/pollIntensity"), attrName)
+}
+
+func TestPollingConfig(t *testing.T) {
+	config, pub, testFolder := newTestPublisher(t)
+	defer os.RemoveAll(testFolder)
+	config.PollIntensity = 2
+	app := internal.NewOpenZwaveApp(config, pub)
+	filename := path.Join(testFolder, internal.AppID+internal.PollingFileSuffix)
+
+	// without saved configuration the outputs use the default
+	err := app.LoadPollingConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), app.GetOutputPollIntensity("5/temperature/1"))
+
+	// saved configuration overrides the default, also to disable polling
+	err = ioutil.WriteFile(filename, []byte(`{"5/temperature/1": 4, "5/humidity/1": 0}`), 0644)
+	require.NoError(t, err)
+	err = app.LoadPollingConfig()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(4), app.GetOutputPollIntensity("5/temperature/1"))
+	assert.Equal(t, uint8(0), app.GetOutputPollIntensity("5/humidity/1"))
+	assert.Equal(t, uint8(2), app.GetOutputPollIntensity("6/temperature/1"))
+
+	// the configuration is saved unchanged
+	err = os.Remove(filename)
+	require.NoError(t, err)
+	err = app.SavePollingConfig()
+	require.NoError(t, err)
+	savedJSON, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	saved := map[string]uint8{}
+	err = json.Unmarshal(savedJSON, &saved)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint8{"5/temperature/1": 4, "5/humidity/1": 0}, saved)
+
+	// an invalid configuration is reported and the outputs use the default
+	err = ioutil.WriteFile(filename, []byte(`{"5/temperature/1": 300}`), 0644)
+	require.NoError(t, err)
+	err = app.LoadPollingConfig()
+	assert.Error(t, err)
+	assert.Equal(t, uint8(2), app.GetOutputPollIntensity("5/temperature/1"))
+}
@@ -2,16 +2,77 @@
 package internal
 
 import (
-	"fmt"
-
+	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/jimjibone/goopenzwave"
 	"github.com/sirupsen/logrus"
 )
 
 // ZWaveRemoveNode is invoked by OZW when it removes a node from its network.
-// This removes the node from the IoTDomain.
+// Openzwave also removes the nodes of a driver that is removed, so only confirmed removals delete the node and
+// the registration of its values from the IoTDomain. See PendingRemovals. Other nodes are marked as lost.
 func (app *OpenZWaveApp) ZWaveRemoveNode(notification *goopenzwave.Notification) {
-	nodeHWID := fmt.Sprint(notification.NodeID)
+	nodeHWID := app.MakeNodeHWID(notification.HomeID, notification.NodeID)
+	if !app.removals.ConfirmRemoval(notification.HomeID, nodeHWID) {
+		logrus.Infof("ZWaveRemoveNode. Node %s removed by the driver. Marked as lost.", nodeHWID)
+		app.pub.UpdateNodeErrorStatus(nodeHWID, types.NodeRunStateLost, "Node removed by the driver")
+		return
+	}
+	app.values.RemoveNode(notification.HomeID, notification.NodeID)
+	app.deleteNode(nodeHWID)
+}
+
+// deleteNode deletes a node with its inputs and outputs from the IoTDomain and stops tracking it
+// The registration of its values must be removed separately.
+func (app *OpenZWaveApp) deleteNode(nodeHWID string) {
+	app.liveness.Remove(nodeHWID)
+	app.commStats.Remove(nodeHWID)
+	inputCount := 0
+	for _, input := range app.pub.GetInputs() {
+		if input.NodeHWID == nodeHWID {
+			app.pub.DeleteInput(input.InputID)
+			inputCount++
+		}
+	}
+	outputCount := 0
+	for _, output := range app.pub.GetOutputs() {
+		if output.NodeHWID == nodeHWID {
+			app.pub.DeleteOutput(output.OutputID)
+			outputCount++
+		}
+	}
 	app.pub.DeleteNode(nodeHWID)
-	logrus.Warningf("ZWaveRemoveNode. Node %s removed", nodeHWID)
+	logrus.Warningf("deleteNode. Node %s removed with %d inputs and %d outputs", nodeHWID, inputCount, outputCount)
+}
+
+// ZWaveRemoveValue is invoked by OZW when it removes a value of a node.
+// Values are also removed with the nodes of a driver that is removed. These are kept so the inputs and outputs
+// remain available when the driver is added again. Otherwise the input or output of the value is deleted.
+func (app *OpenZWaveApp) ZWaveRemoveValue(zwValue *goopenzwave.ValueID) {
+	controller := app.ozwAPI.GetControllerByHomeID(zwValue.HomeID)
+	isDriverReady := false
+	if controller != nil {
+		isDriverReady, _ = IsPhaseReached([]ControllerPhase{app.ozwAPI.GetControllerPhase(controller)}, ControllerPhaseDriverReady)
+	}
+	if !isDriverReady {
+		logrus.Infof("ZWaveRemoveValue. Value %d of node %d removed by the driver. Ignored.", zwValue.ID, zwValue.NodeID)
+		return
+	}
+	inputID, outputID := app.values.Remove(zwValue)
+	if inputID != "" {
+		app.pub.DeleteInput(inputID)
+	}
+	if outputID != "" {
+		app.pub.DeleteOutput(outputID)
+	}
+	logrus.Infof("ZWaveRemoveValue. Value %d of node %d removed. Input='%s', output='%s'",
+		zwValue.ID, zwValue.NodeID, inputID, outputID)
+}
+
+// MarkNodesLost marks the zwave nodes as lost, eg when the publisher stops
+func (app *OpenZWaveApp) MarkNodesLost(reason string) {
+	for _, node := range app.pub.GetNodes() {
+		if node.HWID != types.NodeIDGateway {
+			app.pub.UpdateNodeErrorStatus(node.HWID, types.NodeRunStateLost, reason)
+		}
+	}
 }
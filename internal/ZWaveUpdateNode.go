@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/iotdomain/iotdomain-go/nodes"
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/jimjibone/goopenzwave"
 	"github.com/sirupsen/logrus"
@@ -18,11 +19,10 @@ func (app *OpenZWaveApp) ZWaveUpdateNode(notification *goopenzwave.Notification)
 	pub := app.pub
 	homeID := notification.HomeID
 	zwNodeID := notification.NodeID
-	hwID := fmt.Sprint(zwNodeID)
+	hwID := app.MakeNodeHWID(homeID, zwNodeID)
 
 	//--- These are the known mapped attributes
 	manuID := goopenzwave.GetNodeManufacturerID(homeID, zwNodeID)
-	_ = manuID
 	manufacturer := goopenzwave.GetNodeManufacturerName(homeID, zwNodeID)
 	zwBasicType := goopenzwave.GetNodeBasicType(homeID, zwNodeID)
 	zwControllerNodeID := goopenzwave.GetControllerNodeID(homeID)
@@ -35,6 +35,8 @@ func (app *OpenZWaveApp) ZWaveUpdateNode(notification *goopenzwave.Notification)
 	zwLocation := goopenzwave.GetNodeLocation(homeID, zwNodeID)
 	zwPlusType := goopenzwave.GetNodePlusType(homeID, zwNodeID)
 	zwPlusTypeStr := goopenzwave.GetNodePlusTypeString(homeID, zwNodeID)
+	zwProductID := goopenzwave.GetNodeProductID(homeID, zwNodeID)
+	zwProductType := goopenzwave.GetNodeProductType(homeID, zwNodeID)
 	zwNodeName := goopenzwave.GetNodeName(homeID, zwNodeID)
 	zwNodeType := goopenzwave.GetNodeType(homeID, zwNodeID) // based on genericType or basicType
 	zwProductName := goopenzwave.GetNodeProductName(homeID, zwNodeID)
@@ -45,34 +47,36 @@ func (app *OpenZWaveApp) ZWaveUpdateNode(notification *goopenzwave.Notification)
 	// Ensure that the node exists
 	node := app.pub.GetNodeByHWID(hwID)
 	if node == nil {
-		app.pub.CreateNode(hwID, types.NodeTypeUnknown)
+		node = app.pub.CreateNode(hwID, types.NodeTypeUnknown)
 	}
 	nodeType := zwDeviceTypeStr
 	pub.UpdateNodeAttr(hwID, map[types.NodeAttr]string{
-		types.NodeAttrManufacturer:    manufacturer,
-		types.NodeAttrModel:           zwProductName,
-		types.NodeAttrName:            zwNodeName,
-		types.NodeAttrType:            nodeType,
-		types.NodeAttrDescription:     fmt.Sprint(zwNodeType),
-		types.NodeAttrSoftwareVersion: zwVersion,
-		// TODO: support for SetNodeLocation() via config
-		types.NodeAttrLocationName:      zwLocation,
+		types.NodeAttrManufacturer:      manufacturer,
+		types.NodeAttrModel:             zwProductName,
+		types.NodeAttrType:              nodeType,
+		types.NodeAttrDescription:       fmt.Sprint(zwNodeType),
+		types.NodeAttrSoftwareVersion:   zwVersion,
 		types.NodeAttr("Security Node"): fmt.Sprint(zwIsSecurityDevice),
 	})
 
-	nodeStatus := types.NodeRunStateLost
-	if zwIsNodeFailed {
-		nodeStatus = types.NodeRunStateError
-	} else if !goopenzwave.IsNodeAwake(homeID, zwNodeID) {
-		nodeStatus = types.NodeRunStateReady
-	} else {
-		queryStage := goopenzwave.GetNodeQueryStage(homeID, zwNodeID)
-		nodeStatus = queryStage
+	// Name and location are configurable. See HandleConfigCommand
+	if _, hasConfig := node.Config[types.NodeAttrName]; !hasConfig {
+		pub.UpdateNodeConfig(hwID, types.NodeAttrName,
+			nodes.NewNodeConfig(types.DataTypeString, "Name of the node", ""))
+		pub.UpdateNodeConfig(hwID, types.NodeAttrLocationName,
+			nodes.NewNodeConfig(types.DataTypeString, "Location of the node", ""))
 	}
-	pub.UpdateNodeStatus(hwID, map[types.NodeStatus]string{
-		types.NodeStatusRunState: nodeStatus,
+	pub.UpdateNodeConfigValues(hwID, types.NodeAttrMap{
+		types.NodeAttrName:         zwNodeName,
+		types.NodeAttrLocationName: zwLocation,
 	})
 
+	app.UpdateNodeRunState(homeID, zwNodeID, false)
+	// management commands of the node itself. The controller node has them for the node in the payload.
+	if zwNodeID != zwControllerNodeID {
+		app.createNodeCommandInputs(hwID)
+	}
+
 	//--- ZWave Specific detailed parameters
 	if app.config.IncludeZwInfo {
 		zwMaxBaudrate := goopenzwave.GetNodeMaxBaudRate(homeID, zwNodeID)
@@ -90,6 +94,9 @@ func (app *OpenZWaveApp) ZWaveUpdateNode(notification *goopenzwave.Notification)
 			"zwIsFrequentListeningDevice": fmt.Sprint(goopenzwave.IsNodeFrequentListeningDevice(homeID, zwNodeID)),
 			"zwIsInfoReceived":            fmt.Sprint(goopenzwave.IsNodeInfoReceived(homeID, zwNodeID)),
 			"zwIsRoutingDevice":           fmt.Sprint(goopenzwave.IsNodeRoutingDevice(homeID, zwNodeID)),
+			"zwManufacturerID":            manuID,
+			"zwProductID":                 zwProductID,
+			"zwProductType":               zwProductType,
 			"zwGenericType":               fmt.Sprintf("%v", zwGenericType),
 			"zwSpecificType":              fmt.Sprint(zwSpecificType),
 			"ZWwave+ type":                fmt.Sprintf("%s (%v)", zwPlusTypeStr, zwPlusType),
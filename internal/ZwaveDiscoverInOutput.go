@@ -142,7 +142,7 @@ func (app *OpenZWaveApp) ZWaveDiscoverOutput(nodeHWID string, outputType types.O
 		output = app.pub.CreateOutput(nodeHWID, outputType, zwValueInstanceStr)
 	}
 	// Track the output of a ZwValueID for fast lookup
-	app.outputIDByValueID[zwValueID] = output.OutputID
+	app.values.SetOutput(zwValue, output.OutputID)
 	// Set the output unit if it has one
 	unitName, _ := standardUnitsMap[strings.ToLower(zwValueUnit)]
 	if unitName != "" {
@@ -152,19 +152,20 @@ func (app *OpenZWaveApp) ZWaveDiscoverOutput(nodeHWID string, outputType types.O
 
 	// Writable values are also inputs
 	if zwValueWritable {
-		inputID := app.inputIDByValueID[zwValueID]
+		inputID := app.values.GetInputID(zwValue)
 		if inputID == "" {
 			input := app.pub.CreateInput(
 				nodeHWID, types.InputType(outputType), zwValueInstanceStr, app.HandleInputCommand)
 			input.Unit = unitName
 			inputID = input.InputID
-			app.inputIDByValueID[zwValueID] = inputID
 		} else {
 			input := app.pub.GetInputByID(inputID)
 			input.Unit = unitName
 		}
-		app.valueIDByInputID[inputID] = zwValueID
+		app.values.SetInput(zwValue, inputID)
 	}
+	// Values that are not reported by the device can be polled
+	app.ZWaveDiscoverOutputPolling(output, zwValue)
 
 	dataType := dataTypeMap[zwValue.Type]
 	logrus.Infof("ZWaveDiscoverOutput: Node %s: discoverProperty (%d) - type='%s' (%s), info='%s', "+
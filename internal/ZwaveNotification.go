@@ -3,6 +3,7 @@ package internal
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/jimjibone/goopenzwave"
@@ -15,8 +16,11 @@ func (app *OpenZWaveApp) ZWaveNotification(ozwAPI *OzwAPI, notification *goopenz
 	pub := app.pub
 	//adapter.log.Debugf("handleNotification: Received notification: %v", notification)
 	notificationName := notification.String()
-	nodeHWID := fmt.Sprint(notification.NodeID)
+	nodeHWID := app.MakeNodeHWID(notification.HomeID, notification.NodeID)
 	device := pub.GetNodeByHWID(nodeHWID)
+	app.metrics.CountNotification(notification.Type.String())
+	// any sign of life counts, including ignored values
+	app.UpdateNodeLastSeen(notification)
 
 	if notification.ValueID != nil {
 		valueName := notification.ValueID.GetLabel()
@@ -41,6 +45,7 @@ func (app *OpenZWaveApp) ZWaveNotification(ozwAPI *OzwAPI, notification *goopenz
 	case goopenzwave.NotificationTypeControllerCommand:
 		logrus.Infof("ZWaveNotification: Controller Command. Event=%v, notification=%v",
 			notification.Event, notification.Notification)
+		app.publishControllerCommandState(notification)
 		if *notification.Notification == goopenzwave.NotificationCodeMsgComplete {
 			// How to associate this with the request?
 
@@ -52,16 +57,33 @@ func (app *OpenZWaveApp) ZWaveNotification(ozwAPI *OzwAPI, notification *goopenz
 		app.ZwaveDiscoverNode(notification)
 
 	case goopenzwave.NotificationTypeDeleteButton:
-		app.ZWaveRemoveNode(notification)
+		// a button of a node is deleted, not the node
+		logrus.Infof("ZWaveNotification: Node %s button deleted. Ignored", nodeHWID)
 
 	case goopenzwave.NotificationTypeDriverReady:
 		app.ZWaveDiscoverController(notification)
+		app.publishControllerPhase(notification.HomeID)
+		// the driver is also ready after reconnecting to the controller
+		app.updatePublisherRunState()
 
 	case goopenzwave.NotificationTypeAwakeNodesQueried,
 		goopenzwave.NotificationTypeAllNodesQueried,
 		goopenzwave.NotificationTypeAllNodesQueriedSomeDead:
 		logrus.Info("ZWaveNotification: Nodes Queried")
 		app.ZWaveDiscoverController(notification)
+		app.publishControllerPhase(notification.HomeID)
+
+	case goopenzwave.NotificationTypeDriverReset:
+		// openzwave removed all nodes and values of the network without notifying each of them
+		logrus.Warningf("ZWaveNotification: Driver of network %x reset", notification.HomeID)
+		app.ClearNetwork(notification.HomeID)
+		app.publishControllerPhase(notification.HomeID)
+		app.updatePublisherRunState()
+
+	case goopenzwave.NotificationTypeDriverFailed:
+		logrus.Errorf("ZWaveNotification: Driver failed")
+		app.publishControllerPhase(notification.HomeID)
+		app.updatePublisherRunState()
 
 	case goopenzwave.NotificationTypeGroup:
 		// group association updated
@@ -94,17 +116,25 @@ func (app *OpenZWaveApp) ZWaveNotification(ozwAPI *OzwAPI, notification *goopenz
 
 	case goopenzwave.NotificationTypeNodeNew: // A new device previously unseen is added
 		app.ZwaveDiscoverNode(notification)
+		// a device included from the provisioning list
+		app.BindProvisionedNode(notification.HomeID, notification.NodeID)
 
 	case goopenzwave.NotificationTypeNodeQueriesComplete:
 		app.ZwaveDiscoverNode(notification)
-
-	case goopenzwave.NotificationTypeNodeRemoved: // Removed from network or because the app is closing?
-		// ignored until we can distinguish between removal and app closing
-		// TODO: remove node. Note its values are removed first
+		// all configuration values are known, apply the profile for this node model
+		app.ApplyConfigProfile(notification.HomeID, notification.NodeID)
+		// a replaced node gets the name, location and configuration of the node it replaces
+		app.RestoreReplacedNode(notification.HomeID, notification.NodeID)
+		// a provisioned device gets its name, location and profile
+		app.ApplyProvisionedNode(notification.HomeID, notification.NodeID)
+
+	case goopenzwave.NotificationTypeNodeRemoved: // Removed from the network or because its driver is removed
+		// Notifications sent while closing are discarded. Note its values are removed first.
 		app.ZWaveRemoveNode(notification)
 
 	case goopenzwave.NotificationTypeNodeNaming:
 		//One of the node names has changed (name, manufacturer, product).
+		// This keeps the name and location configuration in sync with the zwave node.
 		app.ZWaveUpdateNode(notification)
 
 	case goopenzwave.NotificationTypeNodeProtocolInfo:
@@ -148,6 +178,7 @@ func (app *OpenZWaveApp) ZWaveNotification(ozwAPI *OzwAPI, notification *goopenz
 		}
 	case goopenzwave.NotificationTypeValueChanged, goopenzwave.NotificationTypeValueRefreshed:
 		// A sensor, info or configuration value has changed value
+		app.metrics.ValueUpdated(notification.HomeID, notification.ValueID.ID, time.Now())
 		app.ZWaveUpdateValue(notification.ValueID)
 
 		// case :goopenzwave.NotificationTypeValueRefreshed
@@ -155,13 +186,16 @@ func (app *OpenZWaveApp) ZWaveNotification(ozwAPI *OzwAPI, notification *goopenz
 		// app.ZWaveUpdateValue(notification.ValueID)
 
 	case goopenzwave.NotificationTypeValueRemoved:
-		// Result of a removed node. Just handle the node removal and remove its sensors
-		// TODO: remove sensor. Note its values are removed before the node is removed
+		// A value of a node is removed, or the node itself is removed
+		app.ZWaveRemoveValue(notification.ValueID)
 
 	case goopenzwave.NotificationTypeNotification:
 		// Some error occurred
 		notificationCode := *notification.Notification
 		logrus.Warningf("ZWaveNotification: Node %s: notification: %v", nodeHWID, notificationCode)
+		if notificationCode == goopenzwave.NotificationCodeTimeout {
+			app.commStats.RecordFailed(nodeHWID)
+		}
 		if device != nil {
 			if notificationCode == goopenzwave.NotificationCodeTimeout {
 				pub.UpdateNodeErrorStatus(nodeHWID, types.NodeRunStateError, fmt.Sprint(notificationCode))
@@ -171,10 +205,10 @@ func (app *OpenZWaveApp) ZWaveNotification(ozwAPI *OzwAPI, notification *goopenz
 				// complete transaction
 			} else if notificationCode == goopenzwave.NotificationCodeSleep {
 				pub.UpdateNodeErrorStatus(nodeHWID, types.NodeRunStateSleeping, "")
-			} else if notificationCode == goopenzwave.NotificationCodeAwake {
-				pub.UpdateNodeErrorStatus(nodeHWID, types.NodeRunStateReady, "")
-			} else if notificationCode == goopenzwave.NotificationCodeAlive {
-				pub.UpdateNodeErrorStatus(nodeHWID, types.NodeRunStateReady, "")
+			} else if notificationCode == goopenzwave.NotificationCodeAwake ||
+				notificationCode == goopenzwave.NotificationCodeAlive {
+				// the node can still be initializing
+				app.UpdateNodeRunState(notification.HomeID, notification.NodeID, true)
 			}
 		}
 	default:
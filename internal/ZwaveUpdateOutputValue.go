@@ -15,7 +15,7 @@ func (app *OpenZWaveApp) ZWaveUpdateOutputValue(zwValue *goopenzwave.ValueID) {
 	zwValueString := zwValue.GetAsString()
 
 	// unknown and blacklisted types don't exist in this table and are ignored
-	outputID := app.outputIDByValueID[zwValue.ID]
+	outputID := app.values.GetOutputID(zwValue)
 	if outputID != "" {
 		output := app.pub.GetOutputByID(outputID)
 		if output != nil {
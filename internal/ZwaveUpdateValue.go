@@ -2,8 +2,6 @@
 package internal
 
 import (
-	"fmt"
-
 	"github.com/iotdomain/iotdomain-go/types"
 	"github.com/jimjibone/goopenzwave"
 	"github.com/sirupsen/logrus"
@@ -15,15 +13,15 @@ func (app *OpenZWaveApp) ZWaveUpdateValue(zwValue *goopenzwave.ValueID) {
 	// Does updateValue get called with cached values?
 	zwValueLabel := zwValue.GetLabel()
 	zwValueString := zwValue.GetAsString()
-	nodeHWID := fmt.Sprint(zwValue.NodeID)
+	nodeHWID := app.MakeNodeHWID(zwValue.HomeID, zwValue.NodeID)
 
-	outputID := app.outputIDByValueID[zwValue.ID]
+	outputID := app.values.GetOutputID(zwValue)
 	if outputID != "" {
 		app.ZWaveUpdateOutputValue(zwValue)
 	} else {
 		// This is an update of a device attribute or configuration
 		node := app.pub.GetNodeByHWID(nodeHWID)
-		attrName := app.attrNameByValueID[zwValue.ID]
+		attrName := app.values.GetConfigAttrName(zwValue)
 		//isReadOnly := zwValue.IsReadOnly()
 		//_ = isReadOnly
 		if node != nil && attrName != "" {
@@ -33,6 +31,7 @@ func (app *OpenZWaveApp) ZWaveUpdateValue(zwValue *goopenzwave.ValueID) {
 			_, isConfig := node.Config[attrName]
 			if isConfig {
 				app.pub.UpdateNodeConfigValues(nodeHWID, types.NodeAttrMap{attrName: zwValueString})
+				app.CheckConfigProfileDrift(nodeHWID)
 			} else {
 				// not config, default to so it is info attribute
 				app.pub.UpdateNodeAttr(nodeHWID, types.NodeAttrMap{types.NodeAttr(zwValueLabel): zwValueString})